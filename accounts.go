@@ -0,0 +1,188 @@
+package main
+
+import (
+	"cmp"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultPostInterval int = 24 * 60
+
+// selectedAccount is the handle given with --account, see [ParseArgs]
+var selectedAccount string
+
+// function SelectAccount scopes conn to the account named by handle. With
+// no handle, the only account is selected, or none when no accounts have
+// been added and credentials come from the environment.
+func SelectAccount(conn *Connection, handle string) (*Connection, error) {
+	if handle != "" {
+		a, err := conn.GetAccount(handle)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("unknown account %v, add it with synapse accounts add", handle)
+		} else if err != nil {
+			return nil, fmt.Errorf("unable to load account %v %v", handle, err.Error())
+		}
+
+		return conn.ForAccount(a.ID), nil
+	}
+
+	accounts, err := conn.GetAccounts()
+	if err != nil {
+		return nil, err
+	}
+
+	switch len(accounts) {
+	case 0:
+		return conn, nil
+	case 1:
+		return conn.ForAccount(accounts[0].ID), nil
+	default:
+		return nil, fmt.Errorf("there are %v accounts, choose one with --account", len(accounts))
+	}
+}
+
+// function SelectAccounts is [SelectAccount] for commands that can act for
+// every account, like the worker
+func SelectAccounts(conn *Connection, handle string) ([]*Connection, error) {
+	if handle != "" {
+		scoped, err := SelectAccount(conn, handle)
+		if err != nil {
+			return nil, err
+		}
+
+		return []*Connection{scoped}, nil
+	}
+
+	accounts, err := conn.GetAccounts()
+	if err != nil {
+		return nil, err
+	} else if len(accounts) == 0 {
+		return []*Connection{conn}, nil
+	}
+
+	conns := []*Connection{}
+	for _, a := range accounts {
+		conns = append(conns, conn.ForAccount(a.ID))
+	}
+
+	return conns, nil
+}
+
+// function AccountPasswordEnv names the environment variable holding an
+// account's app password, e.g. BLUESKY_PASSWORD_STOIC_BSKY_SOCIAL. Passwords
+// are never stored; the session tokens are enough to resume.
+func AccountPasswordEnv(handle string) string {
+	name := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+
+		return '_'
+	}, strings.TrimPrefix(handle, "@"))
+
+	return "BLUESKY_PASSWORD_" + strings.ToUpper(name)
+}
+
+// function ParseAccountArgs reads the options of accounts add
+func ParseAccountArgs(handle string, args []string) (Account, error) {
+	a := Account{Handle: handle}
+	for i := 0; i+1 < len(args); i += 2 {
+		switch args[i] {
+		case "--password", "-password":
+			return a, fmt.Errorf("passwords are not taken on the command line, set %v instead", AccountPasswordEnv(handle))
+		case "--service", "-service":
+			a.Service = args[i+1]
+		case "--interval", "--i", "-interval", "-i":
+			minutes, err := strconv.Atoi(args[i+1])
+			if err != nil || minutes <= 0 {
+				return a, fmt.Errorf("invalid interval %v", args[i+1])
+			}
+
+			a.PostInterval = minutes
+		case "--replies", "-replies":
+			a.ReplyRules = args[i+1]
+		case "--quotes", "-quotes":
+			a.QuoteRules = args[i+1]
+		default:
+			return a, fmt.Errorf("unknown option %v", args[i])
+		}
+	}
+
+	g, err := ParseGates(a.ReplyRules, a.QuoteRules)
+	a.ReplyRules, a.QuoteRules = g.Replies, g.Quotes
+
+	return a, err
+}
+
+// function ManageAccounts is the CLI entrypoint for adding, listing and
+// removing bot accounts
+func ManageAccounts(args []string) error {
+	usage := fmt.Errorf("usage: synapse accounts list|add <handle> [--service url] [--interval minutes] [--replies rules] [--quotes rule]|remove <handle>")
+	if len(args) == 0 {
+		return usage
+	}
+
+	conn := CreateConnection()
+
+	switch args[0] {
+	case "list", "ls":
+		accounts, err := conn.GetAccounts()
+		if err != nil {
+			return err
+		}
+
+		for _, a := range accounts {
+			auth := "not signed in"
+			tokens, _ := conn.ForAccount(a.ID).GetTokens(BlueskyAPI)
+			if _, err := conn.GetOAuthSession(a.Handle); err == nil {
+				auth = "OAuth"
+			} else if os.Getenv(AccountPasswordEnv(a.Handle)) != "" {
+				auth = "app password"
+			} else if t := tokens[RefreshToken]; t != nil && !t.Expired() {
+				auth = "session until " + t.ExpiresAt.Format(time.DateOnly)
+			}
+
+			logger.Infof("%v %v every %v minutes, replies %v, quotes %v (%v)", a.Handle, a.DID, a.PostInterval,
+				cmp.Or(a.ReplyRules, Everybody), cmp.Or(a.QuoteRules, Everybody), auth)
+		}
+	case "add":
+		if len(args) < 2 {
+			return usage
+		}
+
+		a, err := ParseAccountArgs(args[1], args[2:])
+		if err != nil {
+			return err
+		}
+
+		if _, err = conn.SaveAccount(a); err != nil {
+			return err
+		}
+
+		logger.Infof("saved account %v", a.Handle)
+	case "remove", "rm":
+		if len(args) < 2 {
+			return usage
+		}
+
+		a, err := conn.GetAccount(args[1])
+		if err != nil {
+			return fmt.Errorf("unknown account %v", args[1])
+		}
+
+		if err = conn.RemoveAccount(a.ID); err != nil {
+			return err
+		}
+
+		logger.Infof("removed account %v", a.Handle)
+	default:
+		return usage
+	}
+
+	return nil
+}
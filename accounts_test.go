@@ -0,0 +1,194 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAccounts(t *testing.T) {
+	conn := testConnection(t)
+
+	t.Run("no accounts leaves the connection unscoped", func(t *testing.T) {
+		got, err := SelectAccount(conn, "")
+		if err != nil || got.AccountID != 0 {
+			t.Errorf("wanted an unscoped connection but got %v %v", got, err)
+		}
+	})
+
+	t.Run("passwords are not taken on the command line", func(t *testing.T) {
+		if _, err := ParseAccountArgs("stoic.test", []string{"--password", "secret"}); err == nil {
+			t.Errorf("wanted an error but got none")
+		}
+
+		if got := AccountPasswordEnv("@stoic.bsky.social"); got != "BLUESKY_PASSWORD_STOIC_BSKY_SOCIAL" {
+			t.Errorf("wanted BLUESKY_PASSWORD_STOIC_BSKY_SOCIAL but got %v", got)
+		}
+	})
+
+	a, err := ParseAccountArgs("stoic.test", []string{"--service", "https://pds.example.com", "--interval", "60"})
+	if err != nil {
+		t.Fatalf("wanted no error but got %v", err.Error())
+	}
+
+	stoicID, _ := conn.SaveAccount(a)
+
+	t.Run("a single account is selected by default", func(t *testing.T) {
+		got, err := SelectAccount(conn, "")
+		if err != nil || got.AccountID != stoicID {
+			t.Errorf("wanted account %v but got %v %v", stoicID, got, err)
+		}
+	})
+
+	t.Run("saving again keeps the stored service", func(t *testing.T) {
+		if _, err := conn.SaveAccount(Account{Handle: "stoic.test", PostInterval: 90}); err != nil {
+			t.Fatalf("wanted no error but got %v", err.Error())
+		}
+
+		got, err := conn.GetAccount("@stoic.test")
+		if err != nil || got.Service != "https://pds.example.com" || got.PostInterval != 90 {
+			t.Errorf("unexpected account %+v %v", got, err)
+		}
+	})
+
+	t.Run("saving without an interval keeps the stored one", func(t *testing.T) {
+		a, err := ParseAccountArgs("stoic.test", []string{"--replies", "following"})
+		if err != nil {
+			t.Fatalf("wanted no error but got %v", err.Error())
+		}
+
+		if _, err = conn.SaveAccount(a); err != nil {
+			t.Fatalf("wanted no error but got %v", err.Error())
+		}
+
+		got, err := conn.GetAccount("stoic.test")
+		if err != nil || got.PostInterval != 90 || got.ReplyRules != "following" {
+			t.Errorf("unexpected account %+v %v", got, err)
+		}
+	})
+
+	gtdID, _ := conn.SaveAccount(Account{Handle: "gtd.test"})
+
+	t.Run("new accounts post daily by default", func(t *testing.T) {
+		if got, err := conn.GetAccount("gtd.test"); err != nil || got.PostInterval != DefaultPostInterval {
+			t.Errorf("unexpected account %+v %v", got, err)
+		}
+	})
+
+	t.Run("several accounts need a selector", func(t *testing.T) {
+		if _, err := SelectAccount(conn, ""); err == nil {
+			t.Errorf("wanted an error but got none")
+		}
+
+		if _, err := SelectAccount(conn, "unknown.test"); err == nil {
+			t.Errorf("wanted an error but got none")
+		}
+
+		conns, err := SelectAccounts(conn, "")
+		if err != nil || len(conns) != 2 {
+			t.Errorf("wanted both accounts but got %v %v", conns, err)
+		}
+	})
+
+	stoic, gtd := conn.ForAccount(stoicID), conn.ForAccount(gtdID)
+
+	if _, err = ImportBookcision(stoic, &Bookcision{ASIN: "B000FC1PJI", Title: "Meditations", Authors: "Marcus Aurelius", Highlights: []BookcisionHighlight{
+		{Text: "The impediment to action advances action."},
+	}}); err != nil {
+		t.Fatalf("test setup failed %v", err.Error())
+	}
+
+	if _, err = ImportBookcision(conn, &Bookcision{ASIN: "B00KWG9M2E", Title: "Getting Things Done", Authors: "David Allen", Highlights: []BookcisionHighlight{
+		{Text: "Your mind is for having ideas, not holding them."},
+	}}); err != nil {
+		t.Fatalf("test setup failed %v", err.Error())
+	}
+
+	t.Run("themed books are only posted by their account", func(t *testing.T) {
+		got, err := stoic.NextHighlight()
+		if err != nil || got.Title != "Meditations" {
+			t.Errorf("wanted Meditations but got %v %v", got, err)
+		}
+
+		got, err = gtd.NextHighlight()
+		if err != nil || got.Title != "Getting Things Done" {
+			t.Errorf("wanted Getting Things Done but got %v %v", got, err)
+		}
+	})
+
+	t.Run("accounts keep their own posts", func(t *testing.T) {
+		h, _ := gtd.NextHighlight()
+		if _, err := gtd.SavePost(StrongRef{"at://did:plc:gtd/app.bsky.feed.post/1", "cid"}, NewPost(h.Text), h.ID); err != nil {
+			t.Fatalf("test setup failed %v", err.Error())
+		}
+
+		if _, err := gtd.NextHighlight(); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("wanted every highlight to be posted but got %v", err)
+		}
+
+		// Meditations comes first by id, so post it for stoic to reach the shared book
+		first, _ := stoic.NextHighlight()
+		stoic.SavePost(StrongRef{"at://did:plc:stoic/app.bsky.feed.post/1", "cid"}, NewPost(first.Text), first.ID)
+		if got, err := stoic.NextHighlight(); err != nil || got.ID != h.ID {
+			t.Errorf("wanted the shared highlight to still be due but got %v %v", got, err)
+		}
+
+		if posts, _ := stoic.GetPosts(); len(posts) != 1 {
+			t.Errorf("wanted 1 post but got %v", len(posts))
+		}
+	})
+
+	t.Run("posts and highlights of other accounts are left alone", func(t *testing.T) {
+		uri := "at://did:plc:gtd/app.bsky.feed.post/1"
+		if err := stoic.MarkPostDeleted(uri); err != nil {
+			t.Fatalf("wanted no error but got %v", err.Error())
+		}
+
+		if posts, _ := gtd.GetPosts(); len(posts) != 1 || !posts[0].DeletedAt.IsZero() {
+			t.Errorf("wanted gtd's post to be kept but got %+v", posts)
+		}
+
+		if h, err := gtd.GetHighlights(); err != nil || len(h) != 1 || h[0].Title != "Getting Things Done" {
+			t.Errorf("wanted only the shared highlight but got %+v %v", h, err)
+		}
+	})
+
+	t.Run("tokens and cursors are per account", func(t *testing.T) {
+		stoic.SaveToken(Token{"stoic", AccessToken, BlueskyAPI, time.Now().Add(time.Hour)})
+		gtd.SaveToken(Token{"gtd", AccessToken, BlueskyAPI, time.Now().Add(time.Hour)})
+		stoic.SaveCursor(NotificationsCursor, "2024-01-01T00:00:00Z")
+
+		tokens, _ := stoic.GetTokens(BlueskyAPI)
+		if tokens[AccessToken].Token != "stoic" {
+			t.Errorf("wanted stoic's token but got %v", tokens[AccessToken].Token)
+		}
+
+		if cursor, _ := gtd.GetCursor(NotificationsCursor); cursor != "" {
+			t.Errorf("wanted no cursor but got %v", cursor)
+		}
+	})
+
+	t.Run("removed accounts release their books and sessions", func(t *testing.T) {
+		key, _ := NewDPoP()
+		if err := conn.SaveOAuthSession(OAuthSession{DID: "did:plc:stoic", Handle: "stoic.test", DPoP: key}); err != nil {
+			t.Fatalf("test setup failed %v", err.Error())
+		}
+
+		if err := conn.RemoveAccount(stoicID); err != nil {
+			t.Fatalf("wanted no error but got %v", err.Error())
+		}
+
+		if _, err := conn.GetAccount("stoic.test"); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("wanted the account to be gone but got %v", err)
+		}
+
+		if got, err := gtd.NextHighlight(); err != nil || got.Title != "Meditations" {
+			t.Errorf("wanted Meditations to be shared but got %v %v", got, err)
+		}
+
+		if _, err := conn.GetOAuthSession("stoic.test"); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("wanted the OAuth session to be gone but got %v", err)
+		}
+	})
+}
@@ -2,31 +2,66 @@ package main
 
 import (
 	"bufio"
-	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 const (
-	CreateSessionMethod AtProtoMethod = "com.atproto.server.createSession"
-	CreatePostMethod    AtProtoMethod = "com.atproto.repo.createRecord"
-	ServiceURL          string        = "https://bsky.social"
+	CreateSessionMethod     AtProtoMethod = "com.atproto.server.createSession"
+	RefreshSessionMethod    AtProtoMethod = "com.atproto.server.refreshSession"
+	GetSessionMethod        AtProtoMethod = "com.atproto.server.getSession"
+	CreateRecordMethod      AtProtoMethod = "com.atproto.repo.createRecord"
+	ResolveHandleMethod     AtProtoMethod = "com.atproto.identity.resolveHandle"
+	UploadBlobMethod        AtProtoMethod = "com.atproto.repo.uploadBlob"
+	ListRecordsMethod       AtProtoMethod = "com.atproto.repo.listRecords"
+	DeleteRecordMethod      AtProtoMethod = "com.atproto.repo.deleteRecord"
+	GetRecordMethod         AtProtoMethod = "com.atproto.repo.getRecord"
+	PutRecordMethod         AtProtoMethod = "com.atproto.repo.putRecord"
+	ListNotificationsMethod AtProtoMethod = "app.bsky.notification.listNotifications"
+	UpdateSeenMethod        AtProtoMethod = "app.bsky.notification.updateSeen"
+	GetPostsMethod          AtProtoMethod = "app.bsky.feed.getPosts"
+	ServiceURL              string        = "https://bsky.social"
+	DefaultTimeout          time.Duration = 30 * time.Second
 )
 
 type AtProtoMethod = string
 
+// AtClient is safe for concurrent use, so the worker and the server can
+// share one logged in client.
 type AtClient struct {
-	Service     string
+	Service string
+	// HTTP sends every request, see [NewHTTPClient]
+	HTTP *http.Client
+	// Credentials are guarded by mu, read them with [AtClient.CurrentCredentials]
 	Credentials AtCredentials
-}
-
-type SessionRequest struct {
-	Identifier string `json:"identifier"`
-	Password   string `json:"password"`
+	// OnSession is called whenever a session is created or refreshed
+	OnSession func(s Session)
+	// RateLimits holds the latest limits reported for each method
+	RateLimits map[AtProtoMethod]*RateLimit
+	// AuthFactor asks for the emailed sign in code when the credentials
+	// don't have one, see [PromptAuthFactor]
+	AuthFactor func(ctx context.Context) (string, error)
+	// OAuth is set when the client signs requests with DPoP-bound tokens,
+	// see [NewOAuthSessionClient]. It is guarded by mu.
+	OAuth *OAuthSession
+	// OnOAuthSession is called whenever the OAuth session is refreshed
+	OnOAuthSession func(s OAuthSession)
+	// Lexicons validate records before they are written, nil skips it
+	Lexicons *Lexicons
+
+	mu        sync.RWMutex
+	refreshMu sync.Mutex
 }
 
 type AtCredentials struct {
@@ -36,8 +71,16 @@ type AtCredentials struct {
 	RefreshToken    string
 	DID             string
 	ServiceEndpoint string
+	// Entryway is where sessions are created, e.g. a self-hosted PDS
+	Entryway string
+	// AuthFactorToken is the code emailed to accounts with two-factor
+	// sign in. It is only sent when the server asks for it.
+	AuthFactorToken string
 }
 
+// The lexicons type didDoc as unknown, so the DID document is decoded from
+// the generated session types into these hand-written DID Core structs.
+
 type Service struct {
 	ID              string `json:"id"`
 	ServiceEndpoint string `json:"serviceEndpoint"`
@@ -59,18 +102,9 @@ type DidDoc struct {
 	VerificationMethod []VerificationMethod `json:"verificationMethod"`
 }
 
-type Session struct {
-	AccessJwt       string `json:"accessJwt"`
-	RefreshJwt      string `json:"refreshJwt"`
-	Handle          string `json:"handle"`
-	Did             string `json:"did"`
-	DidDoc          DidDoc `json:"didDoc"`
-	Email           string `json:"email"`
-	EmailConfirmed  bool   `json:"emailConfirmed"`
-	EmailAuthFactor bool   `json:"emailAuthFactor"`
-	Active          bool   `json:"active"`
-	Status          string `json:"status"`
-}
+// struct Session is returned by both com.atproto.server.createSession and
+// com.atproto.server.refreshSession
+type Session = ServerCreateSessionOutput
 
 func SetEnvironmentVariables(f string) AtCredentials {
 	file, err := os.Open(f)
@@ -98,6 +132,12 @@ func SetEnvironmentVariables(f string) AtCredentials {
 			if err != nil {
 				logger.Error(fmt.Sprintf("sww %v", err.Error()))
 			}
+		} else if k == "BLUESKY_SERVICE" {
+			c.Entryway = v
+			err = os.Setenv(k, c.Entryway)
+			if err != nil {
+				logger.Error(fmt.Sprintf("sww %v", err.Error()))
+			}
 		}
 	}
 
@@ -108,112 +148,434 @@ func SetEnvironmentVariables(f string) AtCredentials {
 	return c
 }
 
+// authFactorToken is the code given with --auth-factor, see [ParseArgs]. It
+// takes the place of BLUESKY_AUTH_FACTOR_TOKEN in [Login].
+var authFactorToken string
+
 func GetCredentialsFromEnv() AtCredentials {
 	handle := os.Getenv("BLUESKY_HANDLE")
 	password := os.Getenv("BLUESKY_PASSWORD")
+	entryway := os.Getenv("BLUESKY_SERVICE")
+	authFactor := os.Getenv("BLUESKY_AUTH_FACTOR_TOKEN")
 
 	return AtCredentials{
-		Handle:   handle,
-		Password: password,
+		Handle:          handle,
+		Password:        password,
+		Entryway:        entryway,
+		AuthFactorToken: authFactor,
 	}
 }
 
-// Instantiate a new [AtClient]
+// Instantiate a new [AtClient]. Requests go to the credentials' entryway,
+// or [ServiceURL] by default, until a session tells us the account's PDS.
 func NewClient(c AtCredentials) *AtClient {
+	service := ServiceURL
+	if c.Entryway != "" {
+		service = strings.TrimSuffix(c.Entryway, "/")
+	}
+
 	return &AtClient{
-		Service:     ServiceURL,
+		Service:     service,
+		HTTP:        NewHTTPClient(),
 		Credentials: c,
+		Lexicons:    BundledLexicons,
 	}
 }
 
+func NewHTTPClient() *http.Client {
+	return &http.Client{Timeout: DefaultTimeout}
+}
+
+// function CurrentCredentials returns a copy of the client's credentials
+func (c *AtClient) CurrentCredentials() AtCredentials {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.Credentials
+}
+
 func (c *AtCredentials) SetSession(s Session) {
 	c.AccessToken = s.AccessJwt
 	c.RefreshToken = s.RefreshJwt
-	c.DID = s.Did
-	c.ServiceEndpoint = s.ServiceEndpoint()
+	c.DID = s.DID
+	c.SetServiceEndpoint(s.DIDDoc)
 }
 
-func (c AtClient) BuildURL(path AtProtoMethod) string {
-	return fmt.Sprintf("%s/xrpc/%s", c.Service, path)
+// function SetServiceEndpoint keeps the known PDS when the session's DID
+// document does not list one, e.g. a refreshed session without a didDoc
+func (c *AtCredentials) SetServiceEndpoint(doc json.RawMessage) {
+	if e := ParseDidDoc(doc).PDS(); e != "" {
+		c.ServiceEndpoint = e
+	}
 }
 
-func (c AtClient) CreateSession() (*Session, error) {
-	u := c.BuildURL(CreateSessionMethod)
-	r := SessionRequest{c.Credentials.Handle, c.Credentials.Password}
+func (c *AtClient) setSession(s Session) {
+	c.mu.Lock()
+	c.Credentials.SetSession(s)
+	c.mu.Unlock()
+
+	if c.OnSession != nil {
+		c.OnSession(s)
+	}
+}
+
+// function BuildURL routes a method to the account's PDS once it is known.
+// Sessions are always created through the entryway.
+func (c *AtClient) BuildURL(path AtProtoMethod) string {
+	host := c.Service
+	if e := c.CurrentCredentials().ServiceEndpoint; e != "" && path != CreateSessionMethod {
+		host = e
+	}
+
+	return fmt.Sprintf("%s/xrpc/%s", host, path)
+}
+
+func (c *AtClient) CreateSession(ctx context.Context) (*Session, error) {
+	cred := c.CurrentCredentials()
+	r := ServerCreateSessionInput{Identifier: cred.Handle, Password: cred.Password}
 	s := Session{}
-	buf := bytes.NewBuffer(nil)
 
-	req, err := json.Marshal(r)
+	err := c.send(ctx, http.MethodPost, CreateSessionMethod, "", nil, r, &s)
+	if errors.Is(err, ErrAuthFactorTokenRequired) {
+		if r.AuthFactorToken, err = c.authFactorToken(ctx, cred); err == nil {
+			err = c.send(ctx, http.MethodPost, CreateSessionMethod, "", nil, r, &s)
+		}
+	}
+
 	if err != nil {
-		return nil, fmt.Errorf("unable to build body: %s", err.Error())
+		return nil, fmt.Errorf("unable to authenticate: %w", err)
 	}
 
-	buf.Write(req)
+	c.setSession(s)
+	logger.Info(fmt.Sprintf("session created at %s", time.Now().Format("03:04 PM on 01/02/2006")))
 
-	rsp, err := http.Post(u, "application/json", buf)
-	if err != nil {
-		return nil, fmt.Errorf("unable to authenticate: %s", err.Error())
-	} else {
-		logger.Debugf("request to %v completed with status %v", u, rsp.Status)
-		buf.Reset()
+	return &s, nil
+}
+
+// function authFactorToken returns the emailed sign in code from the
+// credentials, or asks for it. Codes are single use, so one from the
+// credentials is cleared once it has been read.
+func (c *AtClient) authFactorToken(ctx context.Context, cred AtCredentials) (string, error) {
+	if cred.AuthFactorToken != "" {
+		c.mu.Lock()
+		c.Credentials.AuthFactorToken = ""
+		c.mu.Unlock()
+
+		return cred.AuthFactorToken, nil
+	}
+
+	if c.AuthFactor == nil {
+		return "", fmt.Errorf("%w: set BLUESKY_AUTH_FACTOR_TOKEN or pass --auth-factor with the code sent to your email", ErrAuthFactorTokenRequired)
 	}
 
-	if rsp.StatusCode != 200 {
-		return nil, fmt.Errorf("request failed with status %v", rsp.Status)
+	logger.Info("two-factor sign in is enabled, a code has been sent to the account's email")
+
+	return c.AuthFactor(ctx)
+}
+
+// function PromptAuthFactor reads the emailed sign in code from r, e.g.
+// stdin, after asking for it on w
+func PromptAuthFactor(r io.Reader, w io.Writer) func(ctx context.Context) (string, error) {
+	return func(ctx context.Context) (string, error) {
+		fmt.Fprint(w, "Sign in code: ")
+
+		line, err := bufio.NewReader(r).ReadString('\n')
+		token := strings.TrimSpace(line)
+		if token == "" {
+			return "", fmt.Errorf("unable to read sign in code %v", err)
+		}
+
+		return token, nil
 	}
+}
 
-	defer rsp.Body.Close()
+// function isTerminal reports whether f is attached to a terminal, and so
+// can be prompted
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
 
-	if _, err := buf.ReadFrom(rsp.Body); err != nil {
-		return nil, fmt.Errorf("unable to read response %s", err.Error())
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// function RefreshSession exchanges the refresh token for a new pair of tokens
+// via com.atproto.server.refreshSession.
+//
+// If the refresh token itself has expired and a password is available, a new
+// session is created instead.
+func (c *AtClient) RefreshSession(ctx context.Context) (*Session, error) {
+	cred := c.CurrentCredentials()
+	if cred.RefreshToken == "" {
+		return nil, fmt.Errorf("unable to refresh session: no refresh token")
 	}
 
-	if err = json.Unmarshal(buf.Bytes(), &s); err != nil {
-		return nil, fmt.Errorf("unable to marshal JSON %v", err.Error())
-	} else {
-		c.Credentials.SetSession(s)
-		logger.Info(fmt.Sprintf("session created at %s", time.Now().Format("03:04 PM on 01/02/2006")))
+	s := Session{}
+	err := c.send(ctx, http.MethodPost, RefreshSessionMethod, cred.RefreshToken, nil, nil, &s)
+	if errors.Is(err, ErrExpiredToken) && cred.Password != "" {
+		logger.Warn("refresh token expired, creating a new session")
+		return c.CreateSession(ctx)
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to refresh session: %w", err)
 	}
 
+	c.setSession(s)
+	logger.Info(fmt.Sprintf("session refreshed at %s", time.Now().Format("03:04 PM on 01/02/2006")))
+
 	return &s, nil
 }
 
+// function GetSession fetches the account details for the current access
+// token via com.atproto.server.getSession. The tokens are left untouched.
+func (c *AtClient) GetSession(ctx context.Context) (*ServerGetSessionOutput, error) {
+	s, err := c.ServerGetSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.Credentials.Handle = s.Handle
+	c.Credentials.DID = s.DID
+	c.Credentials.SetServiceEndpoint(s.DIDDoc)
+
+	return s, nil
+}
+
+// function ResumeSession restores a session from the tokens stored in the
+// database, refreshing it when only the refresh token is still valid.
+// It reports whether the client is authenticated.
+func (c *AtClient) ResumeSession(ctx context.Context, conn *Connection) bool {
+	tokens, err := conn.GetTokens(BlueskyAPI)
+	if err != nil {
+		logger.Errorf("unable to load stored tokens %v", err.Error())
+		return false
+	}
+
+	access, refresh := tokens[AccessToken], tokens[RefreshToken]
+	if refresh == nil || refresh.Expired() {
+		logger.Debug("no valid refresh token stored")
+		return false
+	}
+
+	c.mu.Lock()
+	c.Credentials.RefreshToken = refresh.Token
+	if access != nil && !access.Expired() {
+		c.Credentials.AccessToken = access.Token
+	}
+	c.mu.Unlock()
+
+	if access != nil && !access.Expired() {
+		if _, err = c.GetSession(ctx); err == nil {
+			logger.Info("resumed stored session")
+			return true
+		}
+
+		logger.Warnf("unable to resume stored session %v", err.Error())
+	}
+
+	if _, err = c.RefreshSession(ctx); err != nil {
+		logger.Warnf("unable to refresh stored session %v", err.Error())
+		return false
+	}
+
+	return true
+}
+
+// function ServiceEndpoint is the URL of the account's PDS from its DID
+// document, or an empty string when the document does not list one
 func (s Session) ServiceEndpoint() string {
-	return s.DidDoc.Service[0].ServiceEndpoint
+	return ParseDidDoc(s.DIDDoc).PDS()
+}
+
+// function ParseDidDoc decodes the didDoc of a session, returning an empty
+// document when it is missing or malformed
+func ParseDidDoc(raw json.RawMessage) DidDoc {
+	d := DidDoc{}
+	if len(raw) > 0 {
+		json.Unmarshal(raw, &d)
+	}
+
+	return d
+}
+
+// function PDS is the URL of the account's PDS, or an empty string when the
+// document does not list one
+func (d DidDoc) PDS() string {
+	for _, svc := range d.Service {
+		if strings.HasSuffix(svc.ID, "#atproto_pds") || svc.Type == "AtprotoPersonalDataServer" {
+			return strings.TrimSuffix(svc.ServiceEndpoint, "/")
+		}
+	}
+
+	return ""
 }
 
 func (s Session) DebugToken(l int) string {
 	return s.AccessJwt[:l/2] + "..." + s.AccessJwt[len(s.AccessJwt)-l/2:]
 }
 
-// function SaveToken stores the tokens in the database
+// struct Claims holds the fields of a JWT payload that synapse cares about
+type Claims struct {
+	Scope string `json:"scope"`
+	Sub   string `json:"sub"`
+	Aud   string `json:"aud"`
+	Iat   int64  `json:"iat"`
+	Exp   int64  `json:"exp"`
+}
+
+// function DecodeClaims reads the (unverified) payload of a JWT
+func DecodeClaims(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token: expected 3 parts but got %v", len(parts))
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode token payload %v", err.Error())
+	}
+
+	c := Claims{}
+	if err = json.Unmarshal(payload, &c); err != nil {
+		return nil, fmt.Errorf("unable to marshal JSON %v", err.Error())
+	}
+
+	return &c, nil
+}
+
+// function TokenExpiry estimates when a token should be treated as expired.
+// The exp claim is used when present, otherwise the fallback estimate.
 //
 // Note: Estimated expiry is split in half before storage.
 // https://atproto.blue/en/latest/atproto_client/auth.html#session-string
-func SaveTokens(s Session) {
-	// Access Token
-	// Expiry = Now + 1 hour
-	// Refresh Token
-	// Expiry = Now + 4 weeks
+func TokenExpiry(token string, estimate time.Duration, now time.Time) time.Time {
+	ttl := estimate
+	if c, err := DecodeClaims(token); err == nil && c.Exp > 0 {
+		ttl = time.Unix(c.Exp, 0).Sub(now)
+	}
+
+	return now.Add(ttl / 2)
 }
 
-// function Login creates a [AtClient] and authenticates into BlueSky
-func Login() {
-	logger.Warn("make sure you use an app password to authenticate")
+// function SaveTokens stores the session's tokens in the database
+//
+// Access Token: Expiry = Now + 1 hour
+// Refresh Token: Expiry = Now + 4 weeks
+func SaveTokens(conn *Connection, s Session) error {
+	now := time.Now()
+	tokens := []Token{
+		{s.AccessJwt, AccessToken, BlueskyAPI, TokenExpiry(s.AccessJwt, time.Hour, now)},
+		{s.RefreshJwt, RefreshToken, BlueskyAPI, TokenExpiry(s.RefreshJwt, 4*7*24*time.Hour, now)},
+	}
+
+	for _, t := range tokens {
+		if err := conn.SaveToken(t); err != nil {
+			return err
+		}
+	}
+
+	logger.Debugf("saved tokens, access token expires at %v", tokens[0].ExpiresAt.Format(time.DateTime))
+
+	return nil
+}
+
+// function Login creates a [AtClient] and authenticates into BlueSky as the
+// account conn is scoped to, or with credentials from the environment when
+// it is not. An OAuth session from [Serve] is preferred; otherwise a stored
+// app password session is reused when one is still valid. An account's app
+// password is read from [AccountPasswordEnv] when a new session is needed.
+func Login(ctx context.Context, conn *Connection) (*AtClient, error) {
 	cred := GetCredentialsFromEnv()
+	if authFactorToken != "" {
+		cred.AuthFactorToken = authFactorToken
+	}
+
+	var account *Account
+	if conn.AccountID != 0 {
+		a, err := conn.GetAccount(strconv.FormatInt(conn.AccountID, 10))
+		if err != nil {
+			return nil, fmt.Errorf("unable to load account %v %v", conn.AccountID, err.Error())
+		}
+
+		account = a
+		cred = AtCredentials{
+			Handle:          a.Handle,
+			Password:        os.Getenv(AccountPasswordEnv(a.Handle)),
+			Entryway:        a.Service,
+			AuthFactorToken: cred.AuthFactorToken,
+		}
+	}
+
+	c, err := login(ctx, conn, cred, account)
+	if err != nil {
+		return nil, err
+	}
+
+	if did := c.CurrentCredentials().DID; account != nil && did != "" && did != account.DID {
+		if err = conn.SetAccountDID(account.ID, did); err != nil {
+			logger.Warnf("signed in as %v but %v", account.Handle, err.Error())
+		}
+	}
+
+	return c, nil
+}
+
+func login(ctx context.Context, conn *Connection, cred AtCredentials, account *Account) (*AtClient, error) {
+	s, err := conn.GetOAuthSession(cred.Handle)
+	if errors.Is(err, sql.ErrNoRows) && account != nil && account.DID != "" {
+		s, err = conn.GetOAuthSession(account.DID)
+	}
+
+	if err == nil {
+		logger.Infof("using OAuth session for %v", s.DID)
+		c := NewOAuthSessionClient(s)
+		c.OnOAuthSession = func(s OAuthSession) {
+			if err := conn.SaveOAuthSession(s); err != nil {
+				logger.Errorf("unable to save OAuth session %v", err.Error())
+			}
+		}
+
+		return c, nil
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		logger.Warnf("unable to load OAuth session %v", err.Error())
+	}
+
+	logger.Warn("no OAuth session, signing in with an app password. Run synapse serve and open /oauth/login to use OAuth instead")
 
 	if cred.Handle == "" {
 		logger.Debug("no credentials in term env, attempting to set manually")
+		authFactor := cred.AuthFactorToken
 		cred = SetEnvironmentVariables(".env")
+		cred.AuthFactorToken = authFactor
 	}
 
 	logger.Debugf("credentials set with handle: %v", cred.Handle)
 
 	c := NewClient(cred)
-	s, err := c.CreateSession()
+	if isTerminal(os.Stdin) {
+		c.AuthFactor = PromptAuthFactor(os.Stdin, os.Stderr)
+	}
+
+	c.OnSession = func(s Session) {
+		if err := SaveTokens(conn, s); err != nil {
+			logger.Errorf("unable to save tokens %v", err.Error())
+		}
+	}
+
+	if c.ResumeSession(ctx, conn) {
+		return c, nil
+	} else if account != nil && cred.Password == "" {
+		return nil, fmt.Errorf("%v has no session, set %v or sign in with synapse serve and open /oauth/login",
+			account.Handle, AccountPasswordEnv(account.Handle))
+	}
+
+	session, err := c.CreateSession(ctx)
 	if err != nil {
 		logger.Errorf("unable to create session %v", err.Error())
+		return nil, err
 	}
 
-	logger.Infof("session created with token %v", s.DebugToken(12))
+	logger.Infof("session created with token %v", session.DebugToken(12))
+
+	return c, nil
 }
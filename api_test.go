@@ -1,9 +1,18 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestAPI(t *testing.T) {
@@ -44,3 +53,274 @@ func TestAPI(t *testing.T) {
 		os.Remove(tmp.Name())
 	})
 }
+
+func TestRefreshSession(t *testing.T) {
+	var srv *httptest.Server
+	calls := map[string]int{}
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method := strings.TrimPrefix(r.URL.Path, "/xrpc/")
+		calls[method]++
+		auth := r.Header.Get("Authorization")
+
+		switch method {
+		case RefreshSessionMethod:
+			if auth != "Bearer refresh-1" {
+				t.Errorf("wanted refresh token in header but got %v", auth)
+			}
+
+			json.NewEncoder(w).Encode(Session{
+				AccessJwt:  "access-2",
+				RefreshJwt: "refresh-2",
+				DID:        "did:plc:test",
+				DIDDoc:     rawDidDoc(DidDoc{Service: []Service{{ID: "#atproto_pds", ServiceEndpoint: srv.URL}}}),
+			})
+		default:
+			if auth != "Bearer access-2" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":"ExpiredToken","message":"Token has expired"}`))
+				return
+			}
+
+			w.Write([]byte(`{"ok":true}`))
+		}
+	}))
+
+	defer srv.Close()
+
+	c := NewClient(AtCredentials{AccessToken: "access-1", RefreshToken: "refresh-1"})
+	c.Service = srv.URL
+
+	t.Run("expired token is refreshed and retried", func(t *testing.T) {
+		out := struct {
+			Ok bool `json:"ok"`
+		}{}
+
+		if err := c.Procedure(context.Background(), "com.example.test", nil, &out); err != nil {
+			t.Fatalf("wanted no error but got %v", err.Error())
+		}
+
+		if !out.Ok {
+			t.Errorf("wanted response to be decoded after retry")
+		}
+
+		if calls[RefreshSessionMethod] != 1 || calls["com.example.test"] != 2 {
+			t.Errorf("unexpected calls %v", calls)
+		}
+
+		if c.Credentials.RefreshToken != "refresh-2" {
+			t.Errorf("wanted rotated refresh token but got %v", c.Credentials.RefreshToken)
+		}
+	})
+
+	t.Run("xrpc errors are decoded", func(t *testing.T) {
+		c.Credentials.AccessToken = "bad"
+		c.Credentials.RefreshToken = ""
+
+		err := c.Procedure(context.Background(), "com.example.test", nil, nil)
+		if !IsExpiredToken(err) {
+			t.Errorf("wanted expired token error but got %v", err)
+		}
+	})
+}
+
+func TestTokenExpiry(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"did:plc:test","exp":1700007200}`))
+
+	t.Run("exp claim is halved", func(t *testing.T) {
+		got := TokenExpiry("header."+payload+".sig", time.Hour, now)
+		want := now.Add(time.Hour)
+
+		if !got.Equal(want) {
+			t.Errorf("wanted %v but got %v", want, got)
+		}
+	})
+
+	t.Run("estimate is halved when token has no claims", func(t *testing.T) {
+		got := TokenExpiry("not-a-jwt", 4*time.Hour, now)
+		want := now.Add(2 * time.Hour)
+
+		if !got.Equal(want) {
+			t.Errorf("wanted %v but got %v", want, got)
+		}
+	})
+}
+
+func rawDidDoc(d DidDoc) json.RawMessage {
+	raw, _ := json.Marshal(d)
+	return raw
+}
+
+func TestServiceEndpoint(t *testing.T) {
+	pds := "https://amanita.us-east.host.bsky.network"
+	s := Session{
+		DID: "did:plc:synapse",
+		DIDDoc: rawDidDoc(DidDoc{Service: []Service{
+			{ID: "#bsky_notif", Type: "BskyNotificationService", ServiceEndpoint: "https://api.bsky.app"},
+			{ID: "#atproto_pds", Type: "AtprotoPersonalDataServer", ServiceEndpoint: pds + "/"},
+		}}),
+	}
+
+	t.Run("requests are routed to the pds after login", func(t *testing.T) {
+		c := NewClient(AtCredentials{Entryway: "https://pds.example.com/"})
+		if got := c.BuildURL(GetSessionMethod); got != "https://pds.example.com/xrpc/"+GetSessionMethod {
+			t.Errorf("wanted configured entryway before login but got %v", got)
+		}
+
+		c.Credentials.SetSession(s)
+
+		if got := c.BuildURL(CreateRecordMethod); got != pds+"/xrpc/"+CreateRecordMethod {
+			t.Errorf("wanted pds but got %v", got)
+		}
+
+		if got := c.BuildURL(CreateSessionMethod); !strings.HasPrefix(got, "https://pds.example.com") {
+			t.Errorf("wanted sessions to be created at the entryway but got %v", got)
+		}
+	})
+
+	t.Run("empty did documents keep the known endpoint", func(t *testing.T) {
+		cred := AtCredentials{ServiceEndpoint: pds}
+		cred.SetSession(Session{AccessJwt: "access"})
+
+		if (Session{}).ServiceEndpoint() != "" || cred.ServiceEndpoint != pds {
+			t.Errorf("wanted %v but got %v", pds, cred.ServiceEndpoint)
+		}
+	})
+}
+
+func TestConcurrentClient(t *testing.T) {
+	var refreshes atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch strings.TrimPrefix(r.URL.Path, "/xrpc/") {
+		case RefreshSessionMethod:
+			if r.Header.Get("Authorization") != "Bearer refresh-1" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":"ExpiredToken","message":"Token has been revoked"}`))
+				return
+			}
+
+			refreshes.Add(1)
+			time.Sleep(10 * time.Millisecond)
+			json.NewEncoder(w).Encode(Session{AccessJwt: "access-2", RefreshJwt: "refresh-2", DID: "did:plc:test"})
+		case "com.example.slow":
+			time.Sleep(200 * time.Millisecond)
+		default:
+			if r.Header.Get("Authorization") != "Bearer access-2" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":"ExpiredToken","message":"Token has expired"}`))
+				return
+			}
+
+			w.Write([]byte(`{}`))
+		}
+	}))
+
+	defer srv.Close()
+
+	c := NewClient(AtCredentials{AccessToken: "access-1", RefreshToken: "refresh-1"})
+	c.Service = srv.URL
+
+	t.Run("expired tokens are refreshed once", func(t *testing.T) {
+		wg := sync.WaitGroup{}
+		errs := make(chan error, 10)
+		for range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs <- c.Procedure(context.Background(), "com.example.test", nil, nil)
+			}()
+		}
+
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			if err != nil {
+				t.Errorf("wanted no error but got %v", err.Error())
+			}
+		}
+
+		if n := refreshes.Load(); n != 1 {
+			t.Errorf("wanted a single refresh but got %v", n)
+		}
+	})
+
+	t.Run("requests are cancelled with their context", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		err := c.Procedure(ctx, "com.example.slow", nil, nil)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("wanted deadline exceeded but got %v", err)
+		}
+	})
+
+	t.Run("the http client can be replaced", func(t *testing.T) {
+		c.HTTP = &http.Client{Timeout: 10 * time.Millisecond}
+
+		if err := c.Procedure(context.Background(), "com.example.slow", nil, nil); err == nil {
+			t.Errorf("wanted the client timeout to apply")
+		}
+	})
+}
+
+func TestAuthFactor(t *testing.T) {
+	var tokens []string
+	enabled := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := ServerCreateSessionInput{}
+		json.NewDecoder(r.Body).Decode(&req)
+		tokens = append(tokens, req.AuthFactorToken)
+
+		if req.AuthFactorToken != "ABCDE-12345" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"AuthFactorTokenRequired","message":"A sign in code has been sent to your email address"}`))
+			return
+		}
+
+		json.NewEncoder(w).Encode(Session{AccessJwt: "access", RefreshJwt: "refresh", DID: "did:plc:test", EmailAuthFactor: &enabled})
+	}))
+
+	defer srv.Close()
+
+	ctx := context.Background()
+	cred := AtCredentials{Handle: "synapse.test", Password: "password", Entryway: srv.URL}
+
+	t.Run("token from the credentials is sent when required", func(t *testing.T) {
+		tokens = nil
+		cred := cred
+		cred.AuthFactorToken = "ABCDE-12345"
+		c := NewClient(cred)
+
+		s, err := c.CreateSession(ctx)
+		if err != nil || s.EmailAuthFactor == nil || !*s.EmailAuthFactor {
+			t.Fatalf("wanted a session but got %v %v", s, err)
+		}
+
+		if len(tokens) != 2 || tokens[0] != "" || c.CurrentCredentials().AuthFactorToken != "" {
+			t.Errorf("wanted a retry with the token, which is then cleared, but sent %q", tokens)
+		}
+	})
+
+	t.Run("token is prompted for", func(t *testing.T) {
+		tokens = nil
+		out := &strings.Builder{}
+		c := NewClient(cred)
+		c.AuthFactor = PromptAuthFactor(strings.NewReader(" ABCDE-12345\n"), out)
+
+		if _, err := c.CreateSession(ctx); err != nil {
+			t.Fatalf("wanted no error but got %v", err.Error())
+		}
+
+		if out.String() == "" || len(tokens) != 2 {
+			t.Errorf("wanted a prompt and a retry but sent %q", tokens)
+		}
+	})
+
+	t.Run("missing token is reported", func(t *testing.T) {
+		c := NewClient(cred)
+		if _, err := c.CreateSession(ctx); !errors.Is(err, ErrAuthFactorTokenRequired) {
+			t.Errorf("wanted %v but got %v", ErrAuthFactorTokenRequired, err)
+		}
+	})
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"strings"
+	"sync"
+)
+
+const (
+	CardWidth   int = 1200
+	CardMargin  int = 80
+	LineSpacing int = 8
+)
+
+// The atlas is DejaVu Sans Mono rendered at 28px into a 16 column grid of
+// fixed size cells. See data/fonts/LICENSE.
+//
+//go:embed data/fonts/dejavu-sans-mono-28.png
+var fontAtlas []byte
+
+const (
+	glyphWidth   int = 17
+	glyphHeight  int = 33
+	atlasColumns int = 16
+)
+
+// Glyphs in atlas order: printable ASCII, Latin-1 and the typographic
+// punctuation common in Kindle exports
+var atlasGlyphs = func() []rune {
+	glyphs := []rune{}
+	for r := rune(0x20); r < 0x7F; r++ {
+		glyphs = append(glyphs, r)
+	}
+
+	for r := rune(0xA1); r <= 0xFF; r++ {
+		glyphs = append(glyphs, r)
+	}
+
+	return append(glyphs, []rune("–—‘’“”•…")...)
+}()
+
+// struct BitmapFont draws text from a grayscale glyph atlas, where each
+// pixel's value is the glyph's coverage and is used as an alpha mask
+type BitmapFont struct {
+	Atlas  *image.Alpha
+	Width  int
+	Height int
+	Glyphs map[rune]int
+}
+
+// struct Theme is the color scheme of a quote card
+type Theme struct {
+	Name       string
+	Background color.RGBA
+	Foreground color.RGBA
+	Accent     color.RGBA
+}
+
+// struct Quote is the content rendered on a card
+type Quote struct {
+	Text   string
+	Title  string
+	Author string
+}
+
+var Themes = map[string]Theme{
+	"light": {"light", color.RGBA{250, 250, 247, 255}, color.RGBA{33, 33, 33, 255}, color.RGBA{0, 133, 255, 255}},
+	"dark":  {"dark", color.RGBA{22, 30, 39, 255}, color.RGBA{241, 243, 245, 255}, color.RGBA{32, 139, 254, 255}},
+	"sepia": {"sepia", color.RGBA{244, 236, 216, 255}, color.RGBA{91, 70, 54, 255}, color.RGBA{166, 90, 46, 255}},
+}
+
+var DefaultTheme = Themes["light"]
+
+var loadFont = sync.OnceValues(func() (*BitmapFont, error) {
+	img, err := png.Decode(bytes.NewReader(fontAtlas))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode font atlas %v", err.Error())
+	}
+
+	gray, ok := img.(*image.Gray)
+	if !ok {
+		gray = image.NewGray(img.Bounds())
+		draw.Draw(gray, gray.Bounds(), img, image.Point{}, draw.Src)
+	}
+
+	mask := &image.Alpha{Pix: gray.Pix, Stride: gray.Stride, Rect: gray.Rect}
+	f := BitmapFont{mask, glyphWidth, glyphHeight, make(map[rune]int, len(atlasGlyphs))}
+	for i, r := range atlasGlyphs {
+		f.Glyphs[r] = i
+	}
+
+	return &f, nil
+})
+
+// function glyph returns the atlas cell for r, substituting characters the
+// atlas does not have
+func (f *BitmapFont) glyph(r rune) image.Rectangle {
+	i, ok := f.Glyphs[r]
+	if !ok {
+		switch {
+		case r == ' ', r == '\t':
+			i = f.Glyphs[' ']
+		case r == '′', r == '‵':
+			i = f.Glyphs['\'']
+		case r == '″', r == '‶':
+			i = f.Glyphs['"']
+		default:
+			i = f.Glyphs['?']
+		}
+	}
+
+	x, y := (i%atlasColumns)*f.Width, (i/atlasColumns)*f.Height
+
+	return image.Rect(x, y, x+f.Width, y+f.Height)
+}
+
+// function DrawString draws s with its top left corner at pt
+func (f *BitmapFont) DrawString(dst draw.Image, pt image.Point, s string, c color.Color) {
+	src := image.NewUniform(c)
+	for _, r := range s {
+		if isCombining(r) {
+			continue
+		}
+
+		cell := f.glyph(r)
+		draw.DrawMask(dst, image.Rect(pt.X, pt.Y, pt.X+f.Width, pt.Y+f.Height), src, image.Point{}, f.Atlas, cell.Min, draw.Over)
+		pt.X += f.Width
+	}
+}
+
+func isCombining(r rune) bool {
+	c := classify(r)
+	return c == gcExtend || c == gcZWJ
+}
+
+// function Wrap breaks text into lines of at most cols glyphs on word
+// boundaries. Paragraph breaks are kept.
+func Wrap(text string, cols int) []string {
+	lines := []string{}
+	for _, para := range strings.Split(text, "\n") {
+		line := ""
+		for _, w := range strings.Fields(para) {
+			for len([]rune(w)) > cols {
+				if line != "" {
+					lines = append(lines, line)
+					line = ""
+				}
+
+				lines = append(lines, string([]rune(w)[:cols]))
+				w = string([]rune(w)[cols:])
+			}
+
+			if line == "" {
+				line = w
+			} else if len([]rune(line))+1+len([]rune(w)) <= cols {
+				line += " " + w
+			} else {
+				lines = append(lines, line)
+				line = w
+			}
+		}
+
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+// function Attribution is the "— Author, Title" line credited on cards and
+// posts
+func (q Quote) Attribution() string {
+	switch {
+	case q.Author != "" && q.Title != "":
+		return fmt.Sprintf("— %v, %v", q.Author, q.Title)
+	case q.Title != "":
+		return "— " + q.Title
+	case q.Author != "":
+		return "— " + q.Author
+	default:
+		return ""
+	}
+}
+
+// function PostText is the text of a post sharing the quote, which is what
+// [Preflight] classifies: the quote and its attribution below it
+func (q Quote) PostText() string {
+	text := strings.TrimSpace(q.Text)
+	if a := q.Attribution(); text != "" && a != "" {
+		return text + "\n\n" + a
+	}
+
+	return text
+}
+
+// function RenderQuoteCard draws the quote and its attribution onto an
+// image whose height fits the text, and encodes it as a PNG
+func RenderQuoteCard(q Quote, t Theme) ([]byte, *AspectRatio, error) {
+	f, err := loadFont()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cols := (CardWidth - 2*CardMargin) / f.Width
+	lines := Wrap(strings.TrimSpace(q.Text), cols)
+	credit := []string{}
+	if a := q.Attribution(); a != "" {
+		credit = Wrap(a, cols)
+	}
+
+	lineHeight := f.Height + LineSpacing
+	height := 2*CardMargin + (len(lines)+len(credit))*lineHeight
+	if len(credit) > 0 {
+		height += lineHeight
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, CardWidth, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(t.Background), image.Point{}, draw.Src)
+
+	// Accent bar alongside the quote
+	bar := image.Rect(CardMargin/2-4, CardMargin, CardMargin/2+4, CardMargin+len(lines)*lineHeight-LineSpacing)
+	draw.Draw(img, bar, image.NewUniform(t.Accent), image.Point{}, draw.Src)
+
+	y := CardMargin
+	for _, l := range lines {
+		f.DrawString(img, image.Pt(CardMargin, y), l, t.Foreground)
+		y += lineHeight
+	}
+
+	y += lineHeight
+	for _, l := range credit {
+		f.DrawString(img, image.Pt(CardMargin, y), l, t.Accent)
+		y += lineHeight
+	}
+
+	buf := bytes.NewBuffer(nil)
+	enc := png.Encoder{CompressionLevel: png.BestCompression}
+	if err = enc.Encode(buf, img); err != nil {
+		return nil, nil, fmt.Errorf("unable to encode card %v", err.Error())
+	}
+
+	if buf.Len() > MaxBlobSize {
+		return nil, nil, fmt.Errorf("card is too large to upload (%v bytes)", buf.Len())
+	}
+
+	return buf.Bytes(), &AspectRatio{CardWidth, height}, nil
+}
+
+// function NewQuoteCardPost renders q as an image and uploads it, returning
+// a post with the attribution as text and the full quote as alt text
+func NewQuoteCardPost(ctx context.Context, c *AtClient, q Quote, t Theme) (Post, error) {
+	text := q.Attribution()
+	if PostLength(text) > MaxPostLength {
+		text = strings.Join(Graphemes(text)[:MaxPostLength-1], "") + "…"
+	}
+
+	// The card is not uploaded for a post that would be rejected
+	p := NewPost(text)
+	if err := c.ValidateRecord(PostCollection, "", p); err != nil {
+		return Post{}, err
+	}
+
+	data, ratio, err := RenderQuoteCard(q, t)
+	if err != nil {
+		return Post{}, err
+	}
+
+	blob, err := c.UploadBlob(ctx, data, "image/png")
+	if err != nil {
+		return Post{}, err
+	}
+
+	p.Embed = NewImagesEmbed(EmbedImage{Alt: q.Text, Image: *blob, AspectRatio: ratio})
+
+	return p, nil
+}
+
+// function PublishQuoteCard posts q as a quote card, see [NewQuoteCardPost]
+func PublishQuoteCard(ctx context.Context, c *AtClient, conn *Connection, q Quote, t Theme, highlightID int64) (*StrongRef, error) {
+	p, err := NewQuoteCardPost(ctx, c, q, t)
+	if err != nil {
+		return nil, err
+	}
+
+	return PostOnce(ctx, c, conn, p, highlightID)
+}
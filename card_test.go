@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image/color"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRenderQuoteCard(t *testing.T) {
+	q := Quote{
+		Text:   strings.Repeat("“If an action will take less than two minutes, it should be done at the moment it’s defined.” ", 12),
+		Title:  "Getting Things Done",
+		Author: "David Allen",
+	}
+
+	data, ratio, err := RenderQuoteCard(q, Themes["dark"])
+	if err != nil {
+		t.Fatalf("wanted no error but got %v", err.Error())
+	}
+
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("wanted a valid png but got %v", err.Error())
+	}
+
+	t.Run("height fits the wrapped text", func(t *testing.T) {
+		b := img.Bounds()
+		if b.Dx() != CardWidth || b.Dy() != ratio.Height || b.Dy() < 2*CardMargin+20*glyphHeight {
+			t.Errorf("unexpected card size %v", b)
+		}
+	})
+
+	t.Run("glyphs are drawn in the foreground color", func(t *testing.T) {
+		fg, bg := Themes["dark"].Foreground, Themes["dark"].Background
+		counts := map[string]int{}
+		for x := CardMargin; x < CardWidth-CardMargin; x++ {
+			r, g, b, _ := img.At(x, CardMargin+glyphHeight/2).RGBA()
+			switch (color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), 255}) {
+			case fg:
+				counts["fg"]++
+			case bg:
+				counts["bg"]++
+			}
+		}
+
+		if counts["fg"] == 0 || counts["bg"] == 0 {
+			t.Errorf("wanted glyph strokes with gaps on the first line but got %v", counts)
+		}
+	})
+}
+
+func TestWrap(t *testing.T) {
+	got := Wrap("now, later, someday—big, little, or in between", 12)
+	for _, l := range got {
+		if len([]rune(l)) > 12 {
+			t.Errorf("line %q is longer than 12 glyphs", l)
+		}
+	}
+
+	if strings.Join(got, " ") != "now, later, someday—big, little, or in between" {
+		t.Errorf("wanted words to be preserved but got %q", got)
+	}
+}
+
+func TestPublishQuoteCard(t *testing.T) {
+	var record struct {
+		Record struct {
+			Text  string      `json:"text"`
+			Embed ImagesEmbed `json:"embed"`
+		} `json:"record"`
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/xrpc/" + UploadBlobMethod:
+			body, _ := io.ReadAll(r.Body)
+			if r.Header.Get("Content-Type") != "image/png" || !bytes.HasPrefix(body, []byte("\x89PNG")) {
+				t.Errorf("wanted png upload but got %v", r.Header.Get("Content-Type"))
+			}
+
+			w.Write([]byte(`{"blob":{"$type":"blob","ref":{"$link":"bafkrei"},"mimeType":"image/png","size":1234}}`))
+		default:
+			json.NewDecoder(r.Body).Decode(&record)
+			w.Write([]byte(`{"uri":"at://did:plc:synapse/app.bsky.feed.post/1","cid":"bafy"}`))
+		}
+	}))
+
+	defer srv.Close()
+
+	q := Quote{Text: "Your mind is for having ideas, not holding them.", Title: "Getting Things Done", Author: "David Allen"}
+	if _, err := PublishQuoteCard(context.Background(), testClient(srv), testConnection(t), q, DefaultTheme, 0); err != nil {
+		t.Fatalf("wanted no error but got %v", err.Error())
+	}
+
+	img := record.Record.Embed.Images[0]
+	if record.Record.Embed.Type != ImagesEmbedType || img.Image.Ref.Link != "bafkrei" {
+		t.Errorf("unexpected embed %+v", record.Record.Embed)
+	}
+
+	if img.Alt != q.Text || record.Record.Text != "— David Allen, Getting Things Done" {
+		t.Errorf("unexpected alt %q or text %q", img.Alt, record.Record.Text)
+	}
+}
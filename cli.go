@@ -1,13 +1,41 @@
 package main
 
-import "fmt"
+import (
+	"fmt"
+)
 
 type Commander interface {
 	Run([]string) error
 	ParseArgs(args []string) map[string]string
 }
 
+// function extractGlobalFlags applies the flags every command accepts and
+// returns the remaining arguments
+func extractGlobalFlags(args []string) []string {
+	rest := []string{}
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--auth-factor", "-auth-factor", "--2fa", "-2fa":
+			if i+1 < len(args) {
+				authFactorToken = args[i+1]
+				i++
+			}
+		case "--account", "-account", "--a", "-a":
+			if i+1 < len(args) {
+				selectedAccount = args[i+1]
+				i++
+			}
+		default:
+			rest = append(rest, args[i])
+		}
+	}
+
+	return rest
+}
+
 func ParseArgs(args []string) {
+	args = extractGlobalFlags(args)
+
 	var subC string
 	var rest []string
 	if len(args) < 1 {
@@ -23,11 +51,41 @@ func ParseArgs(args []string) {
 	case "p", "pulse":
 		msg := fmt.Sprintf("remaining args: %v", rest)
 		logger.Info(msg)
-		Run(args)
+		if err := Run(args); err != nil {
+			logger.Error(err)
+		}
 	case "i", "import":
-		logger.Info("import command")
+		if err := Import(rest); err != nil {
+			logger.Error(err)
+		}
+	case "accounts":
+		if err := ManageAccounts(rest); err != nil {
+			logger.Error(err)
+		}
+	case "books":
+		if err := ManageBooks(rest); err != nil {
+			logger.Error(err)
+		}
+	case "labels":
+		if err := ManageLabels(rest); err != nil {
+			logger.Error(err)
+		}
+	case "posts":
+		if err := ManagePosts(rest); err != nil {
+			logger.Error(err)
+		}
+	case "profile":
+		if err := ManageProfile(rest); err != nil {
+			logger.Error(err)
+		}
+	case "c", "check":
+		if err := Check(rest); err != nil {
+			logger.Error(err)
+		}
 	case "s", "start", "serve", "server":
-		logger.Info("server command")
+		if err := Serve(rest); err != nil {
+			logger.Error(err)
+		}
 	default:
 		logger.Info("no match, call help")
 	}
@@ -0,0 +1,475 @@
+// Command lexgen generates Go types and typed AtClient methods from the
+// query and procedure lexicons in a directory. It is run by go generate:
+//
+//	go run ./cmd/lexgen -dir data/lexicons -out lexicons_gen.go
+//
+// Names drop the NSID authority, so com.atproto.server.getSession becomes
+// the method ServerGetSession with its output type ServerGetSessionOutput.
+// Objects the endpoints refer to are generated too; records are left to
+// hand-written types, which are validated against the same lexicons.
+// Endpoints called without a session only get their types, since the
+// generated methods send the access token.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/format"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// struct properties keeps the order properties are declared in, so
+// generated structs read like their lexicon
+type properties struct {
+	Keys []string
+	Defs map[string]*def
+}
+
+func (p *properties) UnmarshalJSON(raw []byte) error {
+	p.Defs = map[string]*def{}
+	d := json.NewDecoder(bytes.NewReader(raw))
+	if _, err := d.Token(); err != nil {
+		return err
+	}
+
+	for d.More() {
+		t, err := d.Token()
+		if err != nil {
+			return err
+		}
+
+		key := t.(string)
+		prop := def{}
+		if err = d.Decode(&prop); err != nil {
+			return err
+		}
+
+		p.Keys = append(p.Keys, key)
+		p.Defs[key] = &prop
+	}
+
+	return nil
+}
+
+type body struct {
+	Encoding string `json:"encoding"`
+	Schema   *def   `json:"schema"`
+}
+
+type def struct {
+	Type        string     `json:"type"`
+	Description string     `json:"description"`
+	Required    []string   `json:"required"`
+	Properties  properties `json:"properties"`
+	Items       *def       `json:"items"`
+	Ref         string     `json:"ref"`
+	Parameters  *def       `json:"parameters"`
+	Input       *body      `json:"input"`
+	Output      *body      `json:"output"`
+}
+
+type doc struct {
+	ID          string          `json:"id"`
+	Description string          `json:"description"`
+	Defs        map[string]*def `json:"defs"`
+}
+
+// unauthenticated endpoints are sent without the session's access token,
+// e.g. by AtClient.CreateSession, so no method is generated for them
+var unauthenticated = []string{"com.atproto.server.createSession"}
+
+// Go spells these words in capitals, e.g. DID and URI, and their plurals
+// as URIs
+var initialisms = []string{"cid", "did", "id", "uri", "url"}
+
+type generator struct {
+	docs map[string]*doc
+	buf  bytes.Buffer
+	// done holds the Go names of the types that have been written
+	done map[string]bool
+	// queue holds object references that still need a type
+	queue []string
+}
+
+// function exported capitalizes a lexicon name, e.g. didDoc becomes DIDDoc
+func exported(name string) string {
+	words := []string{}
+	start := 0
+	for i, r := range name {
+		if i > 0 && unicode.IsUpper(r) {
+			words = append(words, name[start:i])
+			start = i
+		}
+	}
+
+	words = append(words, name[start:])
+	for i, w := range words {
+		lower := strings.ToLower(w)
+		if slices.Contains(initialisms, lower) {
+			words[i] = strings.ToUpper(w)
+		} else if plural, ok := strings.CutSuffix(lower, "s"); ok && slices.Contains(initialisms, plural) {
+			words[i] = strings.ToUpper(plural) + "s"
+		} else {
+			words[i] = strings.ToUpper(w[:1]) + w[1:]
+		}
+	}
+
+	return strings.Join(words, "")
+}
+
+// function typeName names the definition a qualified reference points to
+func typeName(ref string) string {
+	nsid, name, _ := strings.Cut(ref, "#")
+	parts := strings.Split(nsid, ".")
+	if len(parts) > 2 {
+		parts = parts[2:]
+	}
+
+	out := ""
+	for _, p := range parts {
+		out += exported(p)
+	}
+
+	if name != "main" {
+		out += exported(name)
+	}
+
+	return out
+}
+
+func qualify(ref, base string) string {
+	if strings.HasPrefix(ref, "#") {
+		ref = base + ref
+	}
+
+	if !strings.Contains(ref, "#") {
+		ref += "#main"
+	}
+
+	return ref
+}
+
+func (g *generator) resolve(ref string) *def {
+	nsid, name, _ := strings.Cut(ref, "#")
+	if d, ok := g.docs[nsid]; ok {
+		return d.Defs[name]
+	}
+
+	return nil
+}
+
+func (g *generator) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&g.buf, format, args...)
+}
+
+// function comment writes a doc comment in the style of the repo
+func (g *generator) comment(kind, name, text string) {
+	text = strings.Join(strings.Fields(text), " ")
+	if text == "" {
+		return
+	}
+
+	line := fmt.Sprintf("// %v %v", kind, name)
+	for _, w := range strings.Fields(text) {
+		if len(line)+len(w) > 76 {
+			g.printf("%v\n", line)
+			line = "//"
+		}
+
+		line += " " + w
+	}
+
+	g.printf("%v\n", line)
+}
+
+// function goType is the Go type of a field. Optional numbers, booleans and
+// objects are pointers so their zero values can be told apart.
+func (g *generator) goType(d *def, base string, required bool) string {
+	optional := func(t string) string {
+		if required {
+			return t
+		}
+
+		return "*" + t
+	}
+
+	switch d.Type {
+	case "string":
+		return "string"
+	case "integer":
+		return optional("int64")
+	case "boolean":
+		return optional("bool")
+	case "array":
+		return "[]" + g.goType(d.Items, base, true)
+	case "blob":
+		return optional("Blob")
+	case "cid-link":
+		return optional("BlobRef")
+	case "bytes":
+		return "[]byte"
+	case "ref":
+		ref := qualify(d.Ref, base)
+		target := g.resolve(ref)
+		if target == nil {
+			return "json.RawMessage"
+		} else if target.Type != "object" {
+			nsid, _, _ := strings.Cut(ref, "#")
+			return g.goType(target, nsid, required)
+		}
+
+		if !g.done[typeName(ref)] && !slices.Contains(g.queue, ref) {
+			g.queue = append(g.queue, ref)
+		}
+
+		return optional(typeName(ref))
+	default:
+		// unions and unknown values are decoded by the caller
+		return "json.RawMessage"
+	}
+}
+
+// function object writes a struct for an object schema
+func (g *generator) object(name, description string, d *def, base string) {
+	g.done[name] = true
+	g.comment("struct", name, description)
+	g.printf("type %v struct {\n", name)
+
+	for i, key := range d.Properties.Keys {
+		prop := d.Properties.Defs[key]
+		required := slices.Contains(d.Required, key)
+		tag := key
+		if !required {
+			tag += ",omitempty"
+		}
+
+		if prop.Description != "" {
+			if i > 0 {
+				g.printf("\n")
+			}
+
+			for _, line := range wrap(prop.Description, 72) {
+				g.printf("// %v\n", line)
+			}
+		}
+
+		g.printf("%v %v `json:\"%v\"`\n", exported(key), g.goType(prop, base, required), tag)
+	}
+
+	g.printf("}\n\n")
+}
+
+func wrap(text string, width int) []string {
+	lines := []string{}
+	line := ""
+	for _, w := range strings.Fields(text) {
+		if line != "" && len(line)+len(w) >= width {
+			lines = append(lines, line)
+			line = ""
+		}
+
+		if line != "" {
+			line += " "
+		}
+
+		line += w
+	}
+
+	return append(lines, line)
+}
+
+// function params writes a struct for query parameters and the method that
+// encodes it as a query string
+func (g *generator) params(name, nsid string, d *def) {
+	g.object(name, fmt.Sprintf("holds the parameters of %v", nsid), d, nsid)
+
+	g.printf("// function Values encodes the parameters as a query string\n")
+	g.printf("func (p %v) Values() url.Values {\n", name)
+	g.printf("v := url.Values{}\n")
+	for _, key := range d.Properties.Keys {
+		prop := d.Properties.Defs[key]
+		field := "p." + exported(key)
+		required := slices.Contains(d.Required, key)
+
+		switch t := g.goType(prop, nsid, required); t {
+		case "string":
+			if required {
+				g.printf("v.Set(%q, %v)\n", key, field)
+			} else {
+				g.printf("if %v != \"\" {\nv.Set(%q, %v)\n}\n", field, key, field)
+			}
+		case "int64", "bool":
+			g.printf("v.Set(%q, fmt.Sprint(%v))\n", key, field)
+		case "*int64", "*bool":
+			g.printf("if %v != nil {\nv.Set(%q, fmt.Sprint(*%v))\n}\n", field, key, field)
+		case "[]string":
+			g.printf("for _, s := range %v {\nv.Add(%q, s)\n}\n", field, key)
+		default:
+			log.Fatalf("unable to encode parameter %v of %v as %v", key, nsid, t)
+		}
+	}
+
+	g.printf("\nreturn v\n}\n\n")
+}
+
+// function endpoint writes the types of a query or procedure and the method
+// that calls it
+func (g *generator) endpoint(nsid string, d *def) {
+	name := typeName(nsid + "#main")
+	args := []string{"ctx context.Context"}
+	params, in, out := "nil", "nil", ""
+
+	if d.Parameters != nil && len(d.Parameters.Properties.Keys) > 0 {
+		g.params(name+"Params", nsid, d.Parameters)
+		args = append(args, "params "+name+"Params")
+		params = "params.Values()"
+	}
+
+	if d.Input != nil {
+		if d.Input.Encoding == "application/json" && d.Input.Schema != nil {
+			g.object(name+"Input", fmt.Sprintf("is the body of %v", nsid), d.Input.Schema, nsid)
+			args = append(args, "input "+name+"Input")
+		} else {
+			args = append(args, "input RawBody")
+		}
+
+		in = "input"
+	}
+
+	if d.Output != nil && d.Output.Encoding != "application/json" {
+		log.Printf("skipping %v, it responds with %v", nsid, d.Output.Encoding)
+		return
+	}
+
+	if d.Output != nil && d.Output.Schema != nil {
+		out = name + "Output"
+		g.object(out, fmt.Sprintf("is the response of %v", nsid), d.Output.Schema, nsid)
+	}
+
+	if slices.Contains(unauthenticated, nsid) {
+		return
+	}
+
+	call := fmt.Sprintf("c.Query(ctx, %q, %v, ", nsid, params)
+	if d.Type == "procedure" {
+		call = fmt.Sprintf("c.Procedure(ctx, %q, %v, ", nsid, in)
+	}
+
+	g.comment("function", name, fmt.Sprintf("calls %v. %v", nsid, d.Description))
+	if out == "" {
+		g.printf("func (c *AtClient) %v(%v) error {\n", name, strings.Join(args, ", "))
+		g.printf("return %vnil)\n}\n\n", call)
+		return
+	}
+
+	g.printf("func (c *AtClient) %v(%v) (*%v, error) {\n", name, strings.Join(args, ", "), out)
+	g.printf("out := %v{}\n", out)
+	g.printf("if err := %v&out); err != nil {\nreturn nil, err\n}\n\n", call)
+	g.printf("return &out, nil\n}\n\n")
+}
+
+// function Generate returns the formatted Go source for the endpoints in
+// docs, in NSID order
+func Generate(docs map[string]*doc, pkg string) ([]byte, error) {
+	g := generator{docs: docs, done: map[string]bool{}}
+
+	ids := []string{}
+	for id := range docs {
+		ids = append(ids, id)
+	}
+
+	slices.Sort(ids)
+	for _, id := range ids {
+		main := docs[id].Defs["main"]
+		if main != nil && (main.Type == "query" || main.Type == "procedure") {
+			g.endpoint(id, main)
+		}
+	}
+
+	for len(g.queue) > 0 {
+		ref := g.queue[0]
+		g.queue = g.queue[1:]
+
+		nsid, _, _ := strings.Cut(ref, "#")
+		d := g.resolve(ref)
+		description := d.Description
+		if description == "" {
+			description = "is " + strings.TrimSuffix(ref, "#main")
+		}
+
+		g.object(typeName(ref), description, d, nsid)
+	}
+
+	src := bytes.NewBufferString("// Code generated by lexgen from data/lexicons. DO NOT EDIT.\n\n")
+	fmt.Fprintf(src, "package %v\n\nimport (\n", pkg)
+	for _, imp := range [][2]string{
+		{"context", "context.Context"},
+		{"encoding/json", "json.RawMessage"},
+		{"fmt", "fmt.Sprint"},
+		{"net/url", "url.Values"},
+	} {
+		if bytes.Contains(g.buf.Bytes(), []byte(imp[1])) {
+			fmt.Fprintf(src, "%q\n", imp[0])
+		}
+	}
+
+	fmt.Fprintf(src, ")\n\n")
+	src.Write(g.buf.Bytes())
+
+	return format.Source(src.Bytes())
+}
+
+// function Load reads every lexicon document under dir
+func Load(dir string) (map[string]*doc, error) {
+	docs := map[string]*doc{}
+	err := filepath.WalkDir(dir, func(p string, e fs.DirEntry, err error) error {
+		if err != nil || e.IsDir() || filepath.Ext(p) != ".json" {
+			return err
+		}
+
+		raw, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+
+		d := doc{}
+		if err = json.Unmarshal(raw, &d); err != nil {
+			return fmt.Errorf("unable to parse %v %v", p, err.Error())
+		}
+
+		docs[d.ID] = &d
+
+		return nil
+	})
+
+	return docs, err
+}
+
+func main() {
+	dir := flag.String("dir", "data/lexicons", "directory of lexicon JSON files")
+	out := flag.String("out", "lexicons_gen.go", "file to write")
+	pkg := flag.String("package", "main", "package of the generated file")
+	flag.Parse()
+
+	docs, err := Load(*dir)
+	if err != nil {
+		log.Fatalf("unable to load lexicons %v", err.Error())
+	}
+
+	src, err := Generate(docs, *pkg)
+	if err != nil {
+		log.Fatalf("unable to format generated code %v", err.Error())
+	}
+
+	if err = os.WriteFile(*out, src, 0o644); err != nil {
+		log.Fatalf("unable to write %v %v", *out, err.Error())
+	}
+}
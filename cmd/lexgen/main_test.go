@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestGenerate(t *testing.T) {
+	docs, err := Load("../../data/lexicons")
+	if err != nil {
+		t.Fatalf("unable to load lexicons %v", err.Error())
+	}
+
+	src, err := Generate(docs, "main")
+	if err != nil {
+		t.Fatalf("unable to generate %v", err.Error())
+	}
+
+	t.Run("generated file is up to date", func(t *testing.T) {
+		got, err := os.ReadFile("../../lexicons_gen.go")
+		if err != nil || !bytes.Equal(got, src) {
+			t.Errorf("wanted lexicons_gen.go to match the lexicons, run go generate ./... %v", err)
+		}
+	})
+
+	t.Run("records are not generated", func(t *testing.T) {
+		if strings.Contains(string(src), "FeedPost ") {
+			t.Errorf("wanted no record types but got app.bsky.feed.post")
+		}
+	})
+
+	t.Run("unauthenticated endpoints only have types", func(t *testing.T) {
+		if !strings.Contains(string(src), "ServerCreateSessionInput ") || strings.Contains(string(src), ") ServerCreateSession(") {
+			t.Errorf("wanted com.atproto.server.createSession types without a method")
+		}
+	})
+
+	t.Run("initialisms are capitalized", func(t *testing.T) {
+		for _, want := range []string{"DIDDoc ", "URI ", "CID "} {
+			if !strings.Contains(string(src), want) {
+				t.Errorf("wanted %q in the generated source", want)
+			}
+		}
+	})
+}
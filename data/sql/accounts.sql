@@ -0,0 +1,16 @@
+-- Accounts Table
+-- Bot accounts run from this installation, each with its own schedule
+CREATE TABLE IF NOT EXISTS accounts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    handle VARCHAR(255) NOT NULL UNIQUE,
+    did TEXT,
+    -- where sessions are created, e.g. a self-hosted PDS
+    service TEXT,
+    -- minutes between posts
+    post_interval INTEGER NOT NULL DEFAULT 1440,
+    -- who may reply to and quote posts, see gates.go; NULL for everybody
+    reply_rules TEXT,
+    quote_rules TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
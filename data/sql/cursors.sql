@@ -0,0 +1,12 @@
+-- Cursors Table
+-- Where the bot left off in paginated feeds, e.g. notifications
+CREATE TABLE IF NOT EXISTS cursors (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name VARCHAR(255) NOT NULL,
+    value TEXT NOT NULL,
+    -- accounts (id), 0 when no account is selected
+    account_id INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (account_id, name)
+);
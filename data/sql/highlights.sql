@@ -0,0 +1,46 @@
+-- Books & Highlights Tables
+-- Imported from Bookcision exports of Kindle notebooks
+CREATE TABLE IF NOT EXISTS books (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    asin VARCHAR(255) NOT NULL UNIQUE,
+    title TEXT NOT NULL,
+    authors TEXT NOT NULL,
+    -- the account whose theme the book belongs to, NULL to share it with every account
+    account_id INTEGER REFERENCES accounts (id),
+    -- comma separated self-labels for every highlight of the book, e.g. graphic-media
+    labels TEXT,
+    -- the page link cards point to, e.g. the publisher's, instead of Open Library
+    url TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS highlights (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    book_id INTEGER NOT NULL REFERENCES books (id),
+    text TEXT NOT NULL,
+    note TEXT,
+    location INTEGER,
+    -- postable, needs-thread, needs-image
+    status VARCHAR(255) NOT NULL,
+    -- comma separated self-labels added to those of the book and tags
+    labels TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (book_id, text)
+);
+
+-- Tags parsed from highlight notes, e.g. ".habits #focus"
+CREATE TABLE IF NOT EXISTS tags (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name VARCHAR(255) NOT NULL UNIQUE,
+    -- comma separated self-labels for every highlight with the tag
+    labels TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS highlight_tags (
+    highlight_id INTEGER NOT NULL REFERENCES highlights (id),
+    tag_id INTEGER NOT NULL REFERENCES tags (id),
+    PRIMARY KEY (highlight_id, tag_id)
+);
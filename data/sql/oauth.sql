@@ -0,0 +1,36 @@
+-- OAuth Tables
+-- Authorization requests waiting for the redirect back to `synapse serve`
+CREATE TABLE IF NOT EXISTS oauth_requests (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    state VARCHAR(255) NOT NULL UNIQUE,
+    did TEXT NOT NULL,
+    handle TEXT,
+    issuer TEXT NOT NULL,
+    pds TEXT NOT NULL,
+    token_endpoint TEXT NOT NULL,
+    client_id TEXT NOT NULL,
+    redirect_uri TEXT NOT NULL,
+    -- PKCE code verifier
+    verifier TEXT NOT NULL,
+    -- base64url PKCS #8 ES256 key the tokens will be bound to
+    dpop_key TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+-- DPoP-bound sessions, used instead of app passwords
+CREATE TABLE IF NOT EXISTS oauth_sessions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    did TEXT NOT NULL UNIQUE,
+    handle TEXT,
+    issuer TEXT NOT NULL,
+    pds TEXT NOT NULL,
+    token_endpoint TEXT NOT NULL,
+    client_id TEXT NOT NULL,
+    scope TEXT NOT NULL,
+    dpop_key TEXT NOT NULL,
+    access_token TEXT NOT NULL,
+    refresh_token TEXT NOT NULL,
+    expires_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
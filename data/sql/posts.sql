@@ -0,0 +1,24 @@
+-- Posts Table
+-- Records published to BlueSky by the bot
+CREATE TABLE IF NOT EXISTS posts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    uri TEXT NOT NULL UNIQUE,
+    -- NULL while the post is reserved but not confirmed to exist
+    cid TEXT,
+    text TEXT NOT NULL,
+    -- the record as sent, so a retry sends exactly the same post
+    record TEXT NOT NULL,
+    highlight_id INTEGER REFERENCES highlights (id),
+    -- set for replies within a thread
+    root_uri TEXT,
+    parent_uri TEXT,
+    posted_at TIMESTAMP NOT NULL,
+    -- set when the record no longer exists in the repo
+    deleted_at TIMESTAMP,
+    -- set when the PDS rejected the reserved record, so it is not sent again
+    failed_at TIMESTAMP,
+    -- accounts (id) that posted it, 0 when no account is selected
+    account_id INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
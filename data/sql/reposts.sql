@@ -0,0 +1,17 @@
+-- Reposts Table
+-- Throwback reposts of the bot's own posts, one row per app.bsky.feed.repost record
+CREATE TABLE IF NOT EXISTS reposts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    post_id INTEGER NOT NULL REFERENCES posts (id),
+    -- the repost record, not the post
+    uri TEXT NOT NULL UNIQUE,
+    cid TEXT NOT NULL,
+    reposted_at TIMESTAMP NOT NULL,
+    -- set when the repost record is deleted after the undo window
+    undone_at TIMESTAMP,
+    -- accounts (id) that reposted it, 0 when no account is selected
+    account_id INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS reposts_post_id ON reposts (post_id, reposted_at);
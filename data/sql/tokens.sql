@@ -1,13 +1,16 @@
 -- Token Table
 -- Used to authenticate with Discord & BlueSky APIs
 CREATE TABLE IF NOT EXISTS tokens (
-    id SERIAL PRIMARY KEY,
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
     token TEXT NOT NULL,
     -- access, refresh
     type VARCHAR(255) NOT NULL,
     -- discord, bluesky
     api VARCHAR(255) NOT NULL,
     expires_at TIMESTAMP NOT NULL,
+    -- accounts (id), 0 when no account is selected
+    account_id INTEGER NOT NULL DEFAULT 0,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (account_id, api, type)
 );
@@ -2,8 +2,12 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"regexp"
+	"slices"
 	"strings"
 	"time"
 
@@ -22,6 +26,14 @@ const (
 	MigrationReverted MigrationState = iota
 )
 
+const (
+	AccessToken  TokenType = "access"
+	RefreshToken TokenType = "refresh"
+
+	BlueskyAPI TokenAPI = "bluesky"
+	DiscordAPI TokenAPI = "discord"
+)
+
 // MigrationState represents an enumerable description of the
 // state of a migration. See [MigrationState.String] for mapping.
 type MigrationState int
@@ -31,15 +43,23 @@ type Repo interface {
 	InsertRow(rec Repo) (ok bool, id string, err error)
 }
 
+// struct Connection is a handle to the database. Tokens, posts and cursors
+// belong to AccountID, see [Connection.ForAccount]; 0 means no account is
+// selected.
 type Connection struct {
-	Db *sql.DB
+	Db        *sql.DB
+	AccountID int64
+	// ReplyRules and QuoteRules are given with --replies and --quotes for
+	// every account of a run, see [PostGates]
+	ReplyRules string
+	QuoteRules string
 }
 
-// struct Migration represents a single [sql.DB] migration
+// struct Migration represents a single [sql.DB] migration, made once to
+// databases created before it, see [Connection.Migrate]
 type Migration struct {
-	ID      string
-	SQL     string
-	Applied string
+	ID string
+	Up func(tx *sql.Tx) error
 }
 
 type Schema struct {
@@ -50,6 +70,45 @@ type Schema struct {
 	Hash        string
 }
 
+type TokenType = string
+
+type TokenAPI = string
+
+// struct Token is a row in the tokens table
+type Token struct {
+	Token     string
+	Type      TokenType
+	API       TokenAPI
+	ExpiresAt time.Time
+}
+
+// struct PostRow is a row in the posts table
+type PostRow struct {
+	ID          int64
+	URI         string
+	CID         string
+	Text        string
+	RootURI     string
+	ParentURI   string
+	HighlightID int64
+	PostedAt    time.Time
+	DeletedAt   time.Time
+}
+
+// struct Highlight is a row in the highlights table along with its book
+type Highlight struct {
+	ID       int64
+	BookID   int64
+	Text     string
+	Location int
+	Status   PostStatus
+	Title    string
+	Authors  string
+	ASIN     string
+	// URL is the book's source page, see [Highlight.SourceURL]
+	URL string
+}
+
 type Metadata struct {
 	Name string `json:"name"`
 	Desc string `json:"description"`
@@ -72,7 +131,9 @@ func CreateConnection() *Connection {
 	var err error
 	c := Connection{}
 
-	if c.Db, err = sql.Open("sqlite3", DataSourceName); err != nil {
+	// Accounts are worked on concurrently, see [Worker.DoWork], so writers
+	// wait for each other's locks
+	if c.Db, err = sql.Open("sqlite3", DataSourceName+"?_busy_timeout=5000"); err != nil {
 		logger.Fatal(
 			fmt.Sprintf("unable to connect to database %v %v", DataSourceName, err.Error()),
 		)
@@ -132,11 +193,64 @@ func SetupDb(force bool) error {
 		}
 	}
 
-	c := CreateConnection()
+	return CreateConnection().Migrate(pending)
+}
 
-	for _, f := range pending {
-		err = c.ExecuteSQL(f)
-		if err != nil {
+// Migrations bring tables created by an earlier release up to their
+// definition in [SQLDir]. PRAGMA user_version is the number applied. Steps
+// check the table first, since databases from before versioning may already
+// have some of the changes.
+var Migrations = []Migration{
+	{"tokens-account-id", rebuildTable("tokens.sql", "tokens", nil)},
+	{"cursors-account-id", rebuildTable("cursors.sql", "cursors", nil)},
+	// Posts were reserved before they were sent, with cid made nullable,
+	// and later gained failed_at and account_id
+	{"posts-reserved", rebuildTable("posts.sql", "posts", map[string]string{
+		"record": `json_object('$type', 'app.bsky.feed.post', 'text', text, 'createdAt', posted_at)`,
+	})},
+	{"books-account-id", addColumn("books", "account_id", "INTEGER REFERENCES accounts (id)")},
+	{"accounts-gates", func(tx *sql.Tx) error {
+		if err := addColumn("accounts", "reply_rules", "TEXT")(tx); err != nil {
+			return err
+		}
+
+		return addColumn("accounts", "quote_rules", "TEXT")(tx)
+	}},
+	{"labels", func(tx *sql.Tx) error {
+		for _, table := range []string{"books", "highlights", "tags"} {
+			if err := addColumn(table, "labels", "TEXT")(tx); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}},
+	{"books-url", addColumn("books", "url", "TEXT")},
+	// App passwords were stored with accounts; they now come from
+	// [AccountPasswordEnv]
+	{"accounts-password", rebuildTable("accounts.sql", "accounts", nil)},
+}
+
+// function Migrate creates the tables in files that don't exist and applies
+// the [Migrations] the database hasn't had. A new database is created as the
+// files define it, so it needs none of them.
+func (c Connection) Migrate(files []string) error {
+	version, tables := 0, 0
+	if err := c.Db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return fmt.Errorf("unable to read schema version %v", err.Error())
+	}
+
+	err := c.Db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'`).Scan(&tables)
+	if err != nil {
+		return fmt.Errorf("unable to list tables %v", err.Error())
+	}
+
+	if tables == 0 {
+		version = len(Migrations)
+	}
+
+	for _, f := range files {
+		if err = c.ExecuteSQL(f); err != nil {
 			logger.Errorf("query failed with err %v", err.Error())
 
 			return err
@@ -146,5 +260,1137 @@ func SetupDb(force bool) error {
 		logger.Infof("created table %v", s)
 	}
 
+	for i := version; i < len(Migrations); i++ {
+		if err = c.migrate(i+1, Migrations[i]); err != nil {
+			return err
+		}
+
+		logger.Infof("applied migration %v %v", i+1, Migrations[i].ID)
+	}
+
+	if tables == 0 {
+		if _, err = c.Db.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, version)); err != nil {
+			return fmt.Errorf("unable to set schema version %v", err.Error())
+		}
+	}
+
+	return nil
+}
+
+func (c Connection) migrate(version int, m Migration) error {
+	tx, err := c.Db.Begin()
+	if err != nil {
+		return fmt.Errorf("unable to start migration %v %v", m.ID, err.Error())
+	}
+
+	defer tx.Rollback()
+
+	if err = m.Up(tx); err != nil {
+		return fmt.Errorf("unable to apply migration %v %v", m.ID, err.Error())
+	}
+
+	if _, err = tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, version)); err != nil {
+		return fmt.Errorf("unable to set schema version %v", err.Error())
+	}
+
+	return tx.Commit()
+}
+
+// function columns returns the names of a table's columns
+func columns(tx *sql.Tx, table string) ([]string, error) {
+	rows, err := tx.Query(fmt.Sprintf(`SELECT name FROM pragma_table_info('%v')`, table))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read columns of %v %v", table, err.Error())
+	}
+
+	defer rows.Close()
+
+	names := []string{}
+	for rows.Next() {
+		name := ""
+		if err = rows.Scan(&name); err != nil {
+			return nil, err
+		}
+
+		names = append(names, name)
+	}
+
+	return names, rows.Err()
+}
+
+// function addColumn is a migration adding a column the table doesn't have
+func addColumn(table, column, definition string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		names, err := columns(tx, table)
+		if err != nil || slices.Contains(names, column) {
+			return err
+		}
+
+		_, err = tx.Exec(fmt.Sprintf(`ALTER TABLE %v ADD COLUMN %v %v`, table, column, definition))
+
+		return err
+	}
+}
+
+// function rebuildTable is a migration for changes ALTER TABLE can't make,
+// e.g. to constraints. The table is recreated as file defines it and its
+// rows copied over; new columns take their default, or the expression in
+// fill for existing rows.
+func rebuildTable(file, table string, fill map[string]string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		contents, err := os.ReadFile(fmt.Sprintf("%v/%v", SQLDir, file))
+		if err != nil {
+			return fmt.Errorf("unable to read file %v %v", file, err.Error())
+		}
+
+		create := regexp.MustCompile(`(?s)CREATE TABLE IF NOT EXISTS ` + table + ` \(.*?\n\);`).Find(contents)
+		if create == nil {
+			return fmt.Errorf("%v does not define table %v", file, table)
+		}
+
+		old, err := columns(tx, table)
+		if err != nil {
+			return err
+		}
+
+		rebuilt := table + "_rebuilt"
+		stmt := strings.Replace(string(create), "IF NOT EXISTS "+table, rebuilt, 1)
+		if _, err = tx.Exec(stmt); err != nil {
+			return fmt.Errorf("unable to create %v %v", rebuilt, err.Error())
+		}
+
+		names, err := columns(tx, rebuilt)
+		if err != nil {
+			return err
+		}
+
+		into, from := []string{}, []string{}
+		for _, name := range names {
+			if slices.Contains(old, name) {
+				into, from = append(into, name), append(from, name)
+			} else if expr, ok := fill[name]; ok {
+				into, from = append(into, name), append(from, expr)
+			}
+		}
+
+		// Newer rows replace older duplicates a new unique constraint rejects
+		_, err = tx.Exec(fmt.Sprintf(
+			`INSERT OR REPLACE INTO %v (%v) SELECT %v FROM %v ORDER BY rowid`,
+			rebuilt, strings.Join(into, ", "), strings.Join(from, ", "), table,
+		))
+		if err != nil {
+			return fmt.Errorf("unable to copy %v %v", table, err.Error())
+		}
+
+		if _, err = tx.Exec(`DROP TABLE ` + table); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(fmt.Sprintf(`ALTER TABLE %v RENAME TO %v`, rebuilt, table))
+
+		return err
+	}
+}
+
+func (t Token) Expired() bool {
+	return !time.Now().Before(t.ExpiresAt)
+}
+
+// function SaveToken inserts or replaces the token of the same type for an API
+func (c Connection) SaveToken(t Token) error {
+	_, err := c.Db.Exec(`
+		INSERT INTO tokens (token, type, api, expires_at, account_id)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (account_id, api, type) DO UPDATE SET
+			token = excluded.token,
+			expires_at = excluded.expires_at,
+			updated_at = CURRENT_TIMESTAMP`,
+		t.Token, t.Type, t.API, t.ExpiresAt.UTC(), c.AccountID,
+	)
+	if err != nil {
+		return fmt.Errorf("unable to save %v %v token %v", t.API, t.Type, err.Error())
+	}
+
+	return nil
+}
+
+// function GetTokens returns the stored tokens for an API keyed by type
+func (c Connection) GetTokens(api TokenAPI) (map[TokenType]*Token, error) {
+	tokens := map[TokenType]*Token{}
+	rows, err := c.Db.Query(
+		`SELECT token, type, api, expires_at FROM tokens WHERE api = ? AND account_id = ?`,
+		api, c.AccountID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query %v tokens %v", api, err.Error())
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		t := Token{}
+		if err = rows.Scan(&t.Token, &t.Type, &t.API, &t.ExpiresAt); err != nil {
+			return nil, fmt.Errorf("unable to scan token %v", err.Error())
+		}
+
+		tokens[t.Type] = &t
+	}
+
+	return tokens, rows.Err()
+}
+
+// function SavePost records a published post and returns its row ID. A
+// highlightID of 0 means the post is not for a highlight.
+func (c Connection) SavePost(ref StrongRef, p Post, highlightID int64) (int64, error) {
+	return c.insertPost(ref.URI, sql.NullString{String: ref.CID, Valid: true}, p, highlightID)
+}
+
+// function ReservePost records a post before it is sent, under the URI its
+// record key will have. Until [Connection.ConfirmPost] is called the post is
+// pending and its highlight is not picked again.
+func (c Connection) ReservePost(uri string, p Post, highlightID int64) (int64, error) {
+	return c.insertPost(uri, sql.NullString{}, p, highlightID)
+}
+
+func (c Connection) insertPost(uri string, cid sql.NullString, p Post, highlightID int64) (int64, error) {
+	postedAt, err := time.Parse(time.RFC3339Nano, p.CreatedAt)
+	if err != nil {
+		postedAt = time.Now()
+	}
+
+	record, err := json.Marshal(p)
+	if err != nil {
+		return 0, fmt.Errorf("unable to marshal JSON %v", err.Error())
+	}
+
+	var root, parent sql.NullString
+	if p.Reply != nil {
+		root = sql.NullString{String: p.Reply.Root.URI, Valid: true}
+		parent = sql.NullString{String: p.Reply.Parent.URI, Valid: true}
+	}
+
+	highlight := sql.NullInt64{Int64: highlightID, Valid: highlightID != 0}
+
+	res, err := c.Db.Exec(`
+		INSERT INTO posts (uri, cid, text, record, highlight_id, root_uri, parent_uri, posted_at, account_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		uri, cid, p.Text, string(record), highlight, root, parent, postedAt.UTC(), c.AccountID,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("unable to save post %v %v", uri, err.Error())
+	}
+
+	return res.LastInsertId()
+}
+
+// function ConfirmPost stores the CID of a reserved post once it exists
+func (c Connection) ConfirmPost(uri, cid string) error {
+	_, err := c.Db.Exec(
+		`UPDATE posts SET cid = ?, updated_at = CURRENT_TIMESTAMP WHERE uri = ? AND account_id = ?`,
+		cid, uri, c.AccountID,
+	)
+	if err != nil {
+		return fmt.Errorf("unable to confirm post %v %v", uri, err.Error())
+	}
+
+	return nil
+}
+
+// function FailPost keeps the reservation of a post the PDS rejected, so
+// its highlight is not picked again, but stops it from being resent
+func (c Connection) FailPost(uri string) error {
+	_, err := c.Db.Exec(
+		`UPDATE posts SET failed_at = ?, updated_at = CURRENT_TIMESTAMP WHERE uri = ? AND cid IS NULL AND account_id = ?`,
+		time.Now().UTC(), uri, c.AccountID,
+	)
+	if err != nil {
+		return fmt.Errorf("unable to mark post %v failed %v", uri, err.Error())
+	}
+
+	return nil
+}
+
+// struct PendingPost is a reserved post that may not have been sent
+type PendingPost struct {
+	URI         string
+	Record      Post
+	HighlightID int64
+}
+
+// function PendingPosts returns reserved posts without a CID that have not
+// failed, oldest first
+func (c Connection) PendingPosts() ([]PendingPost, error) {
+	rows, err := c.Db.Query(`
+		SELECT uri, record, COALESCE(highlight_id, 0) FROM posts
+		WHERE cid IS NULL AND deleted_at IS NULL AND failed_at IS NULL AND account_id = ?
+		ORDER BY posted_at, id`,
+		c.AccountID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query pending posts %v", err.Error())
+	}
+
+	defer rows.Close()
+
+	pending := []PendingPost{}
+	for rows.Next() {
+		p := PendingPost{}
+		record := ""
+		if err = rows.Scan(&p.URI, &record, &p.HighlightID); err != nil {
+			return nil, fmt.Errorf("unable to scan post %v", err.Error())
+		}
+
+		if err = json.Unmarshal([]byte(record), &p.Record); err != nil {
+			return nil, fmt.Errorf("unable to marshal JSON %v %v", p.URI, err.Error())
+		}
+
+		pending = append(pending, p)
+	}
+
+	return pending, rows.Err()
+}
+
+const postColumns = `id, uri, COALESCE(cid, ''), text, COALESCE(root_uri, ''), COALESCE(parent_uri, ''),
+	COALESCE(highlight_id, 0), posted_at, deleted_at`
+
+// function queryPosts runs a query selecting [postColumns]
+func (c Connection) queryPosts(query string, args ...interface{}) ([]PostRow, error) {
+	rows, err := c.Db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query posts %v", err.Error())
+	}
+
+	defer rows.Close()
+
+	posts := []PostRow{}
+	for rows.Next() {
+		p := PostRow{}
+		deletedAt := sql.NullTime{}
+		err = rows.Scan(&p.ID, &p.URI, &p.CID, &p.Text, &p.RootURI, &p.ParentURI, &p.HighlightID, &p.PostedAt, &deletedAt)
+		if err != nil {
+			return nil, fmt.Errorf("unable to scan post %v", err.Error())
+		}
+
+		p.DeletedAt = deletedAt.Time
+		posts = append(posts, p)
+	}
+
+	return posts, rows.Err()
+}
+
+// function GetPost returns the post at uri, or [sql.ErrNoRows] when it is
+// not recorded
+func (c Connection) GetPost(uri string) (*PostRow, error) {
+	posts, err := c.queryPosts(`SELECT `+postColumns+` FROM posts WHERE uri = ? AND account_id = ?`, uri, c.AccountID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(posts) == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	return &posts[0], nil
+}
+
+// function GetThread returns the posts of a thread, root first
+func (c Connection) GetThread(rootURI string) ([]PostRow, error) {
+	return c.queryPosts(
+		`SELECT `+postColumns+` FROM posts WHERE (uri = ? OR root_uri = ?) AND account_id = ? ORDER BY posted_at, id`,
+		rootURI, rootURI, c.AccountID,
+	)
+}
+
+// function GetPosts returns every recorded post of the account, oldest first
+func (c Connection) GetPosts() ([]PostRow, error) {
+	return c.queryPosts(`SELECT `+postColumns+` FROM posts WHERE account_id = ? ORDER BY posted_at, id`, c.AccountID)
+}
+
+// function RelatedPost returns the account's most recent post of another
+// highlight from the same book as h or sharing a tag with it, or
+// [sql.ErrNoRows] when there is none. Only confirmed thread roots that have
+// not been deleted are considered, so the post can be quoted.
+func (c Connection) RelatedPost(h Highlight) (*PostRow, error) {
+	posts, err := c.queryPosts(`
+		SELECT `+postColumns+`
+		FROM posts
+		WHERE cid IS NOT NULL AND root_uri IS NULL AND deleted_at IS NULL AND account_id = ?
+			AND highlight_id IN (
+				SELECT id FROM highlights WHERE book_id = ? AND id != ?
+				UNION
+				SELECT o.highlight_id FROM highlight_tags o
+				JOIN highlight_tags t ON t.tag_id = o.tag_id
+				WHERE t.highlight_id = ? AND o.highlight_id != ?
+			)
+		ORDER BY posted_at DESC, id DESC
+		LIMIT 1`,
+		c.AccountID, h.BookID, h.ID, h.ID, h.ID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(posts) == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	return &posts[0], nil
+}
+
+// function MarkPostDeleted keeps the row of a deleted post so its highlight
+// is still considered posted
+func (c Connection) MarkPostDeleted(uri string) error {
+	_, err := c.Db.Exec(
+		`UPDATE posts SET deleted_at = ?, updated_at = CURRENT_TIMESTAMP WHERE uri = ? AND account_id = ?`,
+		time.Now().UTC(), uri, c.AccountID,
+	)
+	if err != nil {
+		return fmt.Errorf("unable to mark %v deleted %v", uri, err.Error())
+	}
+
+	return nil
+}
+
+const highlightColumns = `h.id, h.book_id, h.text, COALESCE(h.location, 0), h.status, b.title, b.authors, b.asin, COALESCE(b.url, '')`
+
+// function queryHighlights runs a query selecting [highlightColumns] from
+// highlights h joined with their books b
+func (c Connection) queryHighlights(query string, args ...interface{}) ([]Highlight, error) {
+	rows, err := c.Db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query highlights %v", err.Error())
+	}
+
+	defer rows.Close()
+
+	highlights := []Highlight{}
+	for rows.Next() {
+		h := Highlight{}
+		if err = rows.Scan(&h.ID, &h.BookID, &h.Text, &h.Location, &h.Status, &h.Title, &h.Authors, &h.ASIN, &h.URL); err != nil {
+			return nil, fmt.Errorf("unable to scan highlight %v", err.Error())
+		}
+
+		highlights = append(highlights, h)
+	}
+
+	return highlights, rows.Err()
+}
+
+// function GetHighlights returns every highlight of the account's books
+// with its book
+func (c Connection) GetHighlights() ([]Highlight, error) {
+	return c.queryHighlights(`
+		SELECT `+highlightColumns+`
+		FROM highlights h
+		JOIN books b ON b.id = h.book_id
+		WHERE b.account_id IS NULL OR b.account_id = ?
+		ORDER BY h.id`,
+		c.AccountID,
+	)
+}
+
+// function PostedHighlight returns the highlight shared by the post at uri,
+// or [sql.ErrNoRows] when the post is not one of the bot's highlights
+func (c Connection) PostedHighlight(uri string) (*Highlight, error) {
+	highlights, err := c.queryHighlights(`
+		SELECT `+highlightColumns+`
+		FROM posts p
+		JOIN highlights h ON h.id = p.highlight_id
+		JOIN books b ON b.id = h.book_id
+		WHERE p.uri = ?`,
+		uri,
+	)
+	if err != nil {
+		return nil, err
+	} else if len(highlights) == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	return &highlights[0], nil
+}
+
+// struct HighlightFilter narrows [Connection.RandomHighlights]. Zero values
+// match everything.
+type HighlightFilter struct {
+	BookID  int64
+	Tag     string
+	Exclude int64
+	Status  PostStatus
+}
+
+// function RandomHighlights returns up to limit highlights matching f in
+// random order
+func (c Connection) RandomHighlights(f HighlightFilter, limit int) ([]Highlight, error) {
+	return c.queryHighlights(`
+		SELECT `+highlightColumns+`
+		FROM highlights h
+		JOIN books b ON b.id = h.book_id
+		WHERE (? = 0 OR h.book_id = ?)
+		AND (? = '' OR EXISTS (
+			SELECT 1 FROM highlight_tags ht JOIN tags t ON t.id = ht.tag_id
+			WHERE ht.highlight_id = h.id AND t.name = ?
+		))
+		AND h.id != ?
+		AND (? = '' OR h.status = ?)
+		AND (b.account_id IS NULL OR b.account_id = ?)
+		ORDER BY RANDOM()
+		LIMIT ?`,
+		f.BookID, f.BookID, f.Tag, f.Tag, f.Exclude, f.Status, f.Status, c.AccountID, limit,
+	)
+}
+
+// function NextHighlight returns the earliest highlight of the account's books
+// that it has not posted, or [sql.ErrNoRows] when every highlight has been
+// posted. Highlights shared in replies to mentions still get a post of their
+// own.
+func (c Connection) NextHighlight() (*Highlight, error) {
+	h := Highlight{}
+	err := c.Db.QueryRow(`
+		SELECT `+highlightColumns+`
+		FROM highlights h
+		JOIN books b ON b.id = h.book_id
+		WHERE NOT EXISTS (
+			SELECT 1 FROM posts p
+			WHERE p.highlight_id = h.id AND p.root_uri IS NULL AND p.account_id = ?
+		)
+		AND (b.account_id IS NULL OR b.account_id = ?)
+		ORDER BY h.id
+		LIMIT 1`,
+		c.AccountID, c.AccountID,
+	).Scan(&h.ID, &h.BookID, &h.Text, &h.Location, &h.Status, &h.Title, &h.Authors, &h.ASIN, &h.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &h, nil
+}
+
+// function HasReplied reports whether the bot has already replied to uri
+func (c Connection) HasReplied(uri string) (bool, error) {
+	var exists bool
+	err := c.Db.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM posts WHERE parent_uri = ? AND account_id = ?)`,
+		uri, c.AccountID,
+	).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("unable to query replies to %v %v", uri, err.Error())
+	}
+
+	return exists, nil
+}
+
+// function GetCursor returns the saved position in a paginated feed, or an
+// empty string when there is none
+func (c Connection) GetCursor(name string) (string, error) {
+	var value string
+	err := c.Db.QueryRow(`SELECT value FROM cursors WHERE name = ? AND account_id = ?`, name, c.AccountID).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("unable to query cursor %v %v", name, err.Error())
+	}
+
+	return value, nil
+}
+
+// function SaveCursor records the position in a paginated feed
+func (c Connection) SaveCursor(name, value string) error {
+	_, err := c.Db.Exec(`
+		INSERT INTO cursors (name, value, account_id) VALUES (?, ?, ?)
+		ON CONFLICT (account_id, name) DO UPDATE SET
+			value = excluded.value,
+			updated_at = CURRENT_TIMESTAMP`,
+		name, value, c.AccountID,
+	)
+	if err != nil {
+		return fmt.Errorf("unable to save cursor %v %v", name, err.Error())
+	}
+
+	return nil
+}
+
+// function MetricPosts returns the account's confirmed posts published since
+// then that have not been deleted, oldest first
+func (c Connection) MetricPosts(since time.Time) ([]PostRow, error) {
+	return c.queryPosts(`
+		SELECT `+postColumns+` FROM posts
+		WHERE cid IS NOT NULL AND deleted_at IS NULL AND account_id = ? AND posted_at >= ?
+		ORDER BY posted_at, id`,
+		c.AccountID, since.UTC(),
+	)
+}
+
+// function SaveMetrics stores an engagement snapshot of one of the bot's posts
+func (c Connection) SaveMetrics(m PostMetrics) error {
+	res, err := c.Db.Exec(`
+		INSERT INTO post_metrics (post_id, likes, reposts, replies, quotes, fetched_at)
+		SELECT id, ?, ?, ?, ?, ? FROM posts WHERE uri = ?`,
+		m.Likes, m.Reposts, m.Replies, m.Quotes, m.FetchedAt, m.URI,
+	)
+	if err != nil {
+		return fmt.Errorf("unable to save metrics of %v %v", m.URI, err.Error())
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("unable to save metrics of %v, it is not a recorded post", m.URI)
+	}
+
 	return nil
 }
+
+// function GetMetrics returns the engagement snapshots of a post, oldest first
+func (c Connection) GetMetrics(uri string) ([]PostMetrics, error) {
+	rows, err := c.Db.Query(`
+		SELECT p.uri, m.likes, m.reposts, m.replies, m.quotes, m.fetched_at
+		FROM post_metrics m
+		JOIN posts p ON p.id = m.post_id
+		WHERE p.uri = ?
+		ORDER BY m.fetched_at, m.id`,
+		uri,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query metrics of %v %v", uri, err.Error())
+	}
+
+	defer rows.Close()
+
+	metrics := []PostMetrics{}
+	for rows.Next() {
+		m := PostMetrics{}
+		if err = rows.Scan(&m.URI, &m.Likes, &m.Reposts, &m.Replies, &m.Quotes, &m.FetchedAt); err != nil {
+			return nil, fmt.Errorf("unable to scan metrics %v", err.Error())
+		}
+
+		metrics = append(metrics, m)
+	}
+
+	return metrics, rows.Err()
+}
+
+// struct HighlightEngagement is a highlight with the latest engagement of
+// every post that shared it added together
+type HighlightEngagement struct {
+	Highlight
+	Metrics PostMetrics
+}
+
+// scoreSQL is [PostMetrics.Score] over the columns of a post_metrics row
+const scoreSQL string = `(likes + replies + 2 * (reposts + quotes))`
+
+// function TopHighlights returns up to limit posted highlights with the most
+// engagement by [PostMetrics.Score]
+func (c Connection) TopHighlights(limit int) ([]HighlightEngagement, error) {
+	rows, err := c.Db.Query(`
+		WITH latest AS (
+			SELECT m.*, `+scoreSQL+` AS score FROM post_metrics m
+			WHERE m.id = (
+				SELECT id FROM post_metrics WHERE post_id = m.post_id
+				ORDER BY fetched_at DESC, id DESC LIMIT 1
+			)
+		)
+		SELECT `+highlightColumns+`,
+			SUM(l.likes), SUM(l.reposts), SUM(l.replies), SUM(l.quotes)
+		FROM latest l
+		JOIN posts p ON p.id = l.post_id
+		JOIN highlights h ON h.id = p.highlight_id
+		JOIN books b ON b.id = h.book_id
+		WHERE p.deleted_at IS NULL AND p.account_id = ?
+		GROUP BY h.id
+		ORDER BY SUM(l.score) DESC, h.id
+		LIMIT ?`,
+		c.AccountID, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query engagement %v", err.Error())
+	}
+
+	defer rows.Close()
+
+	top := []HighlightEngagement{}
+	for rows.Next() {
+		e := HighlightEngagement{}
+		h, m := &e.Highlight, &e.Metrics
+		err = rows.Scan(&h.ID, &h.BookID, &h.Text, &h.Location, &h.Status, &h.Title, &h.Authors, &h.ASIN, &h.URL,
+			&m.Likes, &m.Reposts, &m.Replies, &m.Quotes)
+		if err != nil {
+			return nil, fmt.Errorf("unable to scan engagement %v", err.Error())
+		}
+
+		top = append(top, e)
+	}
+
+	return top, rows.Err()
+}
+
+// function ThrowbackCandidate returns the account's thread root posted
+// before cutoff with the most engagement by [PostMetrics.Score], oldest
+// first on a tie, or [sql.ErrNoRows] when there is none. Posts without
+// engagement, or reposted since cutoff or not yet undone, are left out.
+func (c Connection) ThrowbackCandidate(cutoff time.Time) (*PostRow, error) {
+	posts, err := c.queryPosts(`
+		WITH scored AS (
+			SELECT p.*, (
+				SELECT `+scoreSQL+` FROM post_metrics m
+				WHERE m.post_id = p.id
+				ORDER BY m.fetched_at DESC, m.id DESC LIMIT 1
+			) AS score
+			FROM posts p
+			WHERE p.cid IS NOT NULL AND p.root_uri IS NULL AND p.deleted_at IS NULL AND p.highlight_id IS NOT NULL
+				AND p.account_id = ? AND p.posted_at <= ?
+				AND NOT EXISTS (
+					SELECT 1 FROM reposts r
+					WHERE r.post_id = p.id AND (r.reposted_at > ? OR r.undone_at IS NULL)
+				)
+		)
+		SELECT `+postColumns+` FROM scored
+		WHERE score > 0
+		ORDER BY score DESC, posted_at, id
+		LIMIT 1`,
+		c.AccountID, cutoff, cutoff,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(posts) == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	return &posts[0], nil
+}
+
+// function SaveRepost records that the post at uri was reposted by the
+// repost record ref
+func (c Connection) SaveRepost(uri string, ref StrongRef, at time.Time) error {
+	res, err := c.Db.Exec(`
+		INSERT INTO reposts (post_id, uri, cid, reposted_at, account_id)
+		SELECT id, ?, ?, ?, ? FROM posts WHERE uri = ?`,
+		ref.URI, ref.CID, at, c.AccountID, uri,
+	)
+	if err != nil {
+		return fmt.Errorf("unable to save repost of %v %v", uri, err.Error())
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("unable to save repost of %v, it is not a recorded post", uri)
+	}
+
+	return nil
+}
+
+// function ActiveReposts returns the URIs of the account's repost records
+// made before cutoff that have not been undone, oldest first
+func (c Connection) ActiveReposts(cutoff time.Time) ([]string, error) {
+	rows, err := c.Db.Query(
+		`SELECT uri FROM reposts WHERE undone_at IS NULL AND reposted_at <= ? AND account_id = ? ORDER BY reposted_at, id`,
+		cutoff, c.AccountID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query reposts %v", err.Error())
+	}
+
+	defer rows.Close()
+
+	uris := []string{}
+	for rows.Next() {
+		var uri string
+		if err = rows.Scan(&uri); err != nil {
+			return nil, fmt.Errorf("unable to scan repost %v", err.Error())
+		}
+
+		uris = append(uris, uri)
+	}
+
+	return uris, rows.Err()
+}
+
+// function MarkRepostUndone keeps the row of a deleted repost record, so
+// the post is not reposted again too soon
+func (c Connection) MarkRepostUndone(uri string) error {
+	_, err := c.Db.Exec(`UPDATE reposts SET undone_at = ? WHERE uri = ?`, time.Now().UTC(), uri)
+	if err != nil {
+		return fmt.Errorf("unable to mark repost %v undone %v", uri, err.Error())
+	}
+
+	return nil
+}
+
+// function SaveOAuthRequest stores an authorization until the redirect back
+func (c Connection) SaveOAuthRequest(r OAuthRequest) error {
+	key, err := r.DPoP.Marshal()
+	if err != nil {
+		return err
+	}
+
+	_, err = c.Db.Exec(`
+		INSERT INTO oauth_requests
+			(state, did, handle, issuer, pds, token_endpoint, client_id, redirect_uri, verifier, dpop_key, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		r.State, r.DID, r.Handle, r.Issuer, r.PDS, r.TokenEndpoint, r.ClientID, r.RedirectURI, r.Verifier, key, time.Now().UTC(),
+	)
+	if err != nil {
+		return fmt.Errorf("unable to save authorization request %v", err.Error())
+	}
+
+	return nil
+}
+
+// function TakeOAuthRequest returns the authorization request for state and
+// deletes it, so each can only be completed once
+func (c Connection) TakeOAuthRequest(state string) (*OAuthRequest, error) {
+	r := OAuthRequest{}
+	var key string
+	err := c.Db.QueryRow(`
+		DELETE FROM oauth_requests WHERE state = ?
+		RETURNING state, did, COALESCE(handle, ''), issuer, pds, token_endpoint, client_id, redirect_uri, verifier, dpop_key, created_at`,
+		state,
+	).Scan(&r.State, &r.DID, &r.Handle, &r.Issuer, &r.PDS, &r.TokenEndpoint, &r.ClientID, &r.RedirectURI, &r.Verifier, &key, &r.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("unknown authorization request, sign in again")
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to load authorization request %v", err.Error())
+	}
+
+	if r.DPoP, err = ParseDPoP(key); err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+// function SaveOAuthSession stores the tokens and DPoP key of an account
+func (c Connection) SaveOAuthSession(s OAuthSession) error {
+	key, err := s.DPoP.Marshal()
+	if err != nil {
+		return err
+	}
+
+	expiresAt := sql.NullTime{Time: s.ExpiresAt.UTC(), Valid: !s.ExpiresAt.IsZero()}
+	_, err = c.Db.Exec(`
+		INSERT INTO oauth_sessions
+			(did, handle, issuer, pds, token_endpoint, client_id, scope, dpop_key, access_token, refresh_token, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (did) DO UPDATE SET
+			handle = excluded.handle,
+			issuer = excluded.issuer,
+			pds = excluded.pds,
+			token_endpoint = excluded.token_endpoint,
+			client_id = excluded.client_id,
+			scope = excluded.scope,
+			dpop_key = excluded.dpop_key,
+			access_token = excluded.access_token,
+			refresh_token = excluded.refresh_token,
+			expires_at = excluded.expires_at,
+			updated_at = CURRENT_TIMESTAMP`,
+		s.DID, s.Handle, s.Issuer, s.PDS, s.TokenEndpoint, s.ClientID, s.Scope, key, s.AccessToken, s.RefreshToken, expiresAt,
+	)
+	if err != nil {
+		return fmt.Errorf("unable to save OAuth session %v", err.Error())
+	}
+
+	return nil
+}
+
+// function GetOAuthSession returns the session of the account with the given
+// handle or DID, or the most recently updated one when account is empty.
+// It returns [sql.ErrNoRows] when there is none.
+func (c Connection) GetOAuthSession(account string) (*OAuthSession, error) {
+	s := OAuthSession{}
+	var key string
+	var expiresAt sql.NullTime
+	err := c.Db.QueryRow(`
+		SELECT did, COALESCE(handle, ''), issuer, pds, token_endpoint, client_id, scope, dpop_key,
+			access_token, refresh_token, expires_at
+		FROM oauth_sessions
+		WHERE ? = '' OR did = ? OR handle = ?
+		ORDER BY updated_at DESC, id DESC
+		LIMIT 1`,
+		account, account, account,
+	).Scan(&s.DID, &s.Handle, &s.Issuer, &s.PDS, &s.TokenEndpoint, &s.ClientID, &s.Scope, &key,
+		&s.AccessToken, &s.RefreshToken, &expiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	s.ExpiresAt = expiresAt.Time
+	if s.DPoP, err = ParseDPoP(key); err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+// struct Account is a bot account run from this installation
+type Account struct {
+	ID      int64
+	Handle  string
+	DID     string
+	Service string
+	// PostInterval is the number of minutes between posts
+	PostInterval int
+	// ReplyRules and QuoteRules are parsed by [ParseGates]
+	ReplyRules string
+	QuoteRules string
+}
+
+// function SaveAccount adds an account or updates the one with its handle
+// and returns its ID. An empty service, interval or rule keeps the stored
+// one; new accounts post every [DefaultPostInterval] minutes by default.
+func (c Connection) SaveAccount(a Account) (int64, error) {
+	var id int64
+	err := c.Db.QueryRow(`
+		INSERT INTO accounts (handle, service, post_interval, reply_rules, quote_rules)
+		VALUES (?1, NULLIF(?2, ''), COALESCE(NULLIF(?3, 0), ?6), NULLIF(?4, ''), NULLIF(?5, ''))
+		ON CONFLICT (handle) DO UPDATE SET
+			service = COALESCE(excluded.service, accounts.service),
+			post_interval = COALESCE(NULLIF(?3, 0), accounts.post_interval),
+			reply_rules = COALESCE(excluded.reply_rules, accounts.reply_rules),
+			quote_rules = COALESCE(excluded.quote_rules, accounts.quote_rules),
+			updated_at = CURRENT_TIMESTAMP
+		RETURNING id`,
+		a.Handle, a.Service, a.PostInterval, a.ReplyRules, a.QuoteRules, DefaultPostInterval,
+	).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("unable to save account %v %v", a.Handle, err.Error())
+	}
+
+	return id, nil
+}
+
+const accountColumns = `id, handle, COALESCE(did, ''), COALESCE(service, ''), post_interval,
+	COALESCE(reply_rules, ''), COALESCE(quote_rules, '')`
+
+// function GetAccounts returns every account in the order they were added
+func (c Connection) GetAccounts() ([]Account, error) {
+	rows, err := c.Db.Query(`SELECT ` + accountColumns + ` FROM accounts ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query accounts %v", err.Error())
+	}
+
+	defer rows.Close()
+
+	accounts := []Account{}
+	for rows.Next() {
+		a := Account{}
+		if err = rows.Scan(&a.ID, &a.Handle, &a.DID, &a.Service, &a.PostInterval, &a.ReplyRules, &a.QuoteRules); err != nil {
+			return nil, fmt.Errorf("unable to scan account %v", err.Error())
+		}
+
+		accounts = append(accounts, a)
+	}
+
+	return accounts, rows.Err()
+}
+
+// function GetAccount returns the account with the given handle, DID or ID,
+// or [sql.ErrNoRows] when there is none
+func (c Connection) GetAccount(account string) (*Account, error) {
+	a := Account{}
+	err := c.Db.QueryRow(
+		`SELECT `+accountColumns+` FROM accounts WHERE handle = ? OR did = ? OR CAST(id AS TEXT) = ?`,
+		strings.TrimPrefix(account, "@"), account, account,
+	).Scan(&a.ID, &a.Handle, &a.DID, &a.Service, &a.PostInterval, &a.ReplyRules, &a.QuoteRules)
+	if err != nil {
+		return nil, err
+	}
+
+	return &a, nil
+}
+
+// function SetAccountDID records the DID an account's handle resolved to
+func (c Connection) SetAccountDID(id int64, did string) error {
+	_, err := c.Db.Exec(`UPDATE accounts SET did = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`, did, id)
+	if err != nil {
+		return fmt.Errorf("unable to save DID of account %v %v", id, err.Error())
+	}
+
+	return nil
+}
+
+// function RemoveAccount deletes an account with its tokens and OAuth
+// sessions, so adding it again signs in afresh. Its posts are kept so they
+// are still considered posted.
+func (c Connection) RemoveAccount(id int64) error {
+	tx, err := c.Db.Begin()
+	if err != nil {
+		return fmt.Errorf("unable to remove account %v %v", id, err.Error())
+	}
+
+	defer tx.Rollback()
+
+	for _, query := range []string{
+		`DELETE FROM tokens WHERE account_id = ?1`,
+		`DELETE FROM cursors WHERE account_id = ?1`,
+		`UPDATE books SET account_id = NULL WHERE account_id = ?1`,
+		`DELETE FROM oauth_sessions WHERE did IN (SELECT did FROM accounts WHERE id = ?1)
+			OR handle IN (SELECT handle FROM accounts WHERE id = ?1)`,
+		`DELETE FROM oauth_requests WHERE did IN (SELECT did FROM accounts WHERE id = ?1)
+			OR handle IN (SELECT handle FROM accounts WHERE id = ?1)`,
+		`DELETE FROM accounts WHERE id = ?1`,
+	} {
+		if _, err = tx.Exec(query, id); err != nil {
+			return fmt.Errorf("unable to remove account %v %v", id, err.Error())
+		}
+	}
+
+	return tx.Commit()
+}
+
+// function ForAccount returns a connection scoped to an account
+func (c Connection) ForAccount(id int64) *Connection {
+	return &Connection{Db: c.Db, AccountID: id, ReplyRules: c.ReplyRules, QuoteRules: c.QuoteRules}
+}
+
+// function LastPostedAt is when the most recent highlight was posted, or the
+// zero time when nothing has been posted
+func (c Connection) LastPostedAt() (time.Time, error) {
+	var t sql.NullTime
+	err := c.Db.QueryRow(
+		`SELECT MAX(posted_at) FROM posts WHERE highlight_id IS NOT NULL AND root_uri IS NULL AND account_id = ?`,
+		c.AccountID,
+	).Scan(&t)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unable to query last post %v", err.Error())
+	}
+
+	return t.Time, nil
+}
+
+// struct LibraryStats summarizes the highlights an account can post
+type LibraryStats struct {
+	Books      int
+	Highlights int
+	Posted     int
+}
+
+// function LibraryStats counts the books and highlights shared with or
+// themed for the account, and how many of the highlights it has posted
+func (c Connection) LibraryStats() (LibraryStats, error) {
+	s := LibraryStats{}
+	err := c.Db.QueryRow(`
+		SELECT COUNT(DISTINCT b.id), COUNT(DISTINCT h.id), COUNT(DISTINCT p.highlight_id)
+		FROM books b
+		JOIN highlights h ON h.book_id = b.id
+		LEFT JOIN posts p ON p.highlight_id = h.id AND p.root_uri IS NULL
+			AND p.deleted_at IS NULL AND p.account_id = ?
+		WHERE b.account_id IS NULL OR b.account_id = ?`,
+		c.AccountID, c.AccountID,
+	).Scan(&s.Books, &s.Highlights, &s.Posted)
+	if err != nil {
+		return s, fmt.Errorf("unable to count highlights %v", err.Error())
+	}
+
+	return s, nil
+}
+
+// struct Labeled is a book, highlight or tag with self-labels
+type Labeled struct {
+	Target string
+	Name   string
+	Labels []string
+}
+
+// function SetLabels replaces the labels of the book with an ASIN or ID, the
+// highlight with an ID or the tag with a name
+func (c Connection) SetLabels(target, key string, labels []string) error {
+	value := strings.Join(labels, ",")
+
+	var res sql.Result
+	var err error
+	switch target {
+	case BookLabels:
+		res, err = c.Db.Exec(
+			`UPDATE books SET labels = NULLIF(?, ''), updated_at = CURRENT_TIMESTAMP WHERE asin = ? OR CAST(id AS TEXT) = ?`,
+			value, key, key,
+		)
+	case HighlightLabels:
+		res, err = c.Db.Exec(
+			`UPDATE highlights SET labels = NULLIF(?, ''), updated_at = CURRENT_TIMESTAMP WHERE CAST(id AS TEXT) = ?`,
+			value, key,
+		)
+	case TagLabels:
+		res, err = c.Db.Exec(`UPDATE tags SET labels = NULLIF(?, '') WHERE name = ?`, value, strings.ToLower(strings.TrimLeft(key, ".#")))
+	default:
+		return fmt.Errorf("unable to label %v, only a book, highlight or tag can be labeled", target)
+	}
+
+	if err != nil {
+		return fmt.Errorf("unable to label %v %v %v", target, key, err.Error())
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("unable to label %v %v: not found", target, key)
+	}
+
+	return nil
+}
+
+// function SetBookURL stores the source page of the book with an ASIN or
+// ID, or clears it when url is empty
+func (c Connection) SetBookURL(key, url string) error {
+	res, err := c.Db.Exec(
+		`UPDATE books SET url = NULLIF(?, ''), updated_at = CURRENT_TIMESTAMP WHERE asin = ? OR CAST(id AS TEXT) = ?`,
+		url, key, key,
+	)
+	if err != nil {
+		return fmt.Errorf("unable to set the url of book %v %v", key, err.Error())
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("unable to set the url of book %v: not found", key)
+	}
+
+	return nil
+}
+
+// function GetLabels returns every labeled book, highlight and tag
+func (c Connection) GetLabels() ([]Labeled, error) {
+	rows, err := c.Db.Query(`
+		SELECT 'book', title, labels FROM books WHERE labels IS NOT NULL
+		UNION ALL
+		SELECT 'highlight', CAST(id AS TEXT), labels FROM highlights WHERE labels IS NOT NULL
+		UNION ALL
+		SELECT 'tag', name, labels FROM tags WHERE labels IS NOT NULL`,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query labels %v", err.Error())
+	}
+
+	defer rows.Close()
+
+	labeled := []Labeled{}
+	for rows.Next() {
+		l := Labeled{}
+		var labels string
+		if err = rows.Scan(&l.Target, &l.Name, &labels); err != nil {
+			return nil, fmt.Errorf("unable to scan labels %v", err.Error())
+		}
+
+		l.Labels = strings.Split(labels, ",")
+		labeled = append(labeled, l)
+	}
+
+	return labeled, rows.Err()
+}
+
+// function GetHighlightLabels combines the labels of a highlight with those
+// of its book and tags
+func (c Connection) GetHighlightLabels(id int64) ([]string, error) {
+	var highlight, book, tags string
+	err := c.Db.QueryRow(`
+		SELECT COALESCE(h.labels, ''), COALESCE(b.labels, ''), COALESCE((
+			SELECT GROUP_CONCAT(t.labels) FROM highlight_tags ht
+			JOIN tags t ON t.id = ht.tag_id
+			WHERE ht.highlight_id = h.id AND t.labels IS NOT NULL
+		), '')
+		FROM highlights h
+		JOIN books b ON b.id = h.book_id
+		WHERE h.id = ?`,
+		id,
+	).Scan(&highlight, &book, &tags)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query labels of highlight %v %v", id, err.Error())
+	}
+
+	return ParseLabels(highlight, book, tags)
+}
@@ -1 +1,288 @@
 package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// function sqlFiles lists the table definitions in [SQLDir]
+func sqlFiles(t *testing.T) []string {
+	t.Helper()
+
+	entries, err := os.ReadDir(SQLDir)
+	if err != nil {
+		t.Fatalf("test setup failed, unable to read %v %v", SQLDir, err.Error())
+	}
+
+	files := []string{}
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".sql") {
+			files = append(files, fmt.Sprintf("%v/%v", SQLDir, e.Name()))
+		}
+	}
+
+	return files
+}
+
+// function testConnection opens an in-memory database with every table in
+// [SQLDir] created
+func testConnection(t *testing.T) *Connection {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("test setup failed, unable to open database %v", err.Error())
+	}
+
+	db.SetMaxOpenConns(1)
+	c := &Connection{Db: db}
+
+	if err = c.Migrate(sqlFiles(t)); err != nil {
+		t.Fatalf("test setup failed %v", err.Error())
+	}
+
+	t.Cleanup(func() { db.Close() })
+
+	return c
+}
+
+func TestTokens(t *testing.T) {
+	conn := testConnection(t)
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	t.Run("tokens are upserted per api and type", func(t *testing.T) {
+		for _, tok := range []string{"first", "second"} {
+			if err := conn.SaveToken(Token{tok, AccessToken, BlueskyAPI, expiry}); err != nil {
+				t.Fatalf("wanted no error but got %v", err.Error())
+			}
+		}
+
+		conn.SaveToken(Token{"discord", AccessToken, DiscordAPI, expiry})
+
+		got, err := conn.GetTokens(BlueskyAPI)
+		if err != nil {
+			t.Fatalf("wanted no error but got %v", err.Error())
+		}
+
+		if len(got) != 1 || got[AccessToken].Token != "second" {
+			t.Errorf("wanted only the latest access token but got %v", got)
+		}
+
+		if !got[AccessToken].ExpiresAt.Equal(expiry) {
+			t.Errorf("wanted expiry %v but got %v", expiry, got[AccessToken].ExpiresAt)
+		}
+	})
+
+	t.Run("expired tokens are reported", func(t *testing.T) {
+		tok := Token{ExpiresAt: time.Now().Add(-time.Minute)}
+		if !tok.Expired() {
+			t.Errorf("wanted token to be expired")
+		}
+	})
+}
+
+// baselineSchema is the database as first released, before migrations
+const baselineSchema = `
+CREATE TABLE tokens (
+    id SERIAL PRIMARY KEY,
+    token TEXT NOT NULL,
+    type VARCHAR(255) NOT NULL,
+    api VARCHAR(255) NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE posts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    uri TEXT NOT NULL UNIQUE,
+    cid TEXT NOT NULL,
+    text TEXT NOT NULL,
+    posted_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE cursors (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name VARCHAR(255) NOT NULL UNIQUE,
+    value TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE books (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    asin VARCHAR(255) NOT NULL UNIQUE,
+    title TEXT NOT NULL,
+    authors TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE highlights (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    book_id INTEGER NOT NULL REFERENCES books (id),
+    text TEXT NOT NULL,
+    note TEXT,
+    location INTEGER,
+    status VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (book_id, text)
+);
+
+CREATE TABLE tags (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name VARCHAR(255) NOT NULL UNIQUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE accounts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    handle VARCHAR(255) NOT NULL UNIQUE,
+    did TEXT,
+    password TEXT,
+    service TEXT,
+    post_interval INTEGER NOT NULL DEFAULT 1440,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO tokens (token, type, api, expires_at) VALUES
+    ('stale', 'access', 'bluesky', '2024-01-01 00:00:00'),
+    ('fresh', 'access', 'bluesky', '2024-01-02 00:00:00');
+INSERT INTO posts (uri, cid, text, posted_at) VALUES
+    ('at://did:plc:synapse/app.bsky.feed.post/1', 'bafyrei1', 'Capture everything that has your attention.', '2024-01-01 00:00:00');
+INSERT INTO cursors (name, value) VALUES ('notifications', '2024-01-01T00:00:00.000Z');
+INSERT INTO books (asin, title, authors) VALUES ('B00KWG9M2E', 'Getting Things Done', 'David Allen');
+INSERT INTO highlights (book_id, text, status) VALUES (1, 'Your mind is for having ideas, not holding them.', 'postable');
+INSERT INTO tags (name) VALUES ('capture');
+INSERT INTO accounts (handle) VALUES ('synapse.test');
+`
+
+func TestMigrate(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("test setup failed, unable to open database %v", err.Error())
+	}
+
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	conn := &Connection{Db: db}
+	if _, err = db.Exec(baselineSchema); err != nil {
+		t.Fatalf("test setup failed %v", err.Error())
+	}
+
+	if err = conn.Migrate(sqlFiles(t)); err != nil {
+		t.Fatalf("wanted no error but got %v", err.Error())
+	}
+
+	t.Run("the schema version is recorded", func(t *testing.T) {
+		version := 0
+		if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil || version != len(Migrations) {
+			t.Errorf("wanted version %v but got %v %v", len(Migrations), version, err)
+		}
+	})
+
+	t.Run("tokens are unique per account", func(t *testing.T) {
+		got, err := conn.GetTokens(BlueskyAPI)
+		if err != nil || len(got) != 1 || got[AccessToken].Token != "fresh" {
+			t.Fatalf("wanted the newest token to be kept but got %v %v", got, err)
+		}
+
+		expiry := time.Now().Add(time.Hour)
+		for _, c := range []*Connection{conn, conn.ForAccount(1)} {
+			if err := c.SaveToken(Token{"scoped", AccessToken, BlueskyAPI, expiry}); err != nil {
+				t.Errorf("wanted no error but got %v", err.Error())
+			}
+		}
+
+		if got, _ := conn.ForAccount(1).GetTokens(BlueskyAPI); len(got) != 1 {
+			t.Errorf("wanted a token for the account but got %v", got)
+		}
+	})
+
+	t.Run("cursors are unique per account", func(t *testing.T) {
+		if err := conn.ForAccount(1).SaveCursor(NotificationsCursor, "2024-02-01T00:00:00.000Z"); err != nil {
+			t.Fatalf("wanted no error but got %v", err.Error())
+		}
+
+		if cursor, err := conn.GetCursor(NotificationsCursor); err != nil || cursor != "2024-01-01T00:00:00.000Z" {
+			t.Errorf("wanted the cursor to be kept but got %v %v", cursor, err)
+		}
+	})
+
+	t.Run("posts can be reserved and failed", func(t *testing.T) {
+		posts, err := conn.GetPosts()
+		if err != nil || len(posts) != 1 || posts[0].CID != "bafyrei1" {
+			t.Fatalf("wanted the post to be kept but got %+v %v", posts, err)
+		}
+
+		uri := "at://did:plc:synapse/app.bsky.feed.post/2"
+		if _, err = conn.ReservePost(uri, NewPost("Your mind is for having ideas, not holding them."), 1); err != nil {
+			t.Fatalf("wanted no error but got %v", err.Error())
+		}
+
+		if err = conn.FailPost(uri); err != nil {
+			t.Errorf("wanted no error but got %v", err.Error())
+		}
+
+		if pending, err := conn.PendingPosts(); err != nil || len(pending) != 0 {
+			t.Errorf("wanted no pending posts but got %v %v", pending, err)
+		}
+	})
+
+	t.Run("books, highlights and tags take labels and urls", func(t *testing.T) {
+		for _, l := range []struct{ target, key string }{{BookLabels, "B00KWG9M2E"}, {HighlightLabels, "1"}, {TagLabels, "capture"}} {
+			if err := conn.SetLabels(l.target, l.key, []string{"graphic-media"}); err != nil {
+				t.Errorf("wanted no error but got %v", err.Error())
+			}
+		}
+
+		if err := conn.SetBookURL("B00KWG9M2E", "https://press.example.com/gtd"); err != nil {
+			t.Errorf("wanted no error but got %v", err.Error())
+		}
+
+		if h, err := conn.GetHighlights(); err != nil || len(h) != 1 || h[0].URL != "https://press.example.com/gtd" {
+			t.Errorf("unexpected highlights %+v %v", h, err)
+		}
+	})
+
+	t.Run("accounts take gates", func(t *testing.T) {
+		if _, err := conn.SaveAccount(Account{Handle: "synapse.test", PostInterval: 60, ReplyRules: "following"}); err != nil {
+			t.Fatalf("wanted no error but got %v", err.Error())
+		}
+
+		if a, err := conn.GetAccount("synapse.test"); err != nil || a.ReplyRules != "following" {
+			t.Errorf("unexpected account %+v %v", a, err)
+		}
+
+		passwords := 0
+		db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('accounts') WHERE name = 'password'`).Scan(&passwords)
+		if passwords != 0 {
+			t.Errorf("wanted stored passwords to be dropped")
+		}
+	})
+
+	t.Run("reposts are created", func(t *testing.T) {
+		if uris, err := conn.ActiveReposts(time.Now()); err != nil || len(uris) != 0 {
+			t.Errorf("wanted no reposts but got %v %v", uris, err)
+		}
+	})
+
+	t.Run("migrations are applied once", func(t *testing.T) {
+		if err := conn.Migrate(sqlFiles(t)); err != nil {
+			t.Fatalf("wanted no error but got %v", err.Error())
+		}
+
+		if posts, err := conn.GetPosts(); err != nil || len(posts) != 2 {
+			t.Errorf("wanted the posts to be kept but got %v %v", len(posts), err)
+		}
+	})
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DPoPNonceHeader string = "DPoP-Nonce"
+
+var b64 = base64.RawURLEncoding
+
+// struct JWK is the public half of a DPoP key, as embedded in proofs
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type dpopHeader struct {
+	Typ string `json:"typ"`
+	Alg string `json:"alg"`
+	JWK JWK    `json:"jwk"`
+}
+
+// struct DPoPClaims is the payload of a DPoP proof (RFC 9449)
+type DPoPClaims struct {
+	JTI   string `json:"jti"`
+	HTM   string `json:"htm"`
+	HTU   string `json:"htu"`
+	IAT   int64  `json:"iat"`
+	Nonce string `json:"nonce,omitempty"`
+	ATH   string `json:"ath,omitempty"`
+}
+
+// struct DPoP binds tokens to an ES256 key by signing a proof for every
+// request. Servers hand out nonces that must be echoed in later proofs;
+// they are remembered per origin.
+type DPoP struct {
+	Key *ecdsa.PrivateKey
+
+	mu     sync.Mutex
+	nonces map[string]string
+}
+
+// function NewDPoP generates a new P-256 key
+func NewDPoP() (*DPoP, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate DPoP key %v", err.Error())
+	}
+
+	return &DPoP{Key: key}, nil
+}
+
+// function ParseDPoP restores a key saved with [DPoP.Marshal]
+func ParseDPoP(s string) (*DPoP, error) {
+	der, err := b64.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode DPoP key %v", err.Error())
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse DPoP key %v", err.Error())
+	}
+
+	ec, ok := key.(*ecdsa.PrivateKey)
+	if !ok || ec.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("unable to parse DPoP key: not a P-256 key")
+	}
+
+	return &DPoP{Key: ec}, nil
+}
+
+// function Marshal encodes the private key as base64url PKCS #8
+func (d *DPoP) Marshal() (string, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(d.Key)
+	if err != nil {
+		return "", fmt.Errorf("unable to marshal DPoP key %v", err.Error())
+	}
+
+	return b64.EncodeToString(der), nil
+}
+
+func (d *DPoP) JWK() JWK {
+	pub, _ := d.Key.PublicKey.ECDH()
+	point := pub.Bytes()
+
+	return JWK{"EC", "P-256", b64.EncodeToString(point[1:33]), b64.EncodeToString(point[33:])}
+}
+
+// function htu is the target of a request without its query and fragment
+func htu(target string) string {
+	u, err := url.Parse(target)
+	if err != nil {
+		return target
+	}
+
+	u.RawQuery, u.Fragment = "", ""
+
+	return u.String()
+}
+
+func origin(target string) string {
+	u, err := url.Parse(target)
+	if err != nil {
+		return target
+	}
+
+	return u.Scheme + "://" + u.Host
+}
+
+// function Proof signs a DPoP proof for a request. accessToken is hashed
+// into the proof when the request carries one.
+func (d *DPoP) Proof(method, target, accessToken string) (string, error) {
+	jti, err := randomString(16)
+	if err != nil {
+		return "", err
+	}
+
+	claims := DPoPClaims{
+		JTI:   jti,
+		HTM:   method,
+		HTU:   htu(target),
+		IAT:   time.Now().Unix(),
+		Nonce: d.Nonce(target),
+	}
+
+	if accessToken != "" {
+		sum := sha256.Sum256([]byte(accessToken))
+		claims.ATH = b64.EncodeToString(sum[:])
+	}
+
+	header, _ := json.Marshal(dpopHeader{"dpop+jwt", "ES256", d.JWK()})
+	payload, _ := json.Marshal(claims)
+	signing := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+
+	digest := sha256.Sum256([]byte(signing))
+	r, s, err := ecdsa.Sign(rand.Reader, d.Key, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("unable to sign DPoP proof %v", err.Error())
+	}
+
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+
+	return signing + "." + b64.EncodeToString(sig), nil
+}
+
+// function Nonce is the latest nonce the origin of target sent
+func (d *DPoP) Nonce(target string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.nonces[origin(target)]
+}
+
+// function SaveNonce remembers the nonce in a response from target and
+// reports whether it changed
+func (d *DPoP) SaveNonce(target string, h http.Header) bool {
+	nonce := h.Get(DPoPNonceHeader)
+	if nonce == "" {
+		return false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.nonces == nil {
+		d.nonces = map[string]string{}
+	}
+
+	o := origin(target)
+	changed := d.nonces[o] != nonce
+	d.nonces[o] = nonce
+
+	return changed
+}
+
+// function NeedsNonce reports whether rsp rejected a proof for lacking a
+// fresh nonce. Authorization servers answer with a use_dpop_nonce error
+// body, resource servers with a WWW-Authenticate challenge.
+func NeedsNonce(rsp *http.Response, body []byte) bool {
+	if strings.Contains(rsp.Header.Get("WWW-Authenticate"), "use_dpop_nonce") {
+		return true
+	}
+
+	e := struct {
+		Error string `json:"error"`
+	}{}
+	json.Unmarshal(body, &e)
+
+	return e.Error == "use_dpop_nonce"
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+const (
+	ImagesEmbedType   string = "app.bsky.embed.images"
+	ExternalEmbedType string = "app.bsky.embed.external"
+	RecordEmbedType   string = "app.bsky.embed.record"
+	// RecordWithMediaEmbedType quotes a record alongside images or a link card
+	RecordWithMediaEmbedType string = "app.bsky.embed.recordWithMedia"
+	// MaxBlobSize is the largest image the app view accepts in an embed
+	MaxBlobSize int = 1000000
+)
+
+type BlobRef struct {
+	Link string `json:"$link"`
+}
+
+// struct Blob references data uploaded with com.atproto.repo.uploadBlob
+type Blob struct {
+	Type     string  `json:"$type"`
+	Ref      BlobRef `json:"ref"`
+	MimeType string  `json:"mimeType"`
+	Size     int     `json:"size"`
+}
+
+type AspectRatio struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+type EmbedImage struct {
+	Alt         string       `json:"alt"`
+	Image       Blob         `json:"image"`
+	AspectRatio *AspectRatio `json:"aspectRatio,omitempty"`
+}
+
+// struct ImagesEmbed is an app.bsky.embed.images embed
+type ImagesEmbed struct {
+	Type   string       `json:"$type"`
+	Images []EmbedImage `json:"images"`
+}
+
+func NewImagesEmbed(images ...EmbedImage) *ImagesEmbed {
+	return &ImagesEmbed{Type: ImagesEmbedType, Images: images}
+}
+
+// struct External is the link card of an app.bsky.embed.external embed
+type External struct {
+	URI         string `json:"uri"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Thumb       *Blob  `json:"thumb,omitempty"`
+}
+
+// struct ExternalEmbed is an app.bsky.embed.external embed
+type ExternalEmbed struct {
+	Type     string   `json:"$type"`
+	External External `json:"external"`
+}
+
+func NewExternalEmbed(e External) *ExternalEmbed {
+	return &ExternalEmbed{Type: ExternalEmbedType, External: e}
+}
+
+// struct RecordEmbed is an app.bsky.embed.record embed, i.e. a quote post
+type RecordEmbed struct {
+	Type   string    `json:"$type"`
+	Record StrongRef `json:"record"`
+}
+
+// struct RecordWithMediaEmbed is an app.bsky.embed.recordWithMedia embed
+type RecordWithMediaEmbed struct {
+	Type   string      `json:"$type"`
+	Record RecordEmbed `json:"record"`
+	Media  interface{} `json:"media"`
+}
+
+// function NewQuoteEmbed quotes the record at ref, together with media when
+// it is not nil, e.g. an [ImagesEmbed] or [ExternalEmbed]
+func NewQuoteEmbed(ref StrongRef, media interface{}) interface{} {
+	quote := RecordEmbed{Type: RecordEmbedType, Record: ref}
+	if media == nil {
+		return &quote
+	}
+
+	return &RecordWithMediaEmbed{Type: RecordWithMediaEmbedType, Record: quote, Media: media}
+}
+
+// function UploadBlob uploads data via com.atproto.repo.uploadBlob so it can
+// be referenced by a record
+func (c *AtClient) UploadBlob(ctx context.Context, data []byte, mimeType string) (*Blob, error) {
+	rsp, err := c.RepoUploadBlob(ctx, RawBody{data, mimeType})
+	if err != nil {
+		return nil, fmt.Errorf("unable to upload %v blob %w", mimeType, err)
+	}
+
+	logger.Debugf("uploaded %v blob %v (%v bytes)", mimeType, rsp.Blob.Ref.Link, rsp.Blob.Size)
+
+	return &rsp.Blob, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	LinkFeature    string = "app.bsky.richtext.facet#link"
+	MentionFeature string = "app.bsky.richtext.facet#mention"
+	TagFeature     string = "app.bsky.richtext.facet#tag"
+	MaxTagLength   int    = 64
+)
+
+// Go's regexp package works on bytes, so every index returned by these
+// expressions is already a UTF-8 byte offset, which is what facets expect.
+var (
+	linkPattern    = regexp.MustCompile(`(?:^|[\s(])(https?://[^\s]+)`)
+	mentionPattern = regexp.MustCompile(`(?:^|[\s(])@(([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)+[a-zA-Z]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)`)
+	tagPattern     = regexp.MustCompile(`(?:^|\s)[#＃]([^\s\x{00AD}\x{2060}\x{200A}\x{200B}\x{200C}\x{200D}\x{20E2}]+)`)
+)
+
+// struct ByteSlice is the half-open UTF-8 byte range a facet applies to
+type ByteSlice struct {
+	ByteStart int `json:"byteStart"`
+	ByteEnd   int `json:"byteEnd"`
+}
+
+type FacetFeature struct {
+	Type string `json:"$type"`
+	URI  string `json:"uri,omitempty"`
+	DID  string `json:"did,omitempty"`
+	Tag  string `json:"tag,omitempty"`
+}
+
+// struct Facet is an app.bsky.richtext.facet annotation
+type Facet struct {
+	Index    ByteSlice      `json:"index"`
+	Features []FacetFeature `json:"features"`
+}
+
+// struct Mention is an unresolved @handle found in a post's text
+type Mention struct {
+	Handle string
+	Index  ByteSlice
+}
+
+// function trimTrailingPunct shortens the match at [start, end) so it does
+// not end in punctuation, e.g. the period or closing quote after a link
+func trimTrailingPunct(text string, start, end int, keep string) int {
+	for end > start {
+		r, size := utf8.DecodeLastRuneInString(text[start:end])
+		if !unicode.IsPunct(r) && !unicode.IsSymbol(r) || strings.ContainsRune(keep, r) {
+			break
+		}
+
+		end -= size
+	}
+
+	return end
+}
+
+// function DetectLinks finds http(s) URLs in text
+func DetectLinks(text string) []Facet {
+	facets := []Facet{}
+	for _, m := range linkPattern.FindAllStringSubmatchIndex(text, -1) {
+		start := m[2]
+		end := trimTrailingPunct(text, start, m[3], "/)")
+
+		// Keep closing parens only when the URL opened them, e.g. Wikipedia links
+		for text[end-1] == ')' && strings.Count(text[start:end], ")") > strings.Count(text[start:end], "(") {
+			end--
+		}
+
+		if _, err := url.ParseRequestURI(text[start:end]); err != nil {
+			continue
+		}
+
+		facets = append(facets, Facet{
+			Index:    ByteSlice{start, end},
+			Features: []FacetFeature{{Type: LinkFeature, URI: text[start:end]}},
+		})
+	}
+
+	return facets
+}
+
+// function DetectTags finds #hashtags in text. Tags made only of digits or
+// longer than [MaxTagLength] are ignored.
+func DetectTags(text string) []Facet {
+	facets := []Facet{}
+	for _, m := range tagPattern.FindAllStringSubmatchIndex(text, -1) {
+		start := m[2]
+		end := trimTrailingPunct(text, start, m[3], "")
+		tag := text[start:end]
+
+		if tag == "" || utf8.RuneCountInString(tag) > MaxTagLength {
+			continue
+		}
+
+		if strings.IndexFunc(tag, func(r rune) bool { return !unicode.IsDigit(r) }) == -1 {
+			continue
+		}
+
+		// The index covers the leading # (one byte) or ＃ (three bytes)
+		_, size := utf8.DecodeLastRuneInString(text[:start])
+		facets = append(facets, Facet{
+			Index:    ByteSlice{start - size, end},
+			Features: []FacetFeature{{Type: TagFeature, Tag: tag}},
+		})
+	}
+
+	return facets
+}
+
+// function DetectMentions finds @handles in text
+func DetectMentions(text string) []Mention {
+	mentions := []Mention{}
+	for _, m := range mentionPattern.FindAllStringSubmatchIndex(text, -1) {
+		start, end := m[2], m[3]
+		mentions = append(mentions, Mention{
+			Handle: strings.ToLower(text[start:end]),
+			Index:  ByteSlice{start - 1, end},
+		})
+	}
+
+	return mentions
+}
+
+// function ResolveHandle looks up the DID for a handle via
+// com.atproto.identity.resolveHandle
+func (c *AtClient) ResolveHandle(ctx context.Context, handle string) (string, error) {
+	rsp, err := c.IdentityResolveHandle(ctx, IdentityResolveHandleParams{Handle: handle})
+	if err != nil {
+		return "", fmt.Errorf("unable to resolve handle %v %w", handle, err)
+	}
+
+	return rsp.DID, nil
+}
+
+// function BuildFacets detects links, mentions and tags in text. Mentions
+// that cannot be resolved to a DID are left as plain text.
+func (c *AtClient) BuildFacets(ctx context.Context, text string) []Facet {
+	facets := append(DetectLinks(text), DetectTags(text)...)
+
+	for _, m := range DetectMentions(text) {
+		did, err := c.ResolveHandle(ctx, m.Handle)
+		if err != nil {
+			logger.Warnf("skipping mention %v", err.Error())
+			continue
+		}
+
+		facets = append(facets, Facet{
+			Index:    m.Index,
+			Features: []FacetFeature{{Type: MentionFeature, DID: did}},
+		})
+	}
+
+	sort.Slice(facets, func(i, j int) bool {
+		return facets[i].Index.ByteStart < facets[j].Index.ByteStart
+	})
+
+	return facets
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFacets(t *testing.T) {
+	text := "“If an action will take less than two minutes, it should be done”—see https://gettingthingsdone.com/faq. #GTD, @david.allen.test"
+
+	t.Run("links use utf-8 byte ranges", func(t *testing.T) {
+		got := DetectLinks(text)
+		if len(got) != 1 {
+			t.Fatalf("wanted 1 link but got %v", got)
+		}
+
+		want := "https://gettingthingsdone.com/faq"
+		if s := text[got[0].Index.ByteStart:got[0].Index.ByteEnd]; s != want || got[0].Features[0].URI != want {
+			t.Errorf("wanted %v but got %v", want, s)
+		}
+	})
+
+	t.Run("tags include the hash and drop trailing punctuation", func(t *testing.T) {
+		got := DetectTags(text)
+		if len(got) != 1 {
+			t.Fatalf("wanted 1 tag but got %v", got)
+		}
+
+		if s := text[got[0].Index.ByteStart:got[0].Index.ByteEnd]; s != "#GTD" || got[0].Features[0].Tag != "GTD" {
+			t.Errorf("wanted #GTD but got %v", s)
+		}
+	})
+
+	t.Run("numeric tags are ignored", func(t *testing.T) {
+		if got := DetectTags("chapter #2"); len(got) != 0 {
+			t.Errorf("wanted no tags but got %v", got)
+		}
+	})
+
+	t.Run("links keep balanced parentheses", func(t *testing.T) {
+		got := DetectLinks("(https://en.wikipedia.org/wiki/Getting_Things_Done_(book)).")
+		want := "https://en.wikipedia.org/wiki/Getting_Things_Done_(book)"
+
+		if len(got) != 1 || got[0].Features[0].URI != want {
+			t.Errorf("wanted %v but got %v", want, got)
+		}
+	})
+
+	t.Run("mentions are resolved to dids", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Query().Get("handle") != "david.allen.test" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":"InvalidRequest","message":"Unable to resolve handle"}`))
+				return
+			}
+
+			w.Write([]byte(`{"did":"did:plc:davidallen"}`))
+		}))
+
+		defer srv.Close()
+
+		got := testClient(srv).BuildFacets(context.Background(), text+" @unknown.test")
+		if len(got) != 3 {
+			t.Fatalf("wanted 3 facets but got %v", got)
+		}
+
+		m := got[2]
+		if m.Features[0].DID != "did:plc:davidallen" || text[m.Index.ByteStart:m.Index.ByteEnd] != "@david.allen.test" {
+			t.Errorf("unexpected mention facet %+v", m)
+		}
+	})
+}
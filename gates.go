@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ThreadgateCollection string = "app.bsky.feed.threadgate"
+	PostgateCollection   string = "app.bsky.feed.postgate"
+
+	// Reply and quote rules. Replies may combine followers, following and
+	// mentioned, e.g. "followers,mentioned".
+	Everybody string = "everybody"
+	Nobody    string = "nobody"
+	Followers string = "followers"
+	Following string = "following"
+	Mentioned string = "mentioned"
+)
+
+var threadgateRules = map[string]string{
+	Followers: "app.bsky.feed.threadgate#followerRule",
+	Following: "app.bsky.feed.threadgate#followingRule",
+	Mentioned: "app.bsky.feed.threadgate#mentionRule",
+}
+
+type GateRule struct {
+	Type string `json:"$type"`
+}
+
+// struct Threadgate is an app.bsky.feed.threadgate record. An empty Allow
+// means nobody can reply.
+type Threadgate struct {
+	Type      string     `json:"$type"`
+	Post      string     `json:"post"`
+	Allow     []GateRule `json:"allow"`
+	CreatedAt string     `json:"createdAt"`
+}
+
+// struct Postgate is an app.bsky.feed.postgate record
+type Postgate struct {
+	Type           string     `json:"$type"`
+	Post           string     `json:"post"`
+	EmbeddingRules []GateRule `json:"embeddingRules,omitempty"`
+	CreatedAt      string     `json:"createdAt"`
+}
+
+// struct Gates are who may reply to and quote the bot's posts. Empty rules
+// leave posts open to everybody.
+type Gates struct {
+	Replies string
+	Quotes  string
+}
+
+// function ParseGates validates and normalizes reply and quote rules
+func ParseGates(replies, quotes string) (Gates, error) {
+	g := Gates{}
+	rules := []string{}
+	for _, r := range strings.Split(strings.ToLower(replies), ",") {
+		r = strings.TrimSpace(r)
+		switch {
+		case r == "" || slices.Contains(rules, r):
+		case r == Everybody || r == Nobody || threadgateRules[r] != "":
+			rules = append(rules, r)
+		default:
+			return g, fmt.Errorf("unknown reply rule %v, use %v, %v or a list of %v, %v and %v", r, Everybody, Nobody, Followers, Following, Mentioned)
+		}
+	}
+
+	if len(rules) > 1 && (slices.Contains(rules, Everybody) || slices.Contains(rules, Nobody)) {
+		return g, fmt.Errorf("reply rules %v and %v can not be combined with others", Everybody, Nobody)
+	}
+
+	g.Replies = strings.Join(rules, ",")
+
+	switch q := strings.ToLower(strings.TrimSpace(quotes)); q {
+	case "", Everybody, Nobody:
+		g.Quotes = q
+	default:
+		return g, fmt.Errorf("unknown quote rule %v, use %v or %v", q, Everybody, Nobody)
+	}
+
+	return g, nil
+}
+
+// function Threadgate builds the threadgate for a thread root, or nil when
+// everybody may reply
+func (g Gates) Threadgate(uri string) *Threadgate {
+	if g.Replies == "" || g.Replies == Everybody {
+		return nil
+	}
+
+	t := Threadgate{
+		Type:      ThreadgateCollection,
+		Post:      uri,
+		Allow:     []GateRule{},
+		CreatedAt: time.Now().UTC().Format(time.RFC3339Nano),
+	}
+
+	for _, r := range strings.Split(g.Replies, ",") {
+		if rule, ok := threadgateRules[r]; ok {
+			t.Allow = append(t.Allow, GateRule{rule})
+		}
+	}
+
+	return &t
+}
+
+// function Postgate builds the postgate for a post, or nil when everybody
+// may quote it
+func (g Gates) Postgate(uri string) *Postgate {
+	if g.Quotes != Nobody {
+		return nil
+	}
+
+	return &Postgate{
+		Type:           PostgateCollection,
+		Post:           uri,
+		EmbeddingRules: []GateRule{{"app.bsky.feed.postgate#disableRule"}},
+		CreatedAt:      time.Now().UTC().Format(time.RFC3339Nano),
+	}
+}
+
+// function PostGates returns the rules for posts made by the account conn is
+// scoped to. replies and quotes take the place of the account's rules when
+// they are given.
+func PostGates(conn *Connection, replies, quotes string) (Gates, error) {
+	rules := [2]string{}
+	if conn.AccountID != 0 {
+		a, err := conn.GetAccount(strconv.FormatInt(conn.AccountID, 10))
+		if err != nil {
+			return Gates{}, fmt.Errorf("unable to load account %v %v", conn.AccountID, err.Error())
+		}
+
+		rules = [2]string{a.ReplyRules, a.QuoteRules}
+	}
+
+	if replies != "" {
+		rules[0] = replies
+	}
+
+	if quotes != "" {
+		rules[1] = quotes
+	}
+
+	return ParseGates(rules[0], rules[1])
+}
+
+// function WriteGates creates the threadgate and postgate of a post under
+// the post's record key, as the lexicons require. Only thread roots are
+// threadgated. Gates that already exist are left alone.
+func WriteGates(ctx context.Context, c *AtClient, uri string, root bool, g Gates) error {
+	u, err := ParseATURI(uri)
+	if err != nil {
+		return err
+	}
+
+	if t := g.Threadgate(uri); t != nil && root {
+		if _, err = c.CreateRecord(ctx, ThreadgateCollection, u.Rkey, t); err != nil && !isDuplicate(err) {
+			return err
+		}
+	}
+
+	if p := g.Postgate(uri); p != nil {
+		if _, err = c.CreateRecord(ctx, PostgateCollection, u.Rkey, p); err != nil && !isDuplicate(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// function gatePost writes the gates configured for conn's account to a post
+// that has been published
+func gatePost(ctx context.Context, c *AtClient, conn *Connection, uri string, p Post) error {
+	g, err := PostGates(conn, conn.ReplyRules, conn.QuoteRules)
+	if err != nil {
+		return err
+	}
+
+	return WriteGates(ctx, c, uri, p.Reply == nil, g)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseGates(t *testing.T) {
+	tests := []struct {
+		replies, quotes string
+		want            Gates
+		fails           bool
+	}{
+		{"", "", Gates{}, false},
+		{"Nobody", "nobody", Gates{Nobody, Nobody}, false},
+		{"followers, mentioned,followers", "", Gates{"followers,mentioned", ""}, false},
+		{"nobody,followers", "", Gates{}, true},
+		{"friends", "", Gates{}, true},
+		{"", "followers", Gates{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.replies+" "+tt.quotes, func(t *testing.T) {
+			got, err := ParseGates(tt.replies, tt.quotes)
+			if tt.fails != (err != nil) || !tt.fails && got != tt.want {
+				t.Errorf("wanted %+v (fails %v) but got %+v %v", tt.want, tt.fails, got, err)
+			}
+		})
+	}
+
+	t.Run("nobody allows no replies", func(t *testing.T) {
+		raw, _ := json.Marshal(Gates{Replies: Nobody}.Threadgate("at://did:plc:synapse/app.bsky.feed.post/1"))
+		got := map[string]interface{}{}
+		json.Unmarshal(raw, &got)
+
+		if allow, ok := got["allow"].([]interface{}); !ok || len(allow) != 0 {
+			t.Errorf("wanted an empty allow list but got %s", raw)
+		}
+	})
+}
+
+func TestWriteGates(t *testing.T) {
+	created := []RepoCreateRecordInput{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := RepoCreateRecordInput{}
+		json.NewDecoder(r.Body).Decode(&req)
+		created = append(created, req)
+
+		json.NewEncoder(w).Encode(StrongRef{ATURI{req.Repo, req.Collection, req.Rkey}.String(), "bafyreigate"})
+	}))
+
+	defer srv.Close()
+
+	ctx := context.Background()
+	conn := testConnection(t)
+	c := testClient(srv)
+
+	t.Run("open accounts write no gates", func(t *testing.T) {
+		if _, err := Publish(ctx, c, conn, "Your mind is for having ideas, not holding them.", 0); err != nil {
+			t.Fatalf("wanted no error but got %v", err.Error())
+		}
+
+		if len(created) != 1 || created[0].Collection != PostCollection {
+			t.Errorf("wanted only the post but got %+v", created)
+		}
+	})
+
+	a, _ := ParseAccountArgs("synapse.test", []string{"--replies", "followers,mentioned", "--quotes", "nobody"})
+	id, _ := conn.SaveAccount(a)
+	scoped := conn.ForAccount(id)
+
+	t.Run("gated accounts gate every post", func(t *testing.T) {
+		created = nil
+		refs, err := Publish(ctx, c, scoped, "Your mind is for having ideas.", 0)
+		if err != nil {
+			t.Fatalf("wanted no error but got %v", err.Error())
+		}
+
+		if len(created) != 3 || created[1].Collection != ThreadgateCollection || created[2].Collection != PostgateCollection {
+			t.Fatalf("wanted a post, threadgate and postgate but got %+v", created)
+		}
+
+		u, _ := ParseATURI(refs[0].URI)
+		for _, req := range created {
+			if req.Rkey != u.Rkey {
+				t.Errorf("wanted rkey %v but got %v", u.Rkey, req.Rkey)
+			}
+		}
+
+		tg := map[string]interface{}{}
+		json.Unmarshal(created[1].Record, &tg)
+		if tg["post"] != refs[0].URI || len(tg["allow"].([]interface{})) != 2 {
+			t.Errorf("unexpected threadgate %+v", tg)
+		}
+	})
+
+	t.Run("only thread roots are threadgated", func(t *testing.T) {
+		created = nil
+		p := NewPost("Capture everything that has your attention.")
+		p.Reply = &ReplyRef{StrongRef{"at://did:plc:other/app.bsky.feed.post/1", "bafyreiother"}, StrongRef{"at://did:plc:other/app.bsky.feed.post/1", "bafyreiother"}}
+		if _, err := PostOnce(ctx, c, scoped, p, 0); err != nil {
+			t.Fatalf("wanted no error but got %v", err.Error())
+		}
+
+		if len(created) != 2 || created[1].Collection != PostgateCollection {
+			t.Errorf("wanted a post and postgate but got %+v", created)
+		}
+	})
+
+	t.Run("the run overrides account rules", func(t *testing.T) {
+		g, err := PostGates(scoped, Nobody, Everybody)
+		if err != nil || g != (Gates{Nobody, Everybody}) {
+			t.Errorf("unexpected gates %+v %v", g, err)
+		}
+
+		if g, _ = PostGates(scoped, "", Everybody); g.Replies == Nobody {
+			t.Errorf("wanted the account's reply rules but got %+v", g)
+		}
+	})
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// graphemeClass is a simplified Grapheme_Cluster_Break property, enough to
+// segment the text we post.
+//
+// https://www.unicode.org/reports/tr29/#Grapheme_Cluster_Boundary_Rules
+type graphemeClass int
+
+const (
+	gcOther graphemeClass = iota
+	gcCR
+	gcLF
+	gcControl
+	gcExtend
+	gcZWJ
+	gcRegionalIndicator
+	gcSpacingMark
+	gcL
+	gcV
+	gcT
+	gcLV
+	gcLVT
+)
+
+var extendedPictographic = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{0x00A9, 0x00A9, 1}, {0x00AE, 0x00AE, 1}, {0x203C, 0x203C, 1},
+		{0x2049, 0x2049, 1}, {0x2122, 0x2122, 1}, {0x2139, 0x2139, 1},
+		{0x2194, 0x21AA, 1}, {0x231A, 0x23FF, 1}, {0x24C2, 0x24C2, 1},
+		{0x25AA, 0x25FE, 1}, {0x2600, 0x27BF, 1}, {0x2934, 0x2935, 1},
+		{0x2B05, 0x2B55, 1}, {0x3030, 0x3030, 1}, {0x303D, 0x303D, 1},
+		{0x3297, 0x3299, 1},
+	},
+	R32: []unicode.Range32{
+		{0x1F000, 0x1F0FF, 1}, {0x1F10D, 0x1F1AD, 1}, {0x1F201, 0x1FAFF, 1},
+		{0x1FC00, 0x1FFFD, 1},
+	},
+}
+
+func classify(r rune) graphemeClass {
+	switch {
+	case r == '\r':
+		return gcCR
+	case r == '\n':
+		return gcLF
+	case r == 0x200D:
+		return gcZWJ
+	case r == 0x200C, r >= 0xFE00 && r <= 0xFE0F, r >= 0x1F3FB && r <= 0x1F3FF,
+		r >= 0xE0020 && r <= 0xE007F, unicode.In(r, unicode.Mn, unicode.Me):
+		// Variation selectors, skin tone modifiers and tag characters extend
+		// the previous cluster just like combining marks
+		return gcExtend
+	case r >= 0x1F1E6 && r <= 0x1F1FF:
+		return gcRegionalIndicator
+	case unicode.Is(unicode.Mc, r):
+		return gcSpacingMark
+	case unicode.In(r, unicode.Cc, unicode.Zl, unicode.Zp), unicode.Is(unicode.Cf, r):
+		return gcControl
+	case r >= 0x1100 && r <= 0x115F, r >= 0xA960 && r <= 0xA97C:
+		return gcL
+	case r >= 0x1160 && r <= 0x11A7, r >= 0xD7B0 && r <= 0xD7C6:
+		return gcV
+	case r >= 0x11A8 && r <= 0x11FF, r >= 0xD7CB && r <= 0xD7FB:
+		return gcT
+	case r >= 0xAC00 && r <= 0xD7A3:
+		if (r-0xAC00)%28 == 0 {
+			return gcLV
+		}
+
+		return gcLVT
+	default:
+		return gcOther
+	}
+}
+
+// struct graphemeState carries what the break rules need to know about the
+// cluster so far
+type graphemeState struct {
+	prev         graphemeClass
+	pictographic bool // the cluster started with an emoji, GB11
+	zwjAfterPic  bool // ... and the previous rune is a ZWJ following it
+	riCount      int  // consecutive regional indicators, GB12/13
+}
+
+// function isBoundary reports whether there is a cluster boundary before a
+// rune of class next
+func (s *graphemeState) isBoundary(next graphemeClass, r rune) bool {
+	prev := s.prev
+	switch {
+	case prev == gcCR && next == gcLF: // GB3
+		return false
+	case prev == gcCR, prev == gcLF, prev == gcControl: // GB4
+		return true
+	case next == gcCR, next == gcLF, next == gcControl: // GB5
+		return true
+	case prev == gcL && (next == gcL || next == gcV || next == gcLV || next == gcLVT): // GB6
+		return false
+	case (prev == gcLV || prev == gcV) && (next == gcV || next == gcT): // GB7
+		return false
+	case (prev == gcLVT || prev == gcT) && next == gcT: // GB8
+		return false
+	case next == gcExtend, next == gcZWJ, next == gcSpacingMark: // GB9, GB9a
+		return false
+	case s.zwjAfterPic && unicode.Is(extendedPictographic, r): // GB11
+		return false
+	case prev == gcRegionalIndicator && next == gcRegionalIndicator: // GB12, GB13
+		return s.riCount%2 == 0
+	default: // GB999
+		return true
+	}
+}
+
+func (s *graphemeState) advance(boundary bool, c graphemeClass, r rune) {
+	if boundary {
+		s.pictographic = unicode.Is(extendedPictographic, r)
+		s.riCount = 0
+	}
+
+	s.zwjAfterPic = s.pictographic && c == gcZWJ
+	if c == gcRegionalIndicator {
+		s.riCount++
+	}
+
+	s.prev = c
+}
+
+// function Graphemes splits text into user-perceived characters, so that
+// e.g. a family emoji joined by ZWJs, a flag or an accented letter built
+// from combining marks are each a single item
+func Graphemes(text string) []string {
+	clusters := []string{}
+	start := 0
+	s := graphemeState{}
+
+	for i, r := range text {
+		c := classify(r)
+		boundary := i == 0 || s.isBoundary(c, r)
+		if boundary && i > 0 {
+			clusters = append(clusters, text[start:i])
+			start = i
+		}
+
+		s.advance(boundary, c, r)
+	}
+
+	if start < len(text) {
+		clusters = append(clusters, text[start:])
+	}
+
+	return clusters
+}
+
+// function GraphemeCount is the number of grapheme clusters in text
+func GraphemeCount(text string) int {
+	if !needsSegmentation(text) {
+		return utf8.RuneCountInString(text)
+	}
+
+	return len(Graphemes(text))
+}
+
+// function needsSegmentation reports whether any rune could join a cluster,
+// letting plain text skip the full segmenter
+func needsSegmentation(text string) bool {
+	for _, r := range text {
+		if r == '\r' || r >= 0x0300 && classify(r) != gcOther {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestGraphemes(t *testing.T) {
+	for _, tc := range []struct {
+		desc string
+		text string
+		want int
+	}{
+		{"ascii", "Getting Things Done", 19},
+		{"curly quotes and dashes", "“now, later, someday—big”", 25},
+		{"combining marks", "café naïve", 10},
+		{"crlf", "a\r\nb", 3},
+		{"zwj family", "👨‍👩‍👧‍👦", 1},
+		{"skin tone with zwj", "👩🏽‍💻 done", 6},
+		{"flags", "🇺🇸🇫🇷🇯", 3},
+		{"subdivision flag", "🏴\U000E0067\U000E0062\U000E0073\U000E0063\U000E0074\U000E007F", 1},
+		{"keycap", "1️⃣", 1},
+		{"hangul jamo", "각", 1},
+		{"zwj after text", "a‍👍", 2},
+	} {
+		t.Run(fmt.Sprintf("counts %v", tc.desc), func(t *testing.T) {
+			if got := GraphemeCount(tc.text); got != tc.want {
+				t.Errorf("wanted %v but got %v %q", tc.want, got, Graphemes(tc.text))
+			}
+		})
+	}
+}
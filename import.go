@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// struct Bookcision is the JSON export of a Kindle notebook
+//
+// https://readwise.io/bookcision
+type Bookcision struct {
+	ASIN       string                `json:"asin"`
+	Title      string                `json:"title"`
+	Authors    string                `json:"authors"`
+	Highlights []BookcisionHighlight `json:"highlights"`
+}
+
+type BookcisionLocation struct {
+	URL   string `json:"url"`
+	Value int    `json:"value"`
+}
+
+type BookcisionHighlight struct {
+	Text       string             `json:"text"`
+	IsNoteOnly bool               `json:"isNoteOnly"`
+	Location   BookcisionLocation `json:"location"`
+	Note       *string            `json:"note"`
+}
+
+// function ParseTags returns the tags in a highlight note, lowercased and
+// without their prefix. Kindle has no tags of its own, so a word starting
+// with "." (the Readwise convention) or "#" in the note is treated as one.
+func ParseTags(note string) []string {
+	tags := []string{}
+	for _, word := range strings.Fields(note) {
+		if !strings.HasPrefix(word, ".") && !strings.HasPrefix(word, "#") {
+			continue
+		}
+
+		tag := strings.ToLower(strings.TrimRightFunc(word[1:], unicode.IsPunct))
+		if tag != "" && !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+
+	return tags
+}
+
+func ReadBookcision(fpath string) (*Bookcision, error) {
+	contents, err := os.ReadFile(fpath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read file %v %v", fpath, err.Error())
+	}
+
+	b := Bookcision{}
+	if err = json.Unmarshal(contents, &b); err != nil {
+		return nil, fmt.Errorf("unable to marshal JSON %v %v", fpath, err.Error())
+	}
+
+	return &b, nil
+}
+
+// function ImportBookcision stores a book and its highlights, classifying
+// each highlight with [Preflight]. Highlights that were already imported
+// are skipped. It returns the number of new highlights.
+//
+// When conn is scoped to an account the book becomes part of its theme and
+// only that account posts from it.
+func ImportBookcision(conn *Connection, b *Bookcision) (int, error) {
+	tx, err := conn.Db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("unable to start transaction %v", err.Error())
+	}
+
+	defer tx.Rollback()
+
+	var bookID int64
+	err = tx.QueryRow(`
+		INSERT INTO books (asin, title, authors, account_id) VALUES (?, ?, ?, NULLIF(?, 0))
+		ON CONFLICT (asin) DO UPDATE SET
+			title = excluded.title,
+			authors = excluded.authors,
+			account_id = COALESCE(excluded.account_id, books.account_id),
+			updated_at = CURRENT_TIMESTAMP
+		RETURNING id`,
+		b.ASIN, b.Title, b.Authors, conn.AccountID,
+	).Scan(&bookID)
+	if err != nil {
+		return 0, fmt.Errorf("unable to save book %v %v", b.Title, err.Error())
+	}
+
+	count := 0
+	for _, h := range b.Highlights {
+		if h.IsNoteOnly {
+			continue
+		}
+
+		r, err := Preflight(Quote{h.Text, b.Title, b.Authors}.PostText())
+		if err != nil {
+			logger.Warnf("skipping highlight at %v %v", h.Location.Value, err.Error())
+			continue
+		}
+
+		res, err := tx.Exec(`
+			INSERT INTO highlights (book_id, text, note, location, status)
+			VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (book_id, text) DO NOTHING`,
+			bookID, h.Text, h.Note, h.Location.Value, r.Status,
+		)
+		if err != nil {
+			return 0, fmt.Errorf("unable to save highlight at %v %v", h.Location.Value, err.Error())
+		}
+
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+
+		count++
+		if h.Note == nil {
+			continue
+		}
+
+		id, _ := res.LastInsertId()
+		for _, tag := range ParseTags(*h.Note) {
+			var tagID int64
+			err = tx.QueryRow(`
+				INSERT INTO tags (name) VALUES (?)
+				ON CONFLICT (name) DO UPDATE SET name = excluded.name
+				RETURNING id`,
+				tag,
+			).Scan(&tagID)
+			if err == nil {
+				_, err = tx.Exec(`INSERT INTO highlight_tags (highlight_id, tag_id) VALUES (?, ?)`, id, tagID)
+			}
+
+			if err != nil {
+				return 0, fmt.Errorf("unable to tag highlight at %v %v", h.Location.Value, err.Error())
+			}
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("unable to commit import of %v %v", b.Title, err.Error())
+	}
+
+	return count, nil
+}
+
+// function Import is the CLI entrypoint for importing Bookcision files
+func Import(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: synapse import <file.json>...")
+	}
+
+	// Books are shared by every account unless one is chosen
+	conn := CreateConnection()
+	if selectedAccount != "" {
+		scoped, err := SelectAccount(conn, selectedAccount)
+		if err != nil {
+			return err
+		}
+
+		conn = scoped
+	}
+
+	for _, fpath := range args {
+		b, err := ReadBookcision(fpath)
+		if err != nil {
+			return err
+		}
+
+		n, err := ImportBookcision(conn, b)
+		if err != nil {
+			return err
+		}
+
+		logger.Infof("imported %v of %v highlights from %v", n, len(b.Highlights), b.Title)
+	}
+
+	return nil
+}
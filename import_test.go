@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestImportBookcision(t *testing.T) {
+	conn := testConnection(t)
+	b, err := ReadBookcision("data/getting_things_done.json")
+	if err != nil {
+		t.Fatalf("wanted no error but got %v", err.Error())
+	}
+
+	first, err := ImportBookcision(conn, b)
+	if err != nil {
+		t.Fatalf("wanted no error but got %v", err.Error())
+	}
+
+	t.Run("every highlight is imported", func(t *testing.T) {
+		if first == 0 || first > len(b.Highlights) {
+			t.Errorf("unexpected count %v of %v", first, len(b.Highlights))
+		}
+
+		var n int
+		conn.Db.QueryRow(`SELECT COUNT(*) FROM highlights WHERE status = ?`, "").Scan(&n)
+		if n != 0 {
+			t.Errorf("wanted every highlight to be classified but %v were not", n)
+		}
+	})
+
+	t.Run("reimporting skips existing highlights", func(t *testing.T) {
+		got, err := ImportBookcision(conn, b)
+		if err != nil || got != 0 {
+			t.Errorf("wanted 0 new highlights but got %v %v", got, err)
+		}
+	})
+
+	t.Run("highlights are classified with their attribution", func(t *testing.T) {
+		text := strings.Repeat("a", MaxPostLength-10)
+		near := &Bookcision{ASIN: "B00KWG9M2E", Title: b.Title, Authors: b.Authors, Highlights: []BookcisionHighlight{{Text: text}}}
+		if _, err := ImportBookcision(conn, near); err != nil {
+			t.Fatalf("wanted no error but got %v", err.Error())
+		}
+
+		var status PostStatus
+		conn.Db.QueryRow(`SELECT status FROM highlights WHERE text = ?`, text).Scan(&status)
+		if status != NeedsThread {
+			t.Errorf("wanted %v but got %v", NeedsThread, status)
+		}
+	})
+}
+
+func TestParseTags(t *testing.T) {
+	got := ParseTags(".Habits #focus, not.a.tag .habits . #")
+	if len(got) != 2 || got[0] != "habits" || got[1] != "focus" {
+		t.Errorf("unexpected tags %v", got)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const SelfLabelsType string = "com.atproto.label.defs#selfLabels"
+
+// SelfLabelValues are the labels Bluesky clients put behind content
+// warnings, or in the case of !no-unauthenticated, hide from logged out
+// visitors. Violence and gore are graphic-media.
+var SelfLabelValues = []string{"!no-unauthenticated", "porn", "sexual", "nudity", "graphic-media"}
+
+// Targets that can carry labels
+const (
+	BookLabels      string = "book"
+	HighlightLabels string = "highlight"
+	TagLabels       string = "tag"
+)
+
+type SelfLabel struct {
+	Val string `json:"val"`
+}
+
+// struct SelfLabels is a com.atproto.label.defs#selfLabels, set as the
+// labels of a record by its author
+type SelfLabels struct {
+	Type   string      `json:"$type"`
+	Values []SelfLabel `json:"values"`
+}
+
+// function NewSelfLabels returns nil when there are no labels, so records
+// without any leave the field out
+func NewSelfLabels(labels []string) *SelfLabels {
+	if len(labels) == 0 {
+		return nil
+	}
+
+	s := SelfLabels{Type: SelfLabelsType}
+	for _, l := range labels {
+		s.Values = append(s.Values, SelfLabel{l})
+	}
+
+	return &s
+}
+
+// function ParseLabels splits comma separated labels, dropping duplicates
+// and failing on values that are not in [SelfLabelValues]. Labels are
+// returned in the order of [SelfLabelValues].
+func ParseLabels(values ...string) ([]string, error) {
+	found := map[string]bool{}
+	for _, v := range values {
+		for _, l := range strings.Split(v, ",") {
+			l = strings.ToLower(strings.TrimSpace(l))
+			if l == "" {
+				continue
+			}
+
+			if !slices.Contains(SelfLabelValues, l) {
+				return nil, fmt.Errorf("unknown label %v, use one of %v", l, strings.Join(SelfLabelValues, ", "))
+			}
+
+			found[l] = true
+		}
+	}
+
+	labels := []string{}
+	for _, l := range SelfLabelValues {
+		if found[l] {
+			labels = append(labels, l)
+		}
+	}
+
+	return labels, nil
+}
+
+// function ManageLabels is the CLI entrypoint for content warnings:
+//
+//	labels list
+//	labels set book|highlight|tag <asin|id|name> [label]...
+//
+// Setting no labels clears them.
+func ManageLabels(args []string) error {
+	usage := fmt.Errorf("usage: synapse labels list|set book|highlight|tag <asin|id|name> [%v]...", strings.Join(SelfLabelValues, "|"))
+	if len(args) == 0 {
+		return usage
+	}
+
+	conn := CreateConnection()
+
+	switch args[0] {
+	case "list", "ls":
+		labeled, err := conn.GetLabels()
+		if err != nil {
+			return err
+		}
+
+		for _, l := range labeled {
+			logger.Infof("%v %v: %v", l.Target, l.Name, strings.Join(l.Labels, ", "))
+		}
+	case "set":
+		if len(args) < 3 {
+			return usage
+		}
+
+		labels, err := ParseLabels(args[3:]...)
+		if err != nil {
+			return err
+		}
+
+		if err = conn.SetLabels(args[1], args[2], labels); err != nil {
+			return err
+		}
+
+		logger.Infof("labeled %v %v with %v", args[1], args[2], labels)
+	default:
+		return usage
+	}
+
+	return nil
+}
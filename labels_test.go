@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestParseLabels(t *testing.T) {
+	t.Run("labels are deduplicated in a fixed order", func(t *testing.T) {
+		got, err := ParseLabels("Graphic-Media, nudity", "", "nudity")
+		if err != nil || !slices.Equal(got, []string{"nudity", "graphic-media"}) {
+			t.Errorf("unexpected labels %v %v", got, err)
+		}
+	})
+
+	t.Run("unknown labels fail", func(t *testing.T) {
+		if _, err := ParseLabels("violence"); err == nil {
+			t.Errorf("wanted an error but got none")
+		}
+	})
+
+	t.Run("no labels leave the field out", func(t *testing.T) {
+		p := NewPost("text")
+		p.Labels = NewSelfLabels(nil)
+
+		raw, _ := json.Marshal(p)
+		got := map[string]interface{}{}
+		json.Unmarshal(raw, &got)
+		if _, ok := got["labels"]; ok {
+			t.Errorf("wanted no labels but got %s", raw)
+		}
+	})
+}
+
+func TestHighlightLabels(t *testing.T) {
+	conn := testConnection(t)
+	note := ".war"
+	b := &Bookcision{ASIN: "B0040JHNQG", Title: "All Quiet on the Western Front", Authors: "Erich Maria Remarque", Highlights: []BookcisionHighlight{
+		{Text: "We are forlorn like children, and experienced like old men."},
+		{Text: "I am young, I am twenty years old; yet I know nothing of life but despair.", Note: &note},
+	}}
+
+	if _, err := ImportBookcision(conn, b); err != nil {
+		t.Fatalf("test setup failed %v", err.Error())
+	}
+
+	t.Run("unlabeled highlights have no labels", func(t *testing.T) {
+		if got, err := conn.GetHighlightLabels(1); err != nil || len(got) != 0 {
+			t.Errorf("wanted no labels but got %v %v", got, err)
+		}
+	})
+
+	if err := conn.SetLabels(TagLabels, "#war", []string{"graphic-media"}); err != nil {
+		t.Fatalf("wanted no error but got %v", err.Error())
+	}
+
+	if err := conn.SetLabels(BookLabels, "B0040JHNQG", []string{"!no-unauthenticated"}); err != nil {
+		t.Fatalf("wanted no error but got %v", err.Error())
+	}
+
+	t.Run("labels of the book and tags are combined", func(t *testing.T) {
+		got, err := conn.GetHighlightLabels(2)
+		if err != nil || !slices.Equal(got, []string{"!no-unauthenticated", "graphic-media"}) {
+			t.Errorf("unexpected labels %v %v", got, err)
+		}
+
+		labeled, _ := conn.GetLabels()
+		if len(labeled) != 2 {
+			t.Errorf("wanted 2 labeled items but got %+v", labeled)
+		}
+	})
+
+	t.Run("unknown targets fail", func(t *testing.T) {
+		if err := conn.SetLabels(HighlightLabels, "99", []string{"porn"}); err == nil {
+			t.Errorf("wanted an error but got none")
+		}
+	})
+
+	t.Run("posts carry the labels", func(t *testing.T) {
+		var got RepoCreateRecordInput
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewDecoder(r.Body).Decode(&got)
+			json.NewEncoder(w).Encode(StrongRef{ATURI{got.Repo, got.Collection, got.Rkey}.String(), "cid"})
+		}))
+
+		defer srv.Close()
+
+		if _, err := PostOnce(context.Background(), testClient(srv), conn, NewPost(b.Highlights[1].Text), 2); err != nil {
+			t.Fatalf("wanted no error but got %v", err.Error())
+		}
+
+		raw := got.Record
+		p := Post{}
+		json.Unmarshal(raw, &p)
+		if p.Labels == nil || p.Labels.Type != SelfLabelsType || len(p.Labels.Values) != 2 || p.Labels.Values[1].Val != "graphic-media" {
+			t.Errorf("unexpected labels %s", raw)
+		}
+	})
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+//go:generate go run ./cmd/lexgen -dir data/lexicons -out lexicons_gen.go
+
+// Lexicons of the records the bot writes and the endpoints it calls, laid
+// out by NSID like the upstream repository, e.g.
+// data/lexicons/app/bsky/feed/post.json. Types and methods for the
+// endpoints are generated into lexicons_gen.go.
+//
+//go:embed data/lexicons
+var lexiconFiles embed.FS
+
+// BundledLexicons validate every record an [AtClient] writes
+var BundledLexicons = mustLoadLexicons(lexiconFiles)
+
+// ErrInvalidRecord matches every [RecordError] with [errors.Is]
+var ErrInvalidRecord = errors.New("InvalidRecord")
+
+// struct LexiconDef is a definition in a lexicon document. Only the fields
+// used for validating records are read.
+type LexiconDef struct {
+	Type string `json:"type"`
+	// records
+	Key    string      `json:"key"`
+	Record *LexiconDef `json:"record"`
+	// objects
+	Required   []string               `json:"required"`
+	Nullable   []string               `json:"nullable"`
+	Properties map[string]*LexiconDef `json:"properties"`
+	// arrays
+	Items *LexiconDef `json:"items"`
+	// refs and unions
+	Ref    string   `json:"ref"`
+	Refs   []string `json:"refs"`
+	Closed bool     `json:"closed"`
+	// strings, integers, arrays and blobs
+	Format       string        `json:"format"`
+	MinLength    *int          `json:"minLength"`
+	MaxLength    *int          `json:"maxLength"`
+	MinGraphemes *int          `json:"minGraphemes"`
+	MaxGraphemes *int          `json:"maxGraphemes"`
+	Minimum      *int64        `json:"minimum"`
+	Maximum      *int64        `json:"maximum"`
+	Enum         []interface{} `json:"enum"`
+	Const        interface{}   `json:"const"`
+	Accept       []string      `json:"accept"`
+	MaxSize      int           `json:"maxSize"`
+}
+
+// struct LexiconDoc is a lexicon document, one per NSID
+type LexiconDoc struct {
+	Lexicon int                    `json:"lexicon"`
+	ID      string                 `json:"id"`
+	Defs    map[string]*LexiconDef `json:"defs"`
+}
+
+// struct Lexicons resolves references between lexicon documents
+type Lexicons struct {
+	docs map[string]*LexiconDoc
+}
+
+// struct RecordError locates the first part of a record that does not match
+// its lexicon
+type RecordError struct {
+	Collection string
+	Path       string
+	Message    string
+}
+
+func (e *RecordError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("invalid %v record: %v", e.Collection, e.Message)
+	}
+
+	return fmt.Sprintf("invalid %v record: %v %v", e.Collection, e.Path, e.Message)
+}
+
+func (e *RecordError) Is(target error) bool {
+	return target == ErrInvalidRecord
+}
+
+// Formats of string values, following the atproto specs loosely enough to
+// accept anything a PDS would
+var lexiconFormats = map[string]*regexp.Regexp{
+	"did":        regexp.MustCompile(`^did:[a-z]+:[a-zA-Z0-9._:%-]*[a-zA-Z0-9._-]$`),
+	"handle":     regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)+[a-zA-Z]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`),
+	"at-uri":     regexp.MustCompile(`^at://[a-zA-Z0-9._:%-]+(/[a-zA-Z][a-zA-Z0-9.-]*(/[a-zA-Z0-9._~:-]+)?)?$`),
+	"uri":        regexp.MustCompile(`^[a-z][a-z0-9+.-]*:\S+$`),
+	"cid":        regexp.MustCompile(`^[a-zA-Z0-9+=]{8,256}$`),
+	"language":   regexp.MustCompile(`^(i|[a-z]{2,3})(-[a-zA-Z0-9]+)*$`),
+	"nsid":       regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9-]*(\.[a-zA-Z0-9][a-zA-Z0-9-]*)+$`),
+	"tid":        regexp.MustCompile(`^[234567abcdefghij][234567abcdefghijklmnopqrstuvwxyz]{12}$`),
+	"record-key": regexp.MustCompile(`^[a-zA-Z0-9_~.:-]{1,512}$`),
+}
+
+// function LoadLexicons reads every .json lexicon document in fsys
+func LoadLexicons(fsys fs.FS) (*Lexicons, error) {
+	l := Lexicons{docs: map[string]*LexiconDoc{}}
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || path.Ext(p) != ".json" {
+			return err
+		}
+
+		raw, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return err
+		}
+
+		doc := LexiconDoc{}
+		if err = json.Unmarshal(raw, &doc); err != nil {
+			return fmt.Errorf("unable to parse lexicon %v %v", p, err.Error())
+		}
+
+		l.docs[doc.ID] = &doc
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to load lexicons %w", err)
+	}
+
+	return &l, nil
+}
+
+func mustLoadLexicons(fsys fs.FS) *Lexicons {
+	l, err := LoadLexicons(fsys)
+	if err != nil {
+		panic(err)
+	}
+
+	return l
+}
+
+// function qualify expands a reference relative to the document base to
+// nsid#name form
+func qualify(ref, base string) string {
+	if strings.HasPrefix(ref, "#") {
+		ref = base + ref
+	}
+
+	if !strings.Contains(ref, "#") {
+		ref += "#main"
+	}
+
+	return ref
+}
+
+// function resolve finds the definition a qualified reference points to
+func (l *Lexicons) resolve(ref string) (*LexiconDef, string, bool) {
+	nsid, name, _ := strings.Cut(ref, "#")
+	doc, ok := l.docs[nsid]
+	if !ok {
+		return nil, "", false
+	}
+
+	def, ok := doc.Defs[name]
+
+	return def, nsid, ok
+}
+
+// function ValidateRecord checks a record and its key against the lexicon of
+// collection. Collections without a bundled lexicon are not checked.
+func (l *Lexicons) ValidateRecord(collection, rkey string, record interface{}) error {
+	def, _, ok := l.resolve(qualify(collection, collection))
+	if !ok || def.Type != "record" || def.Record == nil {
+		return nil
+	}
+
+	fail := func(p, format string, args ...interface{}) error {
+		return &RecordError{collection, p, fmt.Sprintf(format, args...)}
+	}
+
+	switch key, literal := strings.CutPrefix(def.Key, "literal:"); {
+	case rkey == "":
+	case literal && rkey != key:
+		return fail("", "record key must be %v, got %q", key, rkey)
+	case def.Key == "tid" && !lexiconFormats["tid"].MatchString(rkey):
+		return fail("", "record key must be a TID, got %q", rkey)
+	case !lexiconFormats["record-key"].MatchString(rkey) || rkey == "." || rkey == "..":
+		return fail("", "invalid record key %q", rkey)
+	}
+
+	raw, err := json.Marshal(record)
+	if err != nil {
+		return fail("", "unable to encode %v", err.Error())
+	}
+
+	var value interface{}
+	d := json.NewDecoder(bytes.NewReader(raw))
+	d.UseNumber()
+	if err = d.Decode(&value); err != nil {
+		return fail("", "unable to decode %v", err.Error())
+	}
+
+	if m, ok := value.(map[string]interface{}); !ok || m["$type"] != collection {
+		return fail("$type", "must be %v", collection)
+	}
+
+	if msg, p := l.validate(def.Record, value, "", collection); msg != "" {
+		return fail(p, "%v", msg)
+	}
+
+	return nil
+}
+
+func join(p, name string) string {
+	if p == "" {
+		return name
+	}
+
+	return p + "." + name
+}
+
+// function validate returns why value does not match def and where, or an
+// empty message when it does
+func (l *Lexicons) validate(def *LexiconDef, value interface{}, p, base string) (string, string) {
+	switch def.Type {
+	case "ref":
+		target, nsid, ok := l.resolve(qualify(def.Ref, base))
+		if !ok {
+			return "", ""
+		}
+
+		return l.validate(target, value, p, nsid)
+	case "union":
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return "must be an object", p
+		}
+
+		t, _ := m["$type"].(string)
+		if t == "" {
+			return "is missing $type", p
+		}
+
+		for _, ref := range def.Refs {
+			if qualify(ref, base) != qualify(t, t) {
+				continue
+			}
+
+			target, nsid, ok := l.resolve(qualify(ref, base))
+			if !ok {
+				return "", ""
+			}
+
+			return l.validate(target, value, p, nsid)
+		}
+
+		if def.Closed {
+			return fmt.Sprintf("has $type %v, must be one of %v", t, strings.Join(def.Refs, ", ")), p
+		}
+	case "object":
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return "must be an object", p
+		}
+
+		for _, name := range def.Required {
+			if v, ok := m[name]; !ok || v == nil && !slices.Contains(def.Nullable, name) {
+				return "is required", join(p, name)
+			}
+		}
+
+		// Sorted so the same record always fails on the same property
+		for _, name := range slices.Sorted(maps.Keys(def.Properties)) {
+			prop := def.Properties[name]
+			v, ok := m[name]
+			if !ok || v == nil && slices.Contains(def.Nullable, name) {
+				continue
+			} else if v == nil {
+				return "must not be null", join(p, name)
+			}
+
+			if msg, at := l.validate(prop, v, join(p, name), base); msg != "" {
+				return msg, at
+			}
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return "must be an array", p
+		}
+
+		if def.MaxLength != nil && len(items) > *def.MaxLength {
+			return fmt.Sprintf("has %v items, at most %v are allowed", len(items), *def.MaxLength), p
+		}
+
+		if def.MinLength != nil && len(items) < *def.MinLength {
+			return fmt.Sprintf("has %v items, at least %v are required", len(items), *def.MinLength), p
+		}
+
+		for i, item := range items {
+			if msg, at := l.validate(def.Items, item, fmt.Sprintf("%v[%v]", p, i), base); msg != "" {
+				return msg, at
+			}
+		}
+	case "string":
+		s, ok := value.(string)
+		if !ok {
+			return "must be a string", p
+		}
+
+		return validateString(def, s), p
+	case "integer":
+		n, ok := value.(json.Number)
+		i, err := n.Int64()
+		if !ok || err != nil {
+			return "must be an integer", p
+		}
+
+		if def.Minimum != nil && i < *def.Minimum {
+			return fmt.Sprintf("is %v, the minimum is %v", i, *def.Minimum), p
+		}
+
+		if def.Maximum != nil && i > *def.Maximum {
+			return fmt.Sprintf("is %v, the maximum is %v", i, *def.Maximum), p
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return "must be a boolean", p
+		}
+	case "blob":
+		return validateBlob(def, value), p
+	case "unknown":
+		if _, ok := value.(map[string]interface{}); !ok {
+			return "must be an object", p
+		}
+	}
+
+	return "", ""
+}
+
+func validateString(def *LexiconDef, s string) string {
+	if def.MaxLength != nil && len(s) > *def.MaxLength {
+		return fmt.Sprintf("is %v bytes, at most %v are allowed", len(s), *def.MaxLength)
+	}
+
+	if def.MinLength != nil && len(s) < *def.MinLength {
+		return fmt.Sprintf("is %v bytes, at least %v are required", len(s), *def.MinLength)
+	}
+
+	if def.MaxGraphemes != nil || def.MinGraphemes != nil {
+		n := GraphemeCount(s)
+		if def.MaxGraphemes != nil && n > *def.MaxGraphemes {
+			return fmt.Sprintf("is %v characters, at most %v are allowed", n, *def.MaxGraphemes)
+		}
+
+		if def.MinGraphemes != nil && n < *def.MinGraphemes {
+			return fmt.Sprintf("is %v characters, at least %v are required", n, *def.MinGraphemes)
+		}
+	}
+
+	if def.Const != nil && def.Const != s {
+		return fmt.Sprintf("must be %v", def.Const)
+	}
+
+	if len(def.Enum) > 0 && !slices.Contains(def.Enum, interface{}(s)) {
+		return fmt.Sprintf("is %q, must be one of %v", s, def.Enum)
+	}
+
+	switch def.Format {
+	case "":
+	case "datetime":
+		if _, err := time.Parse(time.RFC3339Nano, s); err != nil {
+			return fmt.Sprintf("is %q, not an RFC 3339 datetime", s)
+		}
+	case "at-identifier":
+		if !lexiconFormats["did"].MatchString(s) && !lexiconFormats["handle"].MatchString(s) {
+			return fmt.Sprintf("is %q, not a DID or handle", s)
+		}
+	default:
+		if re, ok := lexiconFormats[def.Format]; ok && !re.MatchString(s) {
+			return fmt.Sprintf("is %q, not a valid %v", s, def.Format)
+		}
+	}
+
+	return ""
+}
+
+func validateBlob(def *LexiconDef, value interface{}) string {
+	m, ok := value.(map[string]interface{})
+	if !ok || m["$type"] != "blob" {
+		return "must be a blob"
+	}
+
+	ref, _ := m["ref"].(map[string]interface{})
+	if link, _ := ref["$link"].(string); link == "" {
+		return "is missing its ref"
+	}
+
+	mimeType, _ := m["mimeType"].(string)
+	if len(def.Accept) > 0 && !slices.ContainsFunc(def.Accept, func(pattern string) bool {
+		matched, _ := path.Match(pattern, mimeType)
+		return matched
+	}) {
+		return fmt.Sprintf("is %v, must be %v", mimeType, strings.Join(def.Accept, " or "))
+	}
+
+	size, ok := m["size"].(json.Number)
+	if n, err := size.Int64(); !ok || err != nil {
+		return "is missing its size"
+	} else if def.MaxSize > 0 && n > int64(def.MaxSize) {
+		return fmt.Sprintf("is %v bytes, at most %v are allowed", n, def.MaxSize)
+	}
+
+	return ""
+}
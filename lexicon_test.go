@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateRecord(t *testing.T) {
+	valid := func() Post {
+		p := NewPost("Your mind is for having ideas, not holding them.")
+		p.Facets = []Facet{{ByteSlice{0, 4}, []FacetFeature{{Type: "app.bsky.richtext.facet#mention", DID: "did:plc:synapse"}}}}
+		p.Reply = &ReplyRef{
+			StrongRef{"at://did:plc:synapse/app.bsky.feed.post/3l2s5xxv2ze2c", "bafyreiroot"},
+			StrongRef{"at://did:plc:synapse/app.bsky.feed.post/3l2s5xxv2ze2c", "bafyreiroot"},
+		}
+		p.Labels = NewSelfLabels([]string{"graphic-media"})
+
+		return p
+	}
+
+	image := func(mimeType string, size int) *ImagesEmbed {
+		return NewImagesEmbed(EmbedImage{Alt: "alt", Image: Blob{"blob", BlobRef{"bafkreiimage"}, mimeType, size}})
+	}
+
+	tests := []struct {
+		name   string
+		edit   func(p *Post)
+		rkey   string
+		wanted string
+	}{
+		{"a valid post", func(p *Post) {}, "3l2s5xxv2ze2c", ""},
+		{"an open union member", func(p *Post) { p.Embed = map[string]string{"$type": "app.bsky.embed.unknown"} }, "", ""},
+		{"an image", func(p *Post) { p.Embed = image("image/png", MaxBlobSize) }, "", ""},
+		{"a long post", func(p *Post) { p.Text = strings.Repeat("👍🏽", 301) }, "", "text is 301 characters, at most 300 are allowed"},
+		{"a missing timestamp", func(p *Post) { p.CreatedAt = "" }, "", "createdAt is \"\", not an RFC 3339 datetime"},
+		{"a local timestamp", func(p *Post) { p.CreatedAt = time.Now().Format(time.DateTime) }, "", "not an RFC 3339 datetime"},
+		{"a bad mention", func(p *Post) { p.Facets[0].Features[0].DID = "@synapse.test" }, "", "facets[0].features[0].did is \"@synapse.test\", not a valid did"},
+		{"a bad reply", func(p *Post) { p.Reply.Parent.URI = "https://bsky.app" }, "", "reply.parent.uri is \"https://bsky.app\", not a valid at-uri"},
+		{"too many languages", func(p *Post) { p.Langs = []string{"en", "de", "fr", "es"} }, "", "langs has 4 items, at most 3 are allowed"},
+		{"a bad language", func(p *Post) { p.Langs = []string{"English"} }, "", "langs[0] is \"English\", not a valid language"},
+		{"a quote with an image", func(p *Post) { p.Embed = NewQuoteEmbed(p.Reply.Root, image("image/png", 10)) }, "", ""},
+		{"a quote without a cid", func(p *Post) { p.Embed = NewQuoteEmbed(StrongRef{URI: p.Reply.Root.URI}, nil) }, "", "embed.record.cid is \"\", not a valid cid"},
+		{"a large image", func(p *Post) { p.Embed = image("image/png", MaxBlobSize+1) }, "", "embed.images[0].image is 1000001 bytes"},
+		{"a video as image", func(p *Post) { p.Embed = image("video/mp4", 10) }, "", "embed.images[0].image is video/mp4, must be image/*"},
+		{"a missing $type", func(p *Post) { p.Type = "" }, "", "$type must be app.bsky.feed.post"},
+		{"a bad record key", func(p *Post) {}, "self", "record key must be a TID"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := valid()
+			tt.edit(&p)
+
+			err := BundledLexicons.ValidateRecord(PostCollection, tt.rkey, p)
+			switch {
+			case tt.wanted == "" && err != nil:
+				t.Errorf("wanted no error but got %v", err.Error())
+			case tt.wanted != "" && (err == nil || !strings.Contains(err.Error(), tt.wanted)):
+				t.Errorf("wanted %q but got %v", tt.wanted, err)
+			case err != nil && !errors.Is(err, ErrInvalidRecord):
+				t.Errorf("wanted an ErrInvalidRecord but got %v", err)
+			}
+		})
+	}
+
+	t.Run("profiles live under self", func(t *testing.T) {
+		err := BundledLexicons.ValidateRecord(ProfileCollection, "3l2s5xxv2ze2c", Profile{Type: ProfileCollection})
+		if err == nil || !strings.Contains(err.Error(), "record key must be self") {
+			t.Errorf("wanted a record key error but got %v", err)
+		}
+	})
+
+	t.Run("unknown collections are not checked", func(t *testing.T) {
+		if err := BundledLexicons.ValidateRecord("com.example.record", "", map[string]string{}); err != nil {
+			t.Errorf("wanted no error but got %v", err.Error())
+		}
+	})
+
+	t.Run("invalid records are not sent or retried", func(t *testing.T) {
+		calls := 0
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+		}))
+
+		defer srv.Close()
+
+		_, err := testClient(srv).CreatePost(context.Background(), "", NewPost(strings.Repeat("a", 301)))
+		if _, retry := RetryAfter(err); err == nil || calls != 0 || retry {
+			t.Errorf("wanted an error without requests but got %v after %v calls", err, calls)
+		}
+	})
+}
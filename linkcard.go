@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// MaxPageSize is how much of a page is read looking for OpenGraph tags,
+// which are in the head
+const MaxPageSize int64 = 1 << 20
+
+// MaxCardDescription is how many graphemes of a page's description are
+// kept on its card
+const MaxCardDescription int = 300
+
+// OpenLibraryURL is where books without a URL of their own link to
+var OpenLibraryURL = "https://openlibrary.org"
+
+var (
+	isbnPattern  = regexp.MustCompile(`^(\d{9}[\dX]|\d{13})$`)
+	metaPattern  = regexp.MustCompile(`(?is)<meta\s[^>]*>`)
+	attrPattern  = regexp.MustCompile(`(?s)([a-zA-Z:_-]+)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+	titlePattern = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+)
+
+// struct OpenGraph is the preview a page describes in its og: meta tags
+type OpenGraph struct {
+	Title       string
+	Description string
+	// Image is absolute, resolved against the page's URL
+	Image string
+}
+
+// function SourceURL is the page a highlight's book links to: the URL stored
+// on the book, or its Open Library page when the ASIN is an ISBN. It is
+// empty when there is neither, since a search results page would only give
+// a generic card.
+func (h Highlight) SourceURL() string {
+	if h.URL != "" {
+		return h.URL
+	}
+
+	if isbnPattern.MatchString(h.ASIN) {
+		return strings.TrimSuffix(OpenLibraryURL, "/") + "/isbn/" + h.ASIN
+	}
+
+	return ""
+}
+
+// function ParseSourceURL checks a book's URL is an absolute http(s) link.
+// An empty URL is allowed, and clears it.
+func ParseSourceURL(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", nil
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("unable to use %v: not an http or https URL", raw)
+	}
+
+	return u.String(), nil
+}
+
+// function ParseOpenGraph reads the og: meta tags of page, falling back to
+// Twitter card tags, the description meta tag and the title element
+func ParseOpenGraph(base *url.URL, page string) OpenGraph {
+	tags := map[string]string{}
+	for _, tag := range metaPattern.FindAllString(page, -1) {
+		attrs := map[string]string{}
+		for _, m := range attrPattern.FindAllStringSubmatch(tag, -1) {
+			attrs[strings.ToLower(m[1])] = m[2] + m[3] + m[4]
+		}
+
+		key := strings.ToLower(attrs["property"])
+		if key == "" {
+			key = strings.ToLower(attrs["name"])
+		}
+
+		if _, ok := tags[key]; !ok && key != "" {
+			tags[key] = strings.TrimSpace(html.UnescapeString(attrs["content"]))
+		}
+	}
+
+	first := func(keys ...string) string {
+		for _, k := range keys {
+			if tags[k] != "" {
+				return tags[k]
+			}
+		}
+
+		return ""
+	}
+
+	og := OpenGraph{
+		Title:       first("og:title", "twitter:title"),
+		Description: first("og:description", "twitter:description", "description"),
+		Image:       first("og:image:secure_url", "og:image:url", "og:image", "twitter:image"),
+	}
+
+	if m := titlePattern.FindStringSubmatch(page); og.Title == "" && m != nil {
+		og.Title = strings.Join(strings.Fields(html.UnescapeString(m[1])), " ")
+	}
+
+	if img, err := url.Parse(og.Image); og.Image != "" && err == nil && base != nil {
+		og.Image = base.ResolveReference(img).String()
+	}
+
+	return og
+}
+
+// function fetch GETs target, failing unless it responds with 200 OK and a
+// content type in the media range accept, e.g. text/html or image/*. At most
+// limit bytes are read.
+func fetch(ctx context.Context, client *http.Client, target, accept string, limit int64) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to build request: %s", err.Error())
+	}
+
+	req.Header.Set("Accept", accept)
+
+	rsp, err := client.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to fetch %v %w", target, err)
+	}
+
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("unable to fetch %v: %v", target, rsp.Status)
+	}
+
+	// A range like image/* matches on its type alone
+	contentType := rsp.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, strings.TrimSuffix(accept, "*")) {
+		return nil, "", fmt.Errorf("unable to use %v: %v is not %v", target, contentType, accept)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(rsp.Body, limit))
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to read %v %v", target, err.Error())
+	}
+
+	return data, contentType, nil
+}
+
+// function FetchOpenGraph fetches the page at target and parses its
+// OpenGraph tags
+func FetchOpenGraph(ctx context.Context, client *http.Client, target string) (*OpenGraph, error) {
+	page, _, err := fetch(ctx, client, target, "text/html", MaxPageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	base, _ := url.Parse(target)
+	og := ParseOpenGraph(base, string(page))
+
+	return &og, nil
+}
+
+// function UploadThumb downloads the image at target and uploads it as a
+// blob for a link card
+func (c *AtClient) UploadThumb(ctx context.Context, target string) (*Blob, error) {
+	data, _, err := fetch(ctx, c.HTTP, target, "image/*", int64(MaxBlobSize)+1)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) > MaxBlobSize {
+		return nil, fmt.Errorf("unable to use %v: over the %v byte limit", target, MaxBlobSize)
+	}
+
+	mimeType := http.DetectContentType(data)
+	if !strings.HasPrefix(mimeType, "image/") {
+		return nil, fmt.Errorf("unable to use %v: %v is not an image", target, mimeType)
+	}
+
+	return c.UploadBlob(ctx, data, mimeType)
+}
+
+// function BuildExternalEmbed builds a link card for target from its
+// OpenGraph tags. A thumbnail that cannot be fetched or uploaded is left
+// out rather than failing the card.
+func BuildExternalEmbed(ctx context.Context, c *AtClient, target string) (*ExternalEmbed, error) {
+	og, err := FetchOpenGraph(ctx, c.HTTP, target)
+	if err != nil {
+		return nil, err
+	}
+
+	e := External{URI: target, Title: og.Title, Description: og.Description}
+	if e.Title == "" {
+		e.Title = target
+	}
+
+	if g := Graphemes(e.Description); len(g) > MaxCardDescription {
+		e.Description = strings.TrimSpace(strings.Join(g[:MaxCardDescription-1], "")) + "…"
+	}
+
+	if og.Image != "" {
+		if e.Thumb, err = c.UploadThumb(ctx, og.Image); err != nil {
+			logger.Warnf("unable to add a thumbnail to the card for %v %v", target, err.Error())
+		}
+	}
+
+	return NewExternalEmbed(e), nil
+}
+
+// function ManageBooks is the CLI entrypoint for books:
+//
+//	synapse books source <asin|id> [url]
+//
+// sets the page a book's link cards point to, or clears it when no URL is
+// given so they point to Open Library again
+func ManageBooks(args []string) error {
+	usage := fmt.Errorf("usage: synapse books source <asin|id> [url]")
+	if len(args) < 2 || args[0] != "source" {
+		return usage
+	}
+
+	u, err := ParseSourceURL(strings.Join(args[2:], ""))
+	if err != nil {
+		return err
+	}
+
+	if err = CreateConnection().SetBookURL(args[1], u); err != nil {
+		return err
+	}
+
+	if u == "" {
+		logger.Infof("book %v links to Open Library", args[1])
+	} else {
+		logger.Infof("book %v links to %v", args[1], u)
+	}
+
+	return nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestParseOpenGraph(t *testing.T) {
+	base, _ := url.Parse("https://press.example.com/books/remarque/")
+	tests := []struct {
+		name string
+		page string
+		want OpenGraph
+	}{
+		{
+			"og tags",
+			`<head><meta property="og:title" content="All Quiet on the Western Front">
+			<meta content='The Great War &amp; after' property='og:description' />
+			<meta property="og:image" content="/covers/aqwf.png"></head>`,
+			OpenGraph{"All Quiet on the Western Front", "The Great War & after", "https://press.example.com/covers/aqwf.png"},
+		},
+		{
+			"fallbacks",
+			`<title>
+				Remarque | Press
+			</title><meta name="description" content="A novel"><meta name="twitter:image" content="https://cdn.example.com/a.jpg">`,
+			OpenGraph{"Remarque | Press", "A novel", "https://cdn.example.com/a.jpg"},
+		},
+		{"first tag wins", `<meta property="og:title" content="One"><meta property="og:title" content="Two">`, OpenGraph{Title: "One"}},
+		{"no tags", `<p>nothing here</p>`, OpenGraph{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ParseOpenGraph(base, tt.page); got != tt.want {
+				t.Errorf("wanted %+v but got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSourceURL(t *testing.T) {
+	tests := []struct {
+		h    Highlight
+		want string
+	}{
+		{Highlight{ASIN: "B0040JHNQG", URL: "https://press.example.com/aqwf"}, "https://press.example.com/aqwf"},
+		{Highlight{ASIN: "044990525X"}, "https://openlibrary.org/isbn/044990525X"},
+		{Highlight{ASIN: "B0040JHNQG", Title: "All Quiet", Authors: "Erich Maria Remarque"}, ""},
+	}
+
+	for _, tt := range tests {
+		if got := tt.h.SourceURL(); got != tt.want {
+			t.Errorf("wanted %v but got %v", tt.want, got)
+		}
+	}
+
+	if _, err := ParseSourceURL("ftp://example.com/book"); err == nil {
+		t.Errorf("wanted an error for a non-http URL but got none")
+	}
+
+	t.Run("books store their url", func(t *testing.T) {
+		conn := testConnection(t)
+		b := &Bookcision{ASIN: "B0040JHNQG", Title: "All Quiet on the Western Front", Authors: "Erich Maria Remarque", Highlights: []BookcisionHighlight{
+			{Text: "We are forlorn like children, and experienced like old men."},
+		}}
+
+		if _, err := ImportBookcision(conn, b); err != nil {
+			t.Fatalf("test setup failed %v", err.Error())
+		}
+
+		if err := conn.SetBookURL("B0040JHNQG", "https://press.example.com/aqwf"); err != nil {
+			t.Fatalf("wanted no error but got %v", err.Error())
+		}
+
+		if h, _ := conn.GetHighlights(); len(h) != 1 || h[0].SourceURL() != "https://press.example.com/aqwf" {
+			t.Errorf("unexpected highlights %+v", h)
+		}
+
+		if err := conn.SetBookURL("B000000000", ""); err == nil {
+			t.Errorf("wanted an error for an unknown book but got none")
+		}
+	})
+}
+
+func TestBuildExternalEmbed(t *testing.T) {
+	cover := bytes.NewBuffer(nil)
+	png.Encode(cover, image.NewRGBA(image.Rect(0, 0, 2, 3)))
+
+	uploads := 0
+	accepts := map[string]string{}
+	var record struct {
+		Record struct {
+			Embed ExternalEmbed `json:"embed"`
+		} `json:"record"`
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := accepts[r.URL.Path]; !ok {
+			accepts[r.URL.Path] = r.Header.Get("Accept")
+		}
+
+		switch r.URL.Path {
+		case "/book":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte(`<html><head><meta property="og:title" content="Getting Things Done">
+				<meta property="og:description" content="The art of stress-free productivity">
+				<meta property="og:image" content="/cover.png"></head></html>`))
+		case "/plain":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<html><head><meta property="og:image" content="/missing.png"></head></html>`))
+		case "/cover.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(cover.Bytes())
+		case "/xrpc/" + UploadBlobMethod:
+			uploads++
+			body, _ := io.ReadAll(r.Body)
+			if r.Header.Get("Content-Type") != "image/png" || !bytes.Equal(body, cover.Bytes()) {
+				t.Errorf("wanted the cover to be uploaded but got %v", r.Header.Get("Content-Type"))
+			}
+
+			w.Write([]byte(`{"blob":{"$type":"blob","ref":{"$link":"bafkreicover"},"mimeType":"image/png","size":70}}`))
+		case "/xrpc/" + CreateRecordMethod:
+			json.NewDecoder(r.Body).Decode(&record)
+			w.Write([]byte(`{"uri":"at://did:plc:synapse/app.bsky.feed.post/1","cid":"bafyreicard"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	defer srv.Close()
+
+	ctx := context.Background()
+	c := testClient(srv)
+
+	t.Run("cards carry the page's title, description and thumbnail", func(t *testing.T) {
+		card, err := BuildExternalEmbed(ctx, c, srv.URL+"/book")
+		if err != nil {
+			t.Fatalf("wanted no error but got %v", err.Error())
+		}
+
+		e := card.External
+		if e.URI != srv.URL+"/book" || e.Title != "Getting Things Done" || e.Description != "The art of stress-free productivity" {
+			t.Errorf("unexpected card %+v", e)
+		}
+
+		if e.Thumb == nil || e.Thumb.Ref.Link != "bafkreicover" || uploads != 1 {
+			t.Errorf("wanted an uploaded thumbnail but got %+v", e.Thumb)
+		}
+
+		if accepts["/book"] != "text/html" || accepts["/cover.png"] != "image/*" {
+			t.Errorf("wanted media ranges to be accepted but got %v", accepts)
+		}
+	})
+
+	t.Run("missing thumbnails are left out", func(t *testing.T) {
+		card, err := BuildExternalEmbed(ctx, c, srv.URL+"/plain")
+		if err != nil || card.External.Thumb != nil || card.External.Title != srv.URL+"/plain" {
+			t.Errorf("unexpected card %+v %v", card, err)
+		}
+	})
+
+	t.Run("pages that are not html fail", func(t *testing.T) {
+		if _, err := BuildExternalEmbed(ctx, c, srv.URL+"/cover.png"); err == nil {
+			t.Errorf("wanted an error but got none")
+		}
+
+		if _, err := BuildExternalEmbed(ctx, c, srv.URL+"/gone"); err == nil {
+			t.Errorf("wanted an error but got none")
+		}
+	})
+
+	t.Run("threads open with the card", func(t *testing.T) {
+		card, _ := BuildExternalEmbed(ctx, c, srv.URL+"/book")
+		if _, err := PublishEmbed(ctx, c, testConnection(t), "Your mind is for having ideas, not holding them.", card, 0); err != nil {
+			t.Fatalf("wanted no error but got %v", err.Error())
+		}
+
+		if got := record.Record.Embed; got.Type != ExternalEmbedType || got.External.Thumb == nil {
+			t.Errorf("unexpected embed %+v", got)
+		}
+	})
+}
@@ -237,6 +237,10 @@ func (l *Logger) Warn(msg interface{}, keyvals ...interface{}) {
 	l.Log(WarnLevel, msg, keyvals...)
 }
 
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.Log(WarnLevel, fmt.Sprintf(format, args...))
+}
+
 func (l *Logger) Error(msg interface{}, keyvals ...interface{}) {
 	l.Log(ErrorLevel, msg, keyvals...)
 }
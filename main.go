@@ -45,9 +45,14 @@
 // Reads logs table and updates a log in real time
 package main
 
+import "os"
+
 var logger = DefaultLogger()
 
 func main() {
-	Login()
-	SetupDb(false)
+	if err := SetupDb(false); err != nil {
+		logger.Fatal(err)
+	}
+
+	ParseArgs(os.Args[1:])
 }
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	NotificationsCursor  string = "notifications"
+	MaxNotificationPages int    = 10
+
+	MoreCommand   string = "more"
+	RandomCommand string = "random"
+	SourceCommand string = "source"
+)
+
+// Commands start with "!". Only !random takes an argument, e.g. "!random habits"
+var commandPattern = regexp.MustCompile(`(?:^|\s)!(more|random|source)\b(?:[ \t]+[#.]?([^\s!]+))?`)
+
+// struct Notification is an app.bsky.notification.listNotifications#notification
+type Notification = NotificationListNotificationsNotification
+
+// struct Command is a request for a highlight found in a mention
+type Command struct {
+	Name string
+	Arg  string
+}
+
+// function ParseCommand returns the first command in text, or nil when
+// there is none
+func ParseCommand(text string) *Command {
+	m := commandPattern.FindStringSubmatch(text)
+	if m == nil {
+		return nil
+	}
+
+	cmd := Command{Name: m[1]}
+	if cmd.Name == RandomCommand {
+		cmd.Arg = strings.ToLower(m[2])
+	}
+
+	return &cmd
+}
+
+// function ListNotifications fetches mentions and replies, newest first, via
+// app.bsky.notification.listNotifications
+func (c *AtClient) ListNotifications(ctx context.Context, cursor string, limit int64) (*NotificationListNotificationsOutput, error) {
+	params := NotificationListNotificationsParams{Reasons: []string{"mention", "reply"}, Limit: &limit, Cursor: cursor}
+	rsp, err := c.NotificationListNotifications(ctx, params)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list notifications: %w", err)
+	}
+
+	return rsp, nil
+}
+
+// function UpdateSeen marks every notification indexed before seenAt as read
+func (c *AtClient) UpdateSeen(ctx context.Context, seenAt time.Time) error {
+	req := NotificationUpdateSeenInput{seenAt.UTC().Format(time.RFC3339Nano)}
+	if err := c.NotificationUpdateSeen(ctx, req); err != nil {
+		return fmt.Errorf("unable to update seen notifications: %w", err)
+	}
+
+	return nil
+}
+
+// function unhandledNotifications pages back through notifications until it
+// reaches one indexed before since, returning the others oldest first. Those
+// indexed at since may already be handled, [replyTo] skips them. At most
+// [MaxNotificationPages] are read; older mentions past them are not
+// answered, which is logged.
+func unhandledNotifications(ctx context.Context, c *AtClient, since time.Time) ([]Notification, error) {
+	found := []Notification{}
+	cursor := ""
+
+pages:
+	for page := 0; ; page++ {
+		if page == MaxNotificationPages {
+			logger.Warnf("stopped after %v pages of notifications, older mentions since %v are not answered",
+				MaxNotificationPages, since.Format(time.DateTime))
+			break
+		}
+
+		rsp, err := c.ListNotifications(ctx, cursor, 50)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, n := range rsp.Notifications {
+			indexedAt, err := time.Parse(time.RFC3339Nano, n.IndexedAt)
+			if err != nil {
+				logger.Warnf("skipping notification %v %v", n.URI, err.Error())
+				continue
+			}
+
+			if indexedAt.Before(since) {
+				break pages
+			}
+
+			found = append(found, n)
+		}
+
+		if rsp.Cursor == "" || len(rsp.Notifications) == 0 {
+			break
+		}
+
+		cursor = rsp.Cursor
+	}
+
+	for i, j := 0, len(found)-1; i < j; i, j = i+1, j-1 {
+		found[i], found[j] = found[j], found[i]
+	}
+
+	return found, nil
+}
+
+// function threadHighlight returns the highlight the bot posted in the
+// thread a mention replies to, or nil when it is not in one of the bot's
+// threads
+func threadHighlight(conn *Connection, p Post) (*Highlight, error) {
+	if p.Reply == nil {
+		return nil, nil
+	}
+
+	for _, uri := range []string{p.Reply.Parent.URI, p.Reply.Root.URI} {
+		h, err := conn.PostedHighlight(uri)
+		if err == nil {
+			return h, nil
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+	}
+
+	return nil, nil
+}
+
+// function pickHighlight returns the text of the first highlight matching f
+// that fits in a single reply with its attribution
+func pickHighlight(conn *Connection, f HighlightFilter) (string, int64, error) {
+	f.Status = Postable
+	candidates, err := conn.RandomHighlights(f, 10)
+	if err != nil {
+		return "", 0, err
+	}
+
+	for _, h := range candidates {
+		text := Quote{h.Text, h.Title, h.Authors}.PostText()
+		if PostLength(text) <= MaxPostLength {
+			return text, h.ID, nil
+		}
+	}
+
+	return "", 0, sql.ErrNoRows
+}
+
+// function Respond builds the reply to a command in post p. The highlight id
+// is zero when the reply does not share a highlight.
+func Respond(conn *Connection, cmd Command, p Post) (string, int64, error) {
+	posted, err := threadHighlight(conn, p)
+	if err != nil {
+		return "", 0, err
+	}
+
+	switch cmd.Name {
+	case MoreCommand:
+		if posted == nil {
+			return "Reply to one of my highlights with !more for another from the same book.", 0, nil
+		}
+
+		text, id, err := pickHighlight(conn, HighlightFilter{BookID: posted.BookID, Exclude: posted.ID})
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Sprintf("That's all I have from %v for now.", posted.Title), 0, nil
+		}
+
+		return text, id, err
+	case RandomCommand:
+		text, id, err := pickHighlight(conn, HighlightFilter{Tag: cmd.Arg})
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Sprintf("I don't have any highlights tagged #%v yet.", cmd.Arg), 0, nil
+		}
+
+		return text, id, err
+	case SourceCommand:
+		if posted == nil {
+			return "Reply to one of my highlights with !source to see where it's from.", 0, nil
+		}
+
+		source := fmt.Sprintf("From %v by %v", posted.Title, posted.Authors)
+		if posted.Location > 0 {
+			source += fmt.Sprintf(", location %v", posted.Location)
+		}
+
+		return source + ".", 0, nil
+	}
+
+	return "", 0, fmt.Errorf("unknown command %v", cmd.Name)
+}
+
+// function replyTo answers a single notification unless it has no command,
+// is the bot's own post, or has already been answered
+func replyTo(ctx context.Context, c *AtClient, conn *Connection, n Notification) error {
+	p := Post{}
+	if err := json.Unmarshal(n.Record, &p); err != nil {
+		return fmt.Errorf("unable to read notification %v %v", n.URI, err.Error())
+	}
+
+	cmd := ParseCommand(p.Text)
+	if cmd == nil || n.Author.DID == c.CurrentCredentials().DID {
+		return nil
+	}
+
+	if replied, err := conn.HasReplied(n.URI); err != nil || replied {
+		return err
+	}
+
+	text, highlightID, err := Respond(conn, *cmd, p)
+	if err != nil {
+		return err
+	}
+
+	parent := StrongRef{n.URI, n.CID}
+	reply := NewPost(text)
+	reply.Reply = &ReplyRef{parent, parent}
+	if p.Reply != nil {
+		reply.Reply.Root = p.Reply.Root
+	}
+
+	ref, err := PostOnce(ctx, c, conn, reply, highlightID)
+	if err != nil {
+		return err
+	}
+
+	logger.Infof("answered !%v from %v with %v", cmd.Name, n.Author.Handle, ref.URI)
+
+	return nil
+}
+
+// function seedCursor is where a first run starts answering mentions: when
+// the account last read its notifications, or now when it never has, so old
+// mentions are not answered in bulk
+func seedCursor(ctx context.Context, c *AtClient) (time.Time, error) {
+	rsp, err := c.ListNotifications(ctx, "", 1)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if seenAt, err := time.Parse(time.RFC3339Nano, rsp.SeenAt); err == nil {
+		return seenAt, nil
+	}
+
+	return time.Now().UTC(), nil
+}
+
+// function HandleMentions answers commands in mentions and replies received
+// since the saved cursor, then marks the notifications seen. Without a saved
+// cursor it starts from [seedCursor]. A mention the PDS rejects an answer to
+// is logged and skipped, so it does not hold up the others. Any other error
+// stops before the cursor passes the mention, so it is answered on a retry.
+func HandleMentions(ctx context.Context, c *AtClient, conn *Connection) error {
+	seenAt := time.Now()
+
+	saved, err := conn.GetCursor(NotificationsCursor)
+	if err != nil {
+		return err
+	}
+
+	var since time.Time
+	if saved == "" {
+		if since, err = seedCursor(ctx, c); err != nil {
+			return err
+		}
+
+		if err = conn.SaveCursor(NotificationsCursor, since.Format(time.RFC3339Nano)); err != nil {
+			return err
+		}
+
+		logger.Infof("answering mentions from %v", since.Format(time.DateTime))
+	} else if since, err = time.Parse(time.RFC3339Nano, saved); err != nil {
+		return fmt.Errorf("invalid %v cursor %v", NotificationsCursor, saved)
+	}
+
+	notifications, err := unhandledNotifications(ctx, c, since)
+	if err != nil {
+		return err
+	}
+
+	failed := []error{}
+	for _, n := range notifications {
+		if err = replyTo(ctx, c, conn, n); err != nil && !isRejected(err) {
+			return err
+		} else if err != nil {
+			logger.Errorf("unable to answer %v %v", n.URI, err.Error())
+			failed = append(failed, err)
+		}
+
+		if err = conn.SaveCursor(NotificationsCursor, n.IndexedAt); err != nil {
+			return err
+		}
+	}
+
+	if err = c.UpdateSeen(ctx, seenAt); err != nil {
+		return err
+	}
+
+	return errors.Join(failed...)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		text string
+		want *Command
+	}{
+		{"@synapse.test !more please", &Command{"more", ""}},
+		{"!random #Habits", &Command{"random", "habits"}},
+		{"!random .focus and more", &Command{"random", "focus"}},
+		{"where is this from? !source", &Command{"source", ""}},
+		{"that's great!more", nil},
+		{"!moreover", nil},
+		{"no commands here", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			got := ParseCommand(tt.text)
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Errorf("wanted %v but got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestHandleMentions(t *testing.T) {
+	conn := testConnection(t)
+	note := ".capture"
+	b := &Bookcision{ASIN: "B00KWG9M2E", Title: "Getting Things Done", Authors: "David Allen", Highlights: []BookcisionHighlight{
+		{Text: "Your mind is for having ideas, not holding them.", Location: BookcisionLocation{Value: 12}},
+		{Text: "Capture everything that has your attention.", Note: &note},
+	}}
+
+	if _, err := ImportBookcision(conn, b); err != nil {
+		t.Fatalf("test setup failed %v", err.Error())
+	}
+
+	root := StrongRef{"at://did:plc:synapse/app.bsky.feed.post/root", "bafyreiroot"}
+	if _, err := conn.SavePost(root, NewPost(b.Highlights[0].Text), 1); err != nil {
+		t.Fatalf("test setup failed %v", err.Error())
+	}
+
+	mention := func(rkey, text, indexedAt string, reply *ReplyRef) Notification {
+		p := NewPost(text)
+		p.Reply = reply
+		record, _ := json.Marshal(p)
+
+		return Notification{
+			URI:       "at://did:plc:reader/app.bsky.feed.post/" + rkey,
+			CID:       "bafyrei" + rkey,
+			Author:    ActorDefsProfileView{DID: "did:plc:reader", Handle: "reader.test"},
+			Reason:    "mention",
+			Record:    record,
+			IndexedAt: indexedAt,
+		}
+	}
+
+	notifications := []Notification{
+		mention("c", "!random capture", "2024-01-03T00:00:00.000Z", nil),
+		mention("b", "@synapse.test !source", "2024-01-02T00:00:00.000Z", &ReplyRef{root, root}),
+		mention("a", "@synapse.test !more", "2024-01-01T00:00:00.000Z", &ReplyRef{root, root}),
+	}
+
+	replies := map[string]Post{}
+	seen := 0
+	drop := 0
+	seenAt := "2023-12-31T00:00:00.000Z"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/xrpc/" + string(ListNotificationsMethod):
+			json.NewEncoder(w).Encode(NotificationListNotificationsOutput{Notifications: notifications, SeenAt: seenAt})
+		case "/xrpc/" + string(CreateRecordMethod):
+			if drop > 0 {
+				drop--
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+
+			req := struct {
+				Rkey   string `json:"rkey"`
+				Record Post   `json:"record"`
+			}{}
+
+			json.NewDecoder(r.Body).Decode(&req)
+			replies[req.Record.Reply.Parent.URI] = req.Record
+			json.NewEncoder(w).Encode(StrongRef{"at://did:plc:synapse/app.bsky.feed.post/" + req.Rkey, "bafyrei" + req.Rkey})
+		case "/xrpc/" + string(GetRecordMethod):
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"RecordNotFound","message":"Could not locate record"}`))
+		case "/xrpc/" + string(UpdateSeenMethod):
+			seen++
+		default:
+			t.Errorf("unexpected path %v", r.URL.Path)
+		}
+	}))
+
+	defer srv.Close()
+
+	ctx := context.Background()
+	c := testClient(srv)
+
+	t.Run("first runs start from the last seen notification", func(t *testing.T) {
+		fresh := testConnection(t)
+		seenAt = ""
+		defer func() { seenAt = "2023-12-31T00:00:00.000Z" }()
+
+		if err := HandleMentions(ctx, c, fresh); err != nil || len(replies) != 0 {
+			t.Errorf("wanted old mentions to be left but got %v %v", replies, err)
+		}
+
+		cursor, err := fresh.GetCursor(NotificationsCursor)
+		if err != nil || cursor <= notifications[0].IndexedAt {
+			t.Errorf("wanted the cursor to start from now but got %v %v", cursor, err)
+		}
+
+		seen = 0
+	})
+
+	if err := HandleMentions(ctx, c, conn); err != nil {
+		t.Fatalf("wanted no error but got %v", err.Error())
+	}
+
+	t.Run("commands are answered in thread", func(t *testing.T) {
+		more := replies[notifications[2].URI]
+		if !strings.HasPrefix(more.Text, b.Highlights[1].Text) || more.Reply.Root != root {
+			t.Errorf("unexpected !more reply %+v", more)
+		}
+
+		source := replies[notifications[1].URI]
+		if source.Text != "From Getting Things Done by David Allen, location 12." {
+			t.Errorf("unexpected !source reply %v", source.Text)
+		}
+
+		random := replies[notifications[0].URI]
+		if !strings.HasPrefix(random.Text, b.Highlights[1].Text) || random.Reply.Root.URI != notifications[0].URI {
+			t.Errorf("unexpected !random reply %+v", random)
+		}
+	})
+
+	t.Run("cursor and seen state are updated", func(t *testing.T) {
+		cursor, err := conn.GetCursor(NotificationsCursor)
+		if err != nil || cursor != notifications[0].IndexedAt || seen != 1 {
+			t.Errorf("unexpected cursor %v %v after %v updates", cursor, err, seen)
+		}
+	})
+
+	t.Run("handled notifications are skipped", func(t *testing.T) {
+		clear(replies)
+		if err := HandleMentions(ctx, c, conn); err != nil || len(replies) != 0 {
+			t.Errorf("wanted no new replies but got %v %v", replies, err)
+		}
+	})
+
+	t.Run("replies do not count as posting a highlight", func(t *testing.T) {
+		h, err := conn.NextHighlight()
+		if err != nil || h.ID != 2 {
+			t.Errorf("wanted highlight 2 to be next but got %v %v", h, err)
+		}
+	})
+
+	t.Run("failed replies do not hold up the others", func(t *testing.T) {
+		clear(replies)
+		broken := mention("d", "!more", "2024-01-04T00:00:00.000Z", nil)
+		broken.Record = json.RawMessage(`"not a post"`)
+		notifications = append([]Notification{mention("e", "@synapse.test !source", "2024-01-05T00:00:00.000Z", &ReplyRef{root, root}), broken}, notifications...)
+
+		if err := HandleMentions(ctx, c, conn); err == nil {
+			t.Errorf("wanted the failed reply to be reported but got none")
+		}
+
+		if _, ok := replies[notifications[0].URI]; !ok || len(replies) != 1 {
+			t.Errorf("wanted only %v to be answered but got %v", notifications[0].URI, replies)
+		}
+
+		if cursor, _ := conn.GetCursor(NotificationsCursor); cursor != notifications[0].IndexedAt {
+			t.Errorf("wanted the cursor to pass the failed reply but got %v", cursor)
+		}
+	})
+
+	t.Run("transient errors stop before the cursor passes the mention", func(t *testing.T) {
+		clear(replies)
+		before, _ := conn.GetCursor(NotificationsCursor)
+		notifications = append([]Notification{
+			mention("g", "@synapse.test !source", "2024-01-07T00:00:00.000Z", &ReplyRef{root, root}),
+			mention("f", "@synapse.test !source", "2024-01-06T00:00:00.000Z", &ReplyRef{root, root}),
+		}, notifications...)
+
+		drop = 1
+		if err := HandleMentions(ctx, c, conn); err == nil || len(replies) != 0 {
+			t.Fatalf("wanted the run to stop but got %v %v", replies, err)
+		}
+
+		if cursor, _ := conn.GetCursor(NotificationsCursor); cursor != before {
+			t.Errorf("wanted the cursor to stay at %v but got %v", before, cursor)
+		}
+
+		if err := HandleMentions(ctx, c, conn); err != nil {
+			t.Fatalf("wanted no error but got %v", err.Error())
+		}
+
+		// The reply to f was reserved before it failed, so it is resent
+		if err := ResumePendingPosts(ctx, c, conn); err != nil || len(replies) != 2 {
+			t.Errorf("wanted both mentions to be answered on a retry but got %v %v", replies, err)
+		}
+	})
+
+	t.Run("mentions indexed at the cursor are answered once", func(t *testing.T) {
+		clear(replies)
+		notifications = append([]Notification{
+			mention("h", "@synapse.test !source", notifications[0].IndexedAt, &ReplyRef{root, root}),
+		}, notifications...)
+
+		if err := HandleMentions(ctx, c, conn); err != nil {
+			t.Fatalf("wanted no error but got %v", err.Error())
+		}
+
+		if _, ok := replies[notifications[0].URI]; !ok || len(replies) != 1 {
+			t.Errorf("wanted only %v to be answered but got %v", notifications[0].URI, replies)
+		}
+	})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// app.bsky.feed.getPosts accepts at most this many URIs per request
+const MaxGetPosts int = 25
+
+// DefaultMetricsWindow is how long after a post is published its engagement
+// is synced, unless --metrics-window gives another number of days. Most
+// engagement arrives in the first days, so older posts keep their last
+// snapshot, e.g. for [Throwback] to rank them by.
+const DefaultMetricsWindow time.Duration = 30 * 24 * time.Hour
+
+// struct PostView is an app.bsky.feed.defs#postView
+type PostView = FeedDefsPostView
+
+// struct PostMetrics is an engagement snapshot of a post
+type PostMetrics struct {
+	URI       string
+	Likes     int
+	Reposts   int
+	Replies   int
+	Quotes    int
+	FetchedAt time.Time
+}
+
+// function Score weighs engagement into a single number. Reposts and quotes
+// put a highlight in front of new readers, so they count double.
+func (m PostMetrics) Score() int {
+	return m.Likes + m.Replies + 2*(m.Reposts+m.Quotes)
+}
+
+// function engagement is an engagement count of a [PostView], which leaves out
+// the ones it does not know
+func engagement(n *int64) int {
+	if n == nil {
+		return 0
+	}
+
+	return int(*n)
+}
+
+// function GetPosts hydrates up to [MaxGetPosts] posts via
+// app.bsky.feed.getPosts. Posts that no longer exist are left out.
+func (c *AtClient) GetPosts(ctx context.Context, uris []string) ([]PostView, error) {
+	if len(uris) > MaxGetPosts {
+		return nil, fmt.Errorf("unable to get %v posts, at most %v are allowed", len(uris), MaxGetPosts)
+	}
+
+	rsp, err := c.FeedGetPosts(ctx, FeedGetPostsParams{URIs: uris})
+	if err != nil {
+		return nil, fmt.Errorf("unable to get posts %w", err)
+	}
+
+	return rsp.Posts, nil
+}
+
+// function SyncMetrics records a snapshot of the engagement of every post
+// the bot has published within window and not deleted; a window of 0 syncs
+// every post. It returns the number of snapshots.
+func SyncMetrics(ctx context.Context, c *AtClient, conn *Connection, window time.Duration) (int, error) {
+	now := time.Now().UTC()
+	since := time.Time{}
+	if window > 0 {
+		since = now.Add(-window)
+	}
+
+	posts, err := conn.MetricPosts(since)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for start := 0; start < len(posts); start += MaxGetPosts {
+		uris := []string{}
+		for _, p := range posts[start:min(start+MaxGetPosts, len(posts))] {
+			uris = append(uris, p.URI)
+		}
+
+		views, err := c.GetPosts(ctx, uris)
+		if err != nil {
+			return count, err
+		}
+
+		for _, v := range views {
+			m := PostMetrics{v.URI, engagement(v.LikeCount), engagement(v.RepostCount), engagement(v.ReplyCount), engagement(v.QuoteCount), now}
+			if err = conn.SaveMetrics(m); err != nil {
+				return count, err
+			}
+
+			count++
+		}
+	}
+
+	logger.Infof("synced engagement of %v of %v posts", count, len(posts))
+
+	return count, nil
+}
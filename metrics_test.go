@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSyncMetrics(t *testing.T) {
+	conn := testConnection(t)
+	b := &Bookcision{ASIN: "B00KWG9M2E", Title: "Getting Things Done", Authors: "David Allen", Highlights: []BookcisionHighlight{
+		{Text: "Your mind is for having ideas, not holding them."},
+		{Text: "Capture everything that has your attention."},
+	}}
+
+	if _, err := ImportBookcision(conn, b); err != nil {
+		t.Fatalf("test setup failed %v", err.Error())
+	}
+
+	for i := 0; i < 30; i++ {
+		ref := StrongRef{fmt.Sprintf("at://did:plc:synapse/app.bsky.feed.post/%v", i), "cid"}
+		if _, err := conn.SavePost(ref, NewPost("post"), int64(i%2+1)); err != nil {
+			t.Fatalf("test setup failed %v", err.Error())
+		}
+	}
+
+	conn.MarkPostDeleted("at://did:plc:synapse/app.bsky.feed.post/29")
+
+	batches := []int{}
+	likes := int64(0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uris := r.URL.Query()["uris"]
+		batches = append(batches, len(uris))
+
+		rsp := FeedGetPostsOutput{}
+		for _, uri := range uris {
+			v := PostView{URI: uri, LikeCount: &likes}
+			if uri == "at://did:plc:synapse/app.bsky.feed.post/1" {
+				reposts := int64(10)
+				v.RepostCount = &reposts
+			}
+
+			rsp.Posts = append(rsp.Posts, v)
+		}
+
+		json.NewEncoder(w).Encode(rsp)
+	}))
+
+	defer srv.Close()
+
+	ctx := context.Background()
+	c := testClient(srv)
+
+	for likes = 1; likes <= 2; likes++ {
+		if n, err := SyncMetrics(ctx, c, conn, DefaultMetricsWindow); err != nil || n != 29 {
+			t.Fatalf("wanted 29 snapshots but got %v %v", n, err)
+		}
+	}
+
+	t.Run("uris are fetched in batches", func(t *testing.T) {
+		if len(batches) != 4 || batches[0] != MaxGetPosts || batches[1] != 4 {
+			t.Errorf("unexpected batches %v", batches)
+		}
+	})
+
+	t.Run("snapshots form a time series", func(t *testing.T) {
+		got, err := conn.GetMetrics("at://did:plc:synapse/app.bsky.feed.post/0")
+		if err != nil || len(got) != 2 || got[0].Likes != 1 || got[1].Likes != 2 {
+			t.Errorf("unexpected metrics %+v %v", got, err)
+		}
+	})
+
+	t.Run("highlights are ranked by latest engagement", func(t *testing.T) {
+		top, err := conn.TopHighlights(10)
+		if err != nil || len(top) != 2 {
+			t.Fatalf("wanted 2 highlights but got %v %v", top, err)
+		}
+
+		if top[0].ID != 2 || top[0].Metrics.Likes != 28 || top[0].Metrics.Reposts != 10 {
+			t.Errorf("unexpected ranking %+v", top)
+		}
+	})
+
+	t.Run("posts older than the window are not synced", func(t *testing.T) {
+		old := time.Now().UTC().Add(-DefaultMetricsWindow - time.Hour)
+		if _, err := conn.Db.Exec(`UPDATE posts SET posted_at = ? WHERE uri = ?`, old, "at://did:plc:synapse/app.bsky.feed.post/0"); err != nil {
+			t.Fatalf("test setup failed %v", err.Error())
+		}
+
+		if n, err := SyncMetrics(ctx, c, conn, DefaultMetricsWindow); err != nil || n != 28 {
+			t.Errorf("wanted 28 snapshots but got %v %v", n, err)
+		}
+
+		if got, _ := conn.GetMetrics("at://did:plc:synapse/app.bsky.feed.post/0"); len(got) != 2 {
+			t.Errorf("wanted the old post to keep its 2 snapshots but got %v", len(got))
+		}
+	})
+
+	t.Run("a window of 0 syncs every post", func(t *testing.T) {
+		if n, err := SyncMetrics(ctx, c, conn, 0); err != nil || n != 29 {
+			t.Errorf("wanted 29 snapshots but got %v %v", n, err)
+		}
+	})
+}
@@ -0,0 +1,561 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	OAuthScope      string        = "atproto transition:generic"
+	OAuthCallback   string        = "/oauth/callback"
+	PLCDirectory    string        = "https://plc.directory"
+	OAuthRequestTTL time.Duration = 10 * time.Minute
+)
+
+// struct ProtectedResourceMetadata is served by a PDS at
+// /.well-known/oauth-protected-resource
+type ProtectedResourceMetadata struct {
+	Resource             string   `json:"resource"`
+	AuthorizationServers []string `json:"authorization_servers"`
+}
+
+// struct AuthServerMetadata is the part of an authorization server's
+// /.well-known/oauth-authorization-server document the bot uses
+type AuthServerMetadata struct {
+	Issuer                             string   `json:"issuer"`
+	AuthorizationEndpoint              string   `json:"authorization_endpoint"`
+	TokenEndpoint                      string   `json:"token_endpoint"`
+	PushedAuthorizationRequestEndpoint string   `json:"pushed_authorization_request_endpoint"`
+	DPoPSigningAlgValuesSupported      []string `json:"dpop_signing_alg_values_supported"`
+	ScopesSupported                    []string `json:"scopes_supported"`
+}
+
+type PARResponse struct {
+	RequestURI string `json:"request_uri"`
+	ExpiresIn  int    `json:"expires_in"`
+}
+
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	Scope        string `json:"scope"`
+	Sub          string `json:"sub"`
+}
+
+// struct OAuthError is an error response from an authorization server
+type OAuthError struct {
+	Status      int
+	Name        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *OAuthError) Error() string {
+	return fmt.Sprintf("%v (%v) %v", e.Name, e.Status, e.Description)
+}
+
+// struct OAuthRequest is an authorization waiting for the redirect back to
+// the loopback server
+type OAuthRequest struct {
+	State         string
+	DID           string
+	Handle        string
+	Issuer        string
+	PDS           string
+	TokenEndpoint string
+	ClientID      string
+	RedirectURI   string
+	Verifier      string
+	DPoP          *DPoP
+	CreatedAt     time.Time
+}
+
+// struct OAuthSession is a set of DPoP-bound tokens for an account
+type OAuthSession struct {
+	DID           string
+	Handle        string
+	Issuer        string
+	PDS           string
+	TokenEndpoint string
+	ClientID      string
+	Scope         string
+	AccessToken   string
+	RefreshToken  string
+	ExpiresAt     time.Time
+	DPoP          *DPoP
+}
+
+// function Expired reports whether the access token should be refreshed
+// before it is used
+func (s OAuthSession) Expired(now time.Time) bool {
+	return !s.ExpiresAt.IsZero() && !now.Before(s.ExpiresAt)
+}
+
+// struct OAuthClient is a public atproto OAuth client that is redirected
+// back to a loopback address, so it needs no published client metadata
+type OAuthClient struct {
+	HTTP        *http.Client
+	RedirectURI string
+	// Service resolves handles, see [AtClient.ResolveHandle]
+	Service string
+	PLC     string
+}
+
+func NewOAuthClient(redirectURI string) *OAuthClient {
+	return &OAuthClient{
+		HTTP:        NewHTTPClient(),
+		RedirectURI: redirectURI,
+		Service:     ServiceURL,
+		PLC:         PLCDirectory,
+	}
+}
+
+// function ClientID is the loopback client id, which carries the redirect
+// URI and scope in place of a metadata document
+func (o *OAuthClient) ClientID() string {
+	q := url.Values{"redirect_uri": {o.RedirectURI}, "scope": {OAuthScope}}
+
+	return "http://localhost?" + q.Encode()
+}
+
+// function randomString returns n random bytes encoded as base64url, for
+// state, PKCE verifiers and DPoP proof IDs
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("unable to read random bytes %v", err.Error())
+	}
+
+	return b64.EncodeToString(b), nil
+}
+
+// function PKCEChallenge is the S256 code challenge of a verifier
+func PKCEChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+
+	return b64.EncodeToString(sum[:])
+}
+
+// function getJSON fetches an unauthenticated JSON document
+func (o *OAuthClient) getJSON(ctx context.Context, target string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return fmt.Errorf("unable to build request: %s", err.Error())
+	}
+
+	rsp, err := o.HTTP.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to fetch %v %w", target, err)
+	}
+
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unable to fetch %v: %v", target, rsp.Status)
+	}
+
+	if err = json.NewDecoder(rsp.Body).Decode(out); err != nil {
+		return fmt.Errorf("unable to marshal JSON from %v %v", target, err.Error())
+	}
+
+	return nil
+}
+
+// function postForm sends a DPoP-signed form to an authorization server,
+// retrying once when it asks for a fresh nonce
+func (o *OAuthClient) postForm(ctx context.Context, d *DPoP, endpoint string, form url.Values, out interface{}) error {
+	for attempt := 0; ; attempt++ {
+		proof, err := d.Proof(http.MethodPost, endpoint, "")
+		if err != nil {
+			return err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+		if err != nil {
+			return fmt.Errorf("unable to build request: %s", err.Error())
+		}
+
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("DPoP", proof)
+
+		rsp, err := o.HTTP.Do(req)
+		if err != nil {
+			return fmt.Errorf("unable to call %v %w", endpoint, err)
+		}
+
+		body, err := io.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("unable to read response from %v %v", endpoint, err.Error())
+		}
+
+		d.SaveNonce(endpoint, rsp.Header)
+		logger.Debugf("request to %v completed with status %v", endpoint, rsp.Status)
+
+		if rsp.StatusCode >= 300 {
+			if attempt == 0 && NeedsNonce(rsp, body) {
+				continue
+			}
+
+			e := OAuthError{Status: rsp.StatusCode}
+			json.Unmarshal(body, &e)
+
+			return &e
+		}
+
+		if err = json.Unmarshal(body, out); err != nil {
+			return fmt.Errorf("unable to marshal JSON from %v %v", endpoint, err.Error())
+		}
+
+		return nil
+	}
+}
+
+// function ResolveDID fetches the DID document of a did:plc or did:web
+func (o *OAuthClient) ResolveDID(ctx context.Context, did string) (*DidDoc, error) {
+	var target string
+	switch {
+	case strings.HasPrefix(did, "did:plc:"):
+		target = strings.TrimSuffix(o.PLC, "/") + "/" + did
+	case strings.HasPrefix(did, "did:web:"):
+		target = "https://" + strings.TrimPrefix(did, "did:web:") + "/.well-known/did.json"
+	default:
+		return nil, fmt.Errorf("unsupported DID method %v", did)
+	}
+
+	doc := DidDoc{}
+	if err := o.getJSON(ctx, target, &doc); err != nil {
+		return nil, err
+	}
+
+	if doc.ID != did {
+		return nil, fmt.Errorf("DID document for %v is for %v", did, doc.ID)
+	}
+
+	return &doc, nil
+}
+
+// function discover resolves an account to its PDS and the authorization
+// server that PDS trusts
+func (o *OAuthClient) discover(ctx context.Context, account string) (did, pds string, meta *AuthServerMetadata, err error) {
+	did = account
+	if !strings.HasPrefix(account, "did:") {
+		resolver := NewClient(AtCredentials{Entryway: o.Service})
+		resolver.HTTP = o.HTTP
+		if did, err = resolver.ResolveHandle(ctx, strings.TrimPrefix(account, "@")); err != nil {
+			return "", "", nil, err
+		}
+	}
+
+	doc, err := o.ResolveDID(ctx, did)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	if pds = doc.PDS(); pds == "" {
+		return "", "", nil, fmt.Errorf("DID document for %v has no PDS", did)
+	}
+
+	resource := ProtectedResourceMetadata{}
+	if err = o.getJSON(ctx, pds+"/.well-known/oauth-protected-resource", &resource); err != nil {
+		return "", "", nil, err
+	} else if len(resource.AuthorizationServers) == 0 {
+		return "", "", nil, fmt.Errorf("%v lists no authorization servers", pds)
+	}
+
+	issuer := strings.TrimSuffix(resource.AuthorizationServers[0], "/")
+	meta = &AuthServerMetadata{}
+	if err = o.getJSON(ctx, issuer+"/.well-known/oauth-authorization-server", meta); err != nil {
+		return "", "", nil, err
+	}
+
+	switch {
+	case strings.TrimSuffix(meta.Issuer, "/") != issuer:
+		err = fmt.Errorf("authorization server %v claims to be %v", issuer, meta.Issuer)
+	case meta.PushedAuthorizationRequestEndpoint == "":
+		err = fmt.Errorf("authorization server %v does not accept pushed requests", issuer)
+	case !slices.Contains(meta.DPoPSigningAlgValuesSupported, "ES256"):
+		err = fmt.Errorf("authorization server %v does not accept ES256 DPoP proofs", issuer)
+	}
+
+	return did, pds, meta, err
+}
+
+// function Authorize starts signing in to account, a handle or DID. The
+// request is pushed to the authorization server and saved until the user
+// is redirected back; the returned URL is where they approve it.
+func (o *OAuthClient) Authorize(ctx context.Context, conn *Connection, account string) (string, error) {
+	did, pds, meta, err := o.discover(ctx, account)
+	if err != nil {
+		return "", err
+	}
+
+	d, err := NewDPoP()
+	if err != nil {
+		return "", err
+	}
+
+	state, err := randomString(16)
+	if err != nil {
+		return "", err
+	}
+
+	verifier, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+
+	r := OAuthRequest{
+		State:         state,
+		DID:           did,
+		Issuer:        strings.TrimSuffix(meta.Issuer, "/"),
+		PDS:           pds,
+		TokenEndpoint: meta.TokenEndpoint,
+		ClientID:      o.ClientID(),
+		RedirectURI:   o.RedirectURI,
+		Verifier:      verifier,
+		DPoP:          d,
+	}
+
+	if !strings.HasPrefix(account, "did:") {
+		r.Handle = strings.TrimPrefix(account, "@")
+	}
+
+	form := url.Values{
+		"client_id":             {r.ClientID},
+		"response_type":         {"code"},
+		"redirect_uri":          {r.RedirectURI},
+		"scope":                 {OAuthScope},
+		"state":                 {r.State},
+		"code_challenge":        {PKCEChallenge(r.Verifier)},
+		"code_challenge_method": {"S256"},
+		"login_hint":            {account},
+	}
+
+	par := PARResponse{}
+	if err = o.postForm(ctx, d, meta.PushedAuthorizationRequestEndpoint, form, &par); err != nil {
+		return "", fmt.Errorf("unable to push authorization request %w", err)
+	}
+
+	if err = conn.SaveOAuthRequest(r); err != nil {
+		return "", err
+	}
+
+	q := url.Values{"client_id": {r.ClientID}, "request_uri": {par.RequestURI}}
+
+	return meta.AuthorizationEndpoint + "?" + q.Encode(), nil
+}
+
+// function Callback finishes signing in with the query of the redirect to
+// [OAuthCallback], exchanging the code for tokens and saving the session
+func (o *OAuthClient) Callback(ctx context.Context, conn *Connection, q url.Values) (*OAuthSession, error) {
+	if e := q.Get("error"); e != "" {
+		return nil, &OAuthError{Status: http.StatusBadRequest, Name: e, Description: q.Get("error_description")}
+	}
+
+	r, err := conn.TakeOAuthRequest(q.Get("state"))
+	if err != nil {
+		return nil, err
+	}
+
+	if time.Since(r.CreatedAt) > OAuthRequestTTL {
+		return nil, fmt.Errorf("authorization request expired, sign in again")
+	}
+
+	// atproto servers must send iss (RFC 9207), so a redirect without it
+	// is not trusted either
+	if iss := q.Get("iss"); iss == "" {
+		return nil, fmt.Errorf("redirect is missing the issuer %v", r.Issuer)
+	} else if strings.TrimSuffix(iss, "/") != r.Issuer {
+		return nil, fmt.Errorf("redirect came from %v instead of %v", iss, r.Issuer)
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {q.Get("code")},
+		"redirect_uri":  {r.RedirectURI},
+		"code_verifier": {r.Verifier},
+		"client_id":     {r.ClientID},
+	}
+
+	t := TokenResponse{}
+	if err = o.postForm(ctx, r.DPoP, r.TokenEndpoint, form, &t); err != nil {
+		return nil, fmt.Errorf("unable to exchange authorization code %w", err)
+	}
+
+	if t.Sub != r.DID {
+		return nil, fmt.Errorf("tokens were issued for %v instead of %v", t.Sub, r.DID)
+	}
+
+	s := OAuthSession{
+		DID:           r.DID,
+		Handle:        r.Handle,
+		Issuer:        r.Issuer,
+		PDS:           r.PDS,
+		TokenEndpoint: r.TokenEndpoint,
+		ClientID:      r.ClientID,
+		DPoP:          r.DPoP,
+	}
+
+	if err = s.apply(t, time.Now()); err != nil {
+		return nil, err
+	}
+
+	if err = conn.SaveOAuthSession(s); err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+// function apply updates the session with a token response
+func (s *OAuthSession) apply(t TokenResponse, now time.Time) error {
+	if !strings.EqualFold(t.TokenType, "DPoP") {
+		return fmt.Errorf("expected DPoP-bound tokens but got %v", t.TokenType)
+	}
+
+	if !slices.Contains(strings.Fields(t.Scope), "atproto") {
+		return fmt.Errorf("tokens are missing the atproto scope: %v", t.Scope)
+	}
+
+	s.AccessToken = t.AccessToken
+	s.RefreshToken = t.RefreshToken
+	s.Scope = t.Scope
+	s.ExpiresAt = time.Time{}
+	if t.ExpiresIn > 0 {
+		s.ExpiresAt = now.Add(time.Duration(t.ExpiresIn) * time.Second / 2)
+	}
+
+	return nil
+}
+
+// function Refresh exchanges the refresh token of s for new tokens
+func (o *OAuthClient) Refresh(ctx context.Context, s *OAuthSession) error {
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {s.RefreshToken},
+		"client_id":     {s.ClientID},
+	}
+
+	t := TokenResponse{}
+	if err := o.postForm(ctx, s.DPoP, s.TokenEndpoint, form, &t); err != nil {
+		return fmt.Errorf("unable to refresh OAuth session %w", err)
+	}
+
+	if t.Sub != "" && t.Sub != s.DID {
+		return fmt.Errorf("tokens were refreshed for %v instead of %v", t.Sub, s.DID)
+	}
+
+	return s.apply(t, time.Now())
+}
+
+// function NewOAuthSessionClient creates an [AtClient] that authenticates
+// with DPoP-bound tokens instead of an app password session
+func NewOAuthSessionClient(s *OAuthSession) *AtClient {
+	c := NewClient(AtCredentials{
+		Handle:          s.Handle,
+		DID:             s.DID,
+		AccessToken:     s.AccessToken,
+		RefreshToken:    s.RefreshToken,
+		ServiceEndpoint: s.PDS,
+	})
+	c.OAuth = s
+
+	return c
+}
+
+// function refreshOAuth refreshes the client's OAuth session and keeps the
+// credentials in step with it
+func (c *AtClient) refreshOAuth(ctx context.Context) error {
+	c.mu.RLock()
+	s := *c.OAuth
+	c.mu.RUnlock()
+
+	o := &OAuthClient{HTTP: c.HTTP}
+	if err := o.Refresh(ctx, &s); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	*c.OAuth = s
+	c.Credentials.AccessToken = s.AccessToken
+	c.Credentials.RefreshToken = s.RefreshToken
+	c.mu.Unlock()
+
+	logger.Info(fmt.Sprintf("OAuth session refreshed at %s", time.Now().Format("03:04 PM on 01/02/2006")))
+
+	if c.OnOAuthSession != nil {
+		c.OnOAuthSession(s)
+	}
+
+	return nil
+}
+
+// function oauthExpired reports whether the client's OAuth access token is
+// due to be refreshed
+func (c *AtClient) oauthExpired() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.OAuth != nil && c.OAuth.Expired(time.Now())
+}
+
+// function authorize sets the credentials of an XRPC request: a DPoP proof
+// and token for OAuth sessions, otherwise a bearer token
+func (c *AtClient) authorize(req *http.Request, token string) error {
+	if token == "" {
+		return nil
+	}
+
+	c.mu.RLock()
+	s := c.OAuth
+	c.mu.RUnlock()
+
+	if s == nil {
+		req.Header.Set("Authorization", "Bearer "+token)
+		return nil
+	}
+
+	proof, err := s.DPoP.Proof(req.Method, req.URL.String(), token)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "DPoP "+token)
+	req.Header.Set("DPoP", proof)
+
+	return nil
+}
+
+// function retryWithNonce reports whether a response to a DPoP request
+// asked for a new nonce, which has been saved for the retry
+func (c *AtClient) retryWithNonce(rsp *http.Response) bool {
+	c.mu.RLock()
+	s := c.OAuth
+	c.mu.RUnlock()
+
+	if s == nil {
+		return false
+	}
+
+	s.DPoP.SaveNonce(rsp.Request.URL.String(), rsp.Header)
+	if rsp.StatusCode != http.StatusUnauthorized && rsp.StatusCode != http.StatusBadRequest {
+		return false
+	}
+
+	body, _ := io.ReadAll(rsp.Body)
+	rsp.Body = io.NopCloser(bytes.NewReader(body))
+
+	return NeedsNonce(rsp, body)
+}
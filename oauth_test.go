@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// function verifyProof checks the signature of a DPoP proof against the key
+// in its header and returns its claims and key
+func verifyProof(t *testing.T, proof string) (DPoPClaims, JWK) {
+	t.Helper()
+
+	parts := strings.Split(proof, ".")
+	if len(parts) != 3 {
+		t.Fatalf("malformed proof %v", proof)
+	}
+
+	header, claims := dpopHeader{}, DPoPClaims{}
+	raw, _ := b64.DecodeString(parts[0])
+	json.Unmarshal(raw, &header)
+	raw, _ = b64.DecodeString(parts[1])
+	json.Unmarshal(raw, &claims)
+
+	if header.Typ != "dpop+jwt" || header.Alg != "ES256" {
+		t.Errorf("unexpected proof header %+v", header)
+	}
+
+	x, _ := b64.DecodeString(header.JWK.X)
+	y, _ := b64.DecodeString(header.JWK.Y)
+	pub := ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+
+	sig, _ := b64.DecodeString(parts[2])
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if len(sig) != 64 || !ecdsa.Verify(&pub, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		t.Errorf("proof signature does not verify")
+	}
+
+	return claims, header.JWK
+}
+
+func TestDPoP(t *testing.T) {
+	d, err := NewDPoP()
+	if err != nil {
+		t.Fatalf("wanted no error but got %v", err.Error())
+	}
+
+	t.Run("proofs are signed and bound to the request", func(t *testing.T) {
+		proof, err := d.Proof(http.MethodGet, "https://pds.test/xrpc/app.bsky.feed.getPosts?uris=a#b", "token")
+		if err != nil {
+			t.Fatalf("wanted no error but got %v", err.Error())
+		}
+
+		claims, jwk := verifyProof(t, proof)
+		ath := sha256.Sum256([]byte("token"))
+		if claims.HTM != "GET" || claims.HTU != "https://pds.test/xrpc/app.bsky.feed.getPosts" || claims.ATH != b64.EncodeToString(ath[:]) {
+			t.Errorf("unexpected claims %+v", claims)
+		}
+
+		if jwk != d.JWK() || claims.JTI == "" || claims.Nonce != "" {
+			t.Errorf("unexpected key or claims %+v %+v", jwk, claims)
+		}
+	})
+
+	t.Run("nonces are kept per origin", func(t *testing.T) {
+		h := http.Header{}
+		h.Set(DPoPNonceHeader, "n1")
+		d.SaveNonce("https://auth.test/oauth/token", h)
+		proof, _ := d.Proof(http.MethodPost, "https://auth.test/oauth/par", "")
+		if claims, _ := verifyProof(t, proof); claims.Nonce != "n1" {
+			t.Errorf("wanted nonce n1 but got %v", claims.Nonce)
+		}
+
+		if d.Nonce("https://pds.test/xrpc/x") != "" {
+			t.Errorf("wanted no nonce for another origin")
+		}
+	})
+
+	t.Run("keys survive a round trip", func(t *testing.T) {
+		s, err := d.Marshal()
+		if err != nil {
+			t.Fatalf("wanted no error but got %v", err.Error())
+		}
+
+		got, err := ParseDPoP(s)
+		if err != nil || got.JWK() != d.JWK() {
+			t.Errorf("wanted the same key but got %v %v", got, err)
+		}
+	})
+}
+
+func TestOAuth(t *testing.T) {
+	const did = "did:plc:synapse"
+
+	var srv *httptest.Server
+	var challenge, key, access, refresh string
+	issued := 0
+	calls := map[string]int{}
+
+	// requireProof checks a request's DPoP proof, asking for a nonce first
+	requireProof := func(w http.ResponseWriter, r *http.Request, token string) bool {
+		claims, jwk := verifyProof(t, r.Header.Get("DPoP"))
+		if key == "" {
+			key = jwk.X
+		} else if jwk.X != key {
+			t.Errorf("proof signed by a different key")
+		}
+
+		if claims.HTM != r.Method || claims.HTU != srv.URL+r.URL.Path {
+			t.Errorf("proof is for %v %v", claims.HTM, claims.HTU)
+		}
+
+		if token != "" {
+			ath := sha256.Sum256([]byte(token))
+			if claims.ATH != b64.EncodeToString(ath[:]) {
+				t.Errorf("proof is not bound to the access token")
+			}
+		}
+
+		if claims.Nonce != "nonce" {
+			w.Header().Set(DPoPNonceHeader, "nonce")
+			if token != "" {
+				w.Header().Set("WWW-Authenticate", `DPoP error="use_dpop_nonce"`)
+				w.WriteHeader(http.StatusUnauthorized)
+			} else {
+				w.WriteHeader(http.StatusBadRequest)
+			}
+
+			w.Write([]byte(`{"error":"use_dpop_nonce"}`))
+			return false
+		}
+
+		return true
+	}
+
+	tokens := func(w http.ResponseWriter) {
+		issued++
+		access, refresh = fmt.Sprintf("access-%v", issued), fmt.Sprintf("refresh-%v", issued)
+		json.NewEncoder(w).Encode(TokenResponse{
+			AccessToken:  access,
+			TokenType:    "DPoP",
+			RefreshToken: refresh,
+			ExpiresIn:    3600,
+			Scope:        OAuthScope,
+			Sub:          did,
+		})
+	}
+
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls[r.URL.Path]++
+		r.ParseForm()
+
+		switch r.URL.Path {
+		case "/xrpc/" + string(ResolveHandleMethod):
+			json.NewEncoder(w).Encode(IdentityResolveHandleOutput{did})
+		case "/" + did:
+			json.NewEncoder(w).Encode(DidDoc{ID: did, Service: []Service{{ID: "#atproto_pds", ServiceEndpoint: srv.URL}}})
+		case "/.well-known/oauth-protected-resource":
+			json.NewEncoder(w).Encode(ProtectedResourceMetadata{srv.URL, []string{srv.URL}})
+		case "/.well-known/oauth-authorization-server":
+			json.NewEncoder(w).Encode(AuthServerMetadata{
+				Issuer:                             srv.URL,
+				AuthorizationEndpoint:              srv.URL + "/oauth/authorize",
+				TokenEndpoint:                      srv.URL + "/oauth/token",
+				PushedAuthorizationRequestEndpoint: srv.URL + "/oauth/par",
+				DPoPSigningAlgValuesSupported:      []string{"ES256"},
+			})
+		case "/oauth/par":
+			if !requireProof(w, r, "") {
+				return
+			}
+
+			challenge = r.PostForm.Get("code_challenge")
+			if r.PostForm.Get("code_challenge_method") != "S256" || r.PostForm.Get("login_hint") != "synapse.test" {
+				t.Errorf("unexpected authorization request %v", r.PostForm)
+			}
+
+			json.NewEncoder(w).Encode(PARResponse{"urn:ietf:params:oauth:request_uri:req", 60})
+		case "/oauth/token":
+			if !requireProof(w, r, "") {
+				return
+			}
+
+			switch r.PostForm.Get("grant_type") {
+			case "authorization_code":
+				if PKCEChallenge(r.PostForm.Get("code_verifier")) != challenge || r.PostForm.Get("code") != "code" {
+					t.Errorf("code verifier does not match the challenge")
+				}
+			case "refresh_token":
+				if r.PostForm.Get("refresh_token") != refresh {
+					t.Errorf("unexpected refresh token %v", r.PostForm.Get("refresh_token"))
+				}
+			}
+
+			tokens(w)
+		case "/xrpc/" + string(GetSessionMethod):
+			token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "DPoP ")
+			if !requireProof(w, r, token) {
+				return
+			}
+
+			if token != access {
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`{"error":"InvalidToken","message":"token is stale"}`))
+				return
+			}
+
+			json.NewEncoder(w).Encode(ServerGetSessionOutput{Handle: "synapse.test", DID: did})
+		default:
+			t.Errorf("unexpected path %v", r.URL.Path)
+		}
+	}))
+
+	defer srv.Close()
+
+	ctx := context.Background()
+	conn := testConnection(t)
+	o := NewOAuthClient("http://127.0.0.1:8080" + OAuthCallback)
+	o.Service, o.PLC = srv.URL, srv.URL
+
+	target, err := o.Authorize(ctx, conn, "synapse.test")
+	if err != nil {
+		t.Fatalf("wanted no error but got %v", err.Error())
+	}
+
+	t.Run("user is sent to approve the pushed request", func(t *testing.T) {
+		u, _ := url.Parse(target)
+		if u.Path != "/oauth/authorize" || u.Query().Get("request_uri") == "" || u.Query().Get("client_id") != o.ClientID() {
+			t.Errorf("unexpected authorization URL %v", target)
+		}
+
+		if calls["/oauth/par"] != 2 {
+			t.Errorf("wanted a retry with the server's nonce but got %v requests", calls["/oauth/par"])
+		}
+	})
+
+	var state string
+	conn.Db.QueryRow(`SELECT state FROM oauth_requests`).Scan(&state)
+
+	t.Run("redirects from another issuer are rejected", func(t *testing.T) {
+		q := url.Values{"code": {"code"}, "state": {state}, "iss": {"https://evil.test"}}
+		if _, err := o.Callback(ctx, conn, q); err == nil {
+			t.Errorf("wanted an error but got none")
+		}
+	})
+
+	t.Run("redirects without an issuer are rejected", func(t *testing.T) {
+		key = ""
+		if _, err := o.Authorize(ctx, conn, "synapse.test"); err != nil {
+			t.Fatalf("wanted no error but got %v", err.Error())
+		}
+
+		conn.Db.QueryRow(`SELECT state FROM oauth_requests`).Scan(&state)
+		if _, err := o.Callback(ctx, conn, url.Values{"code": {"code"}, "state": {state}}); err == nil {
+			t.Errorf("wanted an error but got none")
+		}
+	})
+
+	// The rejected callbacks consumed the requests, so start over with a new key
+	key = ""
+	if _, err = o.Authorize(ctx, conn, "synapse.test"); err != nil {
+		t.Fatalf("wanted no error but got %v", err.Error())
+	}
+
+	conn.Db.QueryRow(`SELECT state FROM oauth_requests`).Scan(&state)
+
+	s, err := o.Callback(ctx, conn, url.Values{"code": {"code"}, "state": {state}, "iss": {srv.URL}})
+	if err != nil {
+		t.Fatalf("wanted no error but got %v", err.Error())
+	}
+
+	t.Run("session is stored with its key", func(t *testing.T) {
+		got, err := conn.GetOAuthSession("synapse.test")
+		if err != nil || got.AccessToken != "access-1" || got.PDS != srv.URL || got.DPoP.JWK() != s.DPoP.JWK() {
+			t.Errorf("unexpected session %+v %v", got, err)
+		}
+
+		if _, err := o.Callback(ctx, conn, url.Values{"code": {"code"}, "state": {state}}); err == nil {
+			t.Errorf("wanted a replayed callback to fail")
+		}
+	})
+
+	stored, _ := conn.GetOAuthSession("")
+	c := NewOAuthSessionClient(stored)
+	c.HTTP = srv.Client()
+	saved := 0
+	c.OnOAuthSession = func(s OAuthSession) {
+		saved++
+		conn.SaveOAuthSession(s)
+	}
+
+	t.Run("requests carry DPoP-bound tokens", func(t *testing.T) {
+		if _, err := c.GetSession(ctx); err != nil {
+			t.Errorf("wanted no error but got %v", err.Error())
+		}
+	})
+
+	t.Run("expired tokens are refreshed first", func(t *testing.T) {
+		c.OAuth.ExpiresAt = time.Now().Add(-time.Minute)
+		if _, err := c.GetSession(ctx); err != nil {
+			t.Fatalf("wanted no error but got %v", err.Error())
+		}
+
+		got, _ := conn.GetOAuthSession(did)
+		if saved != 1 || got.AccessToken != "access-2" || c.CurrentCredentials().RefreshToken != "refresh-2" {
+			t.Errorf("wanted the refreshed session to be saved but got %+v", got)
+		}
+	})
+
+	t.Run("rejected tokens are refreshed", func(t *testing.T) {
+		access = ""
+		if _, err := c.GetSession(ctx); err != nil {
+			t.Fatalf("wanted no error but got %v", err.Error())
+		}
+
+		if saved != 2 {
+			t.Errorf("wanted a refresh but got %v", saved)
+		}
+	})
+}
+
+func TestOAuthRoutes(t *testing.T) {
+	srv := httptest.NewServer(oauthRoutes(NewOAuthClient("http://127.0.0.1:8080"+OAuthCallback), testConnection(t)))
+	defer srv.Close()
+
+	t.Run("login page asks for a handle", func(t *testing.T) {
+		rsp, err := http.Get(srv.URL + "/oauth/login")
+		if err != nil || rsp.StatusCode != http.StatusOK {
+			t.Fatalf("wanted the login page but got %v %v", rsp, err)
+		}
+	})
+
+	t.Run("unknown callbacks are rejected", func(t *testing.T) {
+		rsp, err := http.Get(srv.URL + OAuthCallback + "?state=unknown&code=code")
+		if err != nil || rsp.StatusCode != http.StatusBadRequest {
+			t.Errorf("wanted a bad request but got %v %v", rsp, err)
+		}
+	})
+}
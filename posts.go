@@ -0,0 +1,634 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	PostCollection string = "app.bsky.feed.post"
+	DefaultLang    string = "en"
+)
+
+// struct StrongRef identifies a specific version of a record
+type StrongRef struct {
+	URI string `json:"uri"`
+	CID string `json:"cid"`
+}
+
+// struct ReplyRef places a post in a thread
+type ReplyRef struct {
+	Root   StrongRef `json:"root"`
+	Parent StrongRef `json:"parent"`
+}
+
+// struct Post is an app.bsky.feed.post record
+type Post struct {
+	Type      string      `json:"$type"`
+	Text      string      `json:"text"`
+	CreatedAt string      `json:"createdAt"`
+	Langs     []string    `json:"langs,omitempty"`
+	Facets    []Facet     `json:"facets,omitempty"`
+	Reply     *ReplyRef   `json:"reply,omitempty"`
+	Embed     interface{} `json:"embed,omitempty"`
+	Labels    *SelfLabels `json:"labels,omitempty"`
+}
+
+// struct Record is an item returned by com.atproto.repo.listRecords
+type Record = RepoListRecordsRecord
+
+// struct ATURI is a parsed at://<repo>/<collection>/<rkey> URI
+type ATURI struct {
+	Repo       string
+	Collection string
+	Rkey       string
+}
+
+// function NewPost builds a post record created now. When no languages are
+// given, [DefaultLang] is used.
+func NewPost(text string, langs ...string) Post {
+	if len(langs) == 0 {
+		langs = []string{DefaultLang}
+	}
+
+	return Post{
+		Type:      PostCollection,
+		Text:      text,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339Nano),
+		Langs:     langs,
+	}
+}
+
+// function CreateRecord writes a record to the authenticated user's repo via
+// com.atproto.repo.createRecord. When rkey is empty the PDS assigns one.
+func (c *AtClient) CreateRecord(ctx context.Context, collection, rkey string, record interface{}) (*StrongRef, error) {
+	did := c.CurrentCredentials().DID
+	if did == "" {
+		return nil, fmt.Errorf("unable to create record, not signed in: %w", ErrAuthRequired)
+	}
+
+	if err := c.ValidateRecord(collection, rkey, record); err != nil {
+		return nil, err
+	}
+
+	raw, err := json.Marshal(record)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode %v record %v", collection, err.Error())
+	}
+
+	out, err := c.RepoCreateRecord(ctx, RepoCreateRecordInput{Repo: did, Collection: collection, Rkey: rkey, Record: raw})
+	if err != nil {
+		return nil, fmt.Errorf("unable to create %v record %w", collection, err)
+	}
+
+	logger.Debugf("created record %v", out.URI)
+
+	return &StrongRef{out.URI, out.CID}, nil
+}
+
+// function ValidateRecord checks a record against the client's lexicons, so
+// malformed records fail before any request is sent
+func (c *AtClient) ValidateRecord(collection, rkey string, record interface{}) error {
+	if c.Lexicons == nil {
+		return nil
+	}
+
+	return c.Lexicons.ValidateRecord(collection, rkey, record)
+}
+
+// function CreatePost publishes an app.bsky.feed.post record. Facets are
+// detected from the text unless the post already has them.
+func (c *AtClient) CreatePost(ctx context.Context, rkey string, p Post) (*StrongRef, error) {
+	if p.Facets == nil {
+		p.Facets = c.BuildFacets(ctx, p.Text)
+	}
+
+	return c.CreateRecord(ctx, PostCollection, rkey, p)
+}
+
+// function GetRecord fetches a record from the authenticated user's repo via
+// com.atproto.repo.getRecord
+func (c *AtClient) GetRecord(ctx context.Context, uri string) (*Record, error) {
+	u, err := ParseATURI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	rec, err := c.RepoGetRecord(ctx, RepoGetRecordParams{Repo: u.Repo, Collection: u.Collection, Rkey: u.Rkey})
+	if err != nil {
+		return nil, fmt.Errorf("unable to get %v %w", uri, err)
+	}
+
+	return &Record{rec.URI, rec.CID, rec.Value}, nil
+}
+
+// function PutRecord writes a record under rkey via
+// com.atproto.repo.putRecord, only replacing the version with CID swap when
+// it is not empty
+func (c *AtClient) PutRecord(ctx context.Context, collection, rkey string, record interface{}, swap string) (*StrongRef, error) {
+	did := c.CurrentCredentials().DID
+	if did == "" {
+		return nil, fmt.Errorf("unable to put record, not signed in: %w", ErrAuthRequired)
+	}
+
+	if err := c.ValidateRecord(collection, rkey, record); err != nil {
+		return nil, err
+	}
+
+	raw, err := json.Marshal(record)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode %v record %v", collection, err.Error())
+	}
+
+	out, err := c.RepoPutRecord(ctx, RepoPutRecordInput{Repo: did, Collection: collection, Rkey: rkey, Record: raw, SwapRecord: swap})
+	if err != nil {
+		return nil, fmt.Errorf("unable to put %v record %w", collection, err)
+	}
+
+	logger.Debugf("put record %v", out.URI)
+
+	return &StrongRef{out.URI, out.CID}, nil
+}
+
+// function isDuplicate reports whether createRecord failed because a record
+// with the same key already exists
+func isDuplicate(err error) bool {
+	var e *XRPCError
+	if !errors.As(err, &e) {
+		return false
+	}
+
+	return errors.Is(e, ErrInvalidSwap) || strings.Contains(strings.ToLower(e.Message), "already exists")
+}
+
+// function PostOnce publishes a post under a record key that is reserved in
+// the database before the request is sent. If the process stops before the
+// post is confirmed, [ResumePendingPosts] finishes it under the same key
+// instead of making a second visible post. Posts of a highlight carry the
+// self-labels of the highlight, its book and tags.
+func PostOnce(ctx context.Context, c *AtClient, conn *Connection, p Post, highlightID int64) (*StrongRef, error) {
+	u := ATURI{c.CurrentCredentials().DID, PostCollection, NextTID()}
+	p, err := preparePost(ctx, c, conn, u, p, highlightID)
+	if err != nil {
+		return nil, err
+	}
+
+	uri := u.String()
+	if _, err := conn.ReservePost(uri, p, highlightID); err != nil {
+		return nil, err
+	}
+
+	return sendReserved(ctx, c, conn, uri, p)
+}
+
+// function preparePost validates a post that will be created at u and adds
+// its facets and self-labels
+func preparePost(ctx context.Context, c *AtClient, conn *Connection, u ATURI, p Post, highlightID int64) (Post, error) {
+	// Invalid posts fail before handles are resolved for facets, and are
+	// never reserved, which would leave them to be marked failed
+	if err := c.ValidateRecord(PostCollection, u.Rkey, p); err != nil {
+		return p, err
+	}
+
+	if p.Facets == nil {
+		p.Facets = c.BuildFacets(ctx, p.Text)
+	}
+
+	if p.Labels == nil && highlightID != 0 {
+		labels, err := conn.GetHighlightLabels(highlightID)
+		if err != nil {
+			return p, err
+		}
+
+		p.Labels = NewSelfLabels(labels)
+	}
+
+	// Facets and self-labels are added after the first check, so they are
+	// checked again before the post is reserved
+	if err := c.ValidateRecord(PostCollection, u.Rkey, p); err != nil {
+		return p, err
+	}
+
+	return p, nil
+}
+
+// function isRejected reports whether the PDS will never accept the record,
+// e.g. it is invalid. Transient and authentication errors are not
+// rejections, the post can be sent again once they clear.
+func isRejected(err error) bool {
+	if _, retry := RetryAfter(err); retry || err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	for _, auth := range []error{ErrAuthRequired, ErrExpiredToken, ErrInvalidToken, ErrAuthFactorTokenRequired} {
+		if errors.Is(err, auth) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// function sendReserved creates a reserved post. A duplicate key means an
+// earlier attempt succeeded, so the existing record is confirmed instead.
+// A rejected post is marked failed so it does not hold up later posts.
+func sendReserved(ctx context.Context, c *AtClient, conn *Connection, uri string, p Post) (*StrongRef, error) {
+	u, err := ParseATURI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	ref, err := c.CreatePost(ctx, u.Rkey, p)
+	if isDuplicate(err) {
+		logger.Warnf("%v already exists, confirming it", uri)
+		var rec *Record
+		if rec, err = c.GetRecord(ctx, uri); err == nil {
+			ref = &StrongRef{rec.URI, rec.CID}
+		}
+	}
+
+	if isRejected(err) {
+		logger.Errorf("%v was rejected %v", uri, err.Error())
+		if failErr := conn.FailPost(uri); failErr != nil {
+			logger.Error(failErr)
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = conn.ConfirmPost(uri, ref.CID); err != nil {
+		logger.Errorf("posted %v but %v", ref.URI, err.Error())
+	}
+
+	if err = gatePost(ctx, c, conn, ref.URI, p); err != nil {
+		logger.Errorf("posted %v but %v", ref.URI, err.Error())
+	}
+
+	return ref, nil
+}
+
+// function threadReply fills in the CIDs of the root and parent of a thread
+// part, which are not known when the part is reserved, see [PublishEmbed].
+// It reports false when one of them was never sent.
+func threadReply(conn *Connection, reply *ReplyRef) (bool, error) {
+	if reply == nil {
+		return true, nil
+	}
+
+	for _, ref := range []*StrongRef{&reply.Root, &reply.Parent} {
+		if ref.CID != "" {
+			continue
+		}
+
+		row, err := conn.GetPost(ref.URI)
+		if err != nil {
+			return false, err
+		}
+
+		if row.CID == "" {
+			return false, nil
+		}
+
+		ref.CID = row.CID
+	}
+
+	return true, nil
+}
+
+// function ResumePendingPosts settles posts that were reserved but never
+// confirmed: those that reached the PDS are confirmed, the rest are sent
+// again with their original record key and content. Posts the PDS rejects,
+// and thread parts whose parent was rejected, are marked failed and
+// skipped; any other error stops the resume so it is tried again later.
+func ResumePendingPosts(ctx context.Context, c *AtClient, conn *Connection) error {
+	pending, err := conn.PendingPosts()
+	if err != nil {
+		return err
+	}
+
+	for _, p := range pending {
+		rec, err := c.GetRecord(ctx, p.URI)
+		switch {
+		case err == nil:
+			logger.Infof("confirming %v from an earlier attempt", p.URI)
+			if err = conn.ConfirmPost(p.URI, rec.CID); err == nil {
+				err = gatePost(ctx, c, conn, p.URI, p.Record)
+			}
+		case errors.Is(err, ErrRecordNotFound):
+			var posted bool
+			if posted, err = threadReply(conn, p.Record.Reply); err != nil {
+				break
+			} else if !posted {
+				logger.Errorf("%v was not resent, the post it replies to was never sent", p.URI)
+				err = conn.FailPost(p.URI)
+				break
+			}
+
+			logger.Infof("resending %v", p.URI)
+			if _, err = sendReserved(ctx, c, conn, p.URI, p.Record); isRejected(err) {
+				continue
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// function ParseATURI splits a record URI into its parts
+func ParseATURI(uri string) (*ATURI, error) {
+	rest, ok := strings.CutPrefix(uri, "at://")
+	parts := strings.Split(rest, "/")
+	if !ok || len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return nil, fmt.Errorf("invalid record uri %v", uri)
+	}
+
+	return &ATURI{parts[0], parts[1], parts[2]}, nil
+}
+
+func (u ATURI) String() string {
+	return fmt.Sprintf("at://%v/%v/%v", u.Repo, u.Collection, u.Rkey)
+}
+
+// function ListRecords returns a page of records in a collection of the
+// authenticated user's repo, newest first, via com.atproto.repo.listRecords
+func (c *AtClient) ListRecords(ctx context.Context, collection, cursor string, limit int) (*RepoListRecordsOutput, error) {
+	l := int64(limit)
+	params := RepoListRecordsParams{Repo: c.CurrentCredentials().DID, Collection: collection, Limit: &l, Cursor: cursor}
+
+	rsp, err := c.RepoListRecords(ctx, params)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list %v records %w", collection, err)
+	}
+
+	return rsp, nil
+}
+
+// function ListPosts pages through every app.bsky.feed.post record in the
+// authenticated user's repo
+func (c *AtClient) ListPosts(ctx context.Context) ([]Record, error) {
+	records := []Record{}
+	cursor := ""
+	for {
+		page, err := c.ListRecords(ctx, PostCollection, cursor, 100)
+		if err != nil {
+			return nil, err
+		}
+
+		records = append(records, page.Records...)
+		if page.Cursor == "" || len(page.Records) == 0 {
+			return records, nil
+		}
+
+		cursor = page.Cursor
+	}
+}
+
+// function DeleteRecord removes a record from the authenticated user's repo
+// via com.atproto.repo.deleteRecord
+func (c *AtClient) DeleteRecord(ctx context.Context, uri string) error {
+	u, err := ParseATURI(uri)
+	if err != nil {
+		return err
+	}
+
+	if did := c.CurrentCredentials().DID; u.Repo != did {
+		return fmt.Errorf("unable to delete %v: record is not in %v", uri, did)
+	}
+
+	_, err = c.RepoDeleteRecord(ctx, RepoDeleteRecordInput{Repo: u.Repo, Collection: u.Collection, Rkey: u.Rkey})
+	if err != nil {
+		return fmt.Errorf("unable to delete %v %w", uri, err)
+	}
+
+	logger.Infof("deleted record %v", uri)
+
+	return nil
+}
+
+// function DeletePost deletes a post and marks it as deleted locally, so its
+// highlight is not posted again
+func DeletePost(ctx context.Context, c *AtClient, conn *Connection, uri string) error {
+	if err := c.DeleteRecord(ctx, uri); err != nil {
+		return err
+	}
+
+	return conn.MarkPostDeleted(uri)
+}
+
+// struct postEmbed is the part of an embed reconciliation looks at. A quote
+// card that quotes another post has its images under Media, see
+// [RecordWithMediaEmbed].
+type postEmbed struct {
+	Images []struct {
+		Alt string `json:"alt"`
+	} `json:"images"`
+	Media *postEmbed `json:"media"`
+}
+
+// function matchHighlight finds the highlight a post was made for, either by
+// its quote card's alt text, or by its text being exactly the highlight as
+// posted, or the first part of it as a thread. Highlights posted without
+// their attribution are matched the same way.
+func matchHighlight(p Post, e postEmbed, highlights []Highlight) int64 {
+	images := e.Images
+	if e.Media != nil {
+		images = append(images, e.Media.Images...)
+	}
+
+	for _, img := range images {
+		for _, h := range highlights {
+			if img.Alt == h.Text {
+				return h.ID
+			}
+		}
+	}
+
+	text := strings.TrimSpace(p.Text)
+	for _, h := range highlights {
+		for _, posted := range []string{Quote{h.Text, h.Title, h.Authors}.PostText(), h.Text} {
+			if text == strings.TrimSpace(posted) || text == SplitThread(posted, MaxPostLength)[0] {
+				return h.ID
+			}
+		}
+	}
+
+	return 0
+}
+
+// struct ReconcileResult counts the changes made by [Reconcile]
+type ReconcileResult struct {
+	Remote   int
+	Restored int
+	Deleted  int
+}
+
+// function Reconcile compares the posts in the user's repo with the posts
+// table. Remote posts missing locally are restored and linked to the
+// highlight they were made for; local posts missing remotely are marked as
+// deleted, unless they are reserved and not yet sent. Either way their
+// highlights are not posted again.
+func Reconcile(ctx context.Context, c *AtClient, conn *Connection) (*ReconcileResult, error) {
+	records, err := c.ListPosts(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	local, err := conn.GetPosts()
+	if err != nil {
+		return nil, err
+	}
+
+	highlights, err := conn.GetHighlights()
+	if err != nil {
+		return nil, err
+	}
+
+	known := make(map[string]bool, len(local))
+	for _, p := range local {
+		known[p.URI] = true
+	}
+
+	r := ReconcileResult{Remote: len(records)}
+	remote := make(map[string]bool, len(records))
+	missing := []Record{}
+	posts := map[string]Post{}
+	for _, rec := range records {
+		remote[rec.URI] = true
+		if known[rec.URI] {
+			continue
+		}
+
+		p := Post{}
+		if err = json.Unmarshal(rec.Value, &p); err != nil {
+			logger.Warnf("skipping %v %v", rec.URI, err.Error())
+			continue
+		}
+
+		posts[rec.URI] = p
+		missing = append(missing, rec)
+	}
+
+	// Restore oldest first so thread roots come before their replies
+	sort.SliceStable(missing, func(i, j int) bool {
+		return posts[missing[i].URI].CreatedAt < posts[missing[j].URI].CreatedAt
+	})
+
+	for _, rec := range missing {
+		p := posts[rec.URI]
+		e := postEmbed{}
+		if raw, err := json.Marshal(p.Embed); err == nil {
+			json.Unmarshal(raw, &e)
+		}
+
+		highlightID := int64(0)
+		if p.Reply == nil {
+			highlightID = matchHighlight(p, e, highlights)
+		}
+
+		if _, err = conn.SavePost(StrongRef{rec.URI, rec.CID}, p, highlightID); err != nil {
+			return nil, err
+		}
+
+		r.Restored++
+	}
+
+	for _, p := range local {
+		// Reservations have not been sent yet, see [PostOnce]
+		if remote[p.URI] || !p.DeletedAt.IsZero() || p.CID == "" {
+			continue
+		}
+
+		if err = conn.MarkPostDeleted(p.URI); err != nil {
+			return nil, err
+		}
+
+		r.Deleted++
+	}
+
+	logger.Infof("reconciled %v remote posts, restored %v and marked %v deleted", r.Remote, r.Restored, r.Deleted)
+
+	return &r, nil
+}
+
+// function ManagePosts is the CLI entrypoint for the bot's own posts:
+//
+//	posts list
+//	posts delete <at-uri>...
+//	posts reconcile
+//	posts metrics
+//	posts throwback
+//	posts unrepost
+func ManagePosts(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: synapse posts list|delete|reconcile|metrics|throwback|unrepost")
+	}
+
+	ctx := context.Background()
+	conn, err := SelectAccount(CreateConnection(), selectedAccount)
+	if err != nil {
+		return err
+	}
+
+	c, err := Login(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "list", "ls":
+		records, err := c.ListPosts(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, rec := range records {
+			p := Post{}
+			json.Unmarshal(rec.Value, &p)
+			logger.Infof("%v %v %q", p.CreatedAt, rec.URI, p.Text)
+		}
+	case "delete", "rm":
+		for _, uri := range args[1:] {
+			if err = DeletePost(ctx, c, conn, uri); err != nil {
+				return err
+			}
+		}
+	case "reconcile":
+		_, err = Reconcile(ctx, c, conn)
+	case "metrics":
+		if _, err = SyncMetrics(ctx, c, conn, DefaultMetricsWindow); err != nil {
+			return err
+		}
+
+		top, err := conn.TopHighlights(10)
+		if err != nil {
+			return err
+		}
+
+		for _, e := range top {
+			m := e.Metrics
+			logger.Infof("%3d ♥%d ⟲%d ↩%d ❝%d %v %q", m.Score(), m.Likes, m.Reposts, m.Replies, m.Quotes, e.Title, e.Text)
+		}
+	case "throwback":
+		_, err = Throwback(ctx, c, conn, DefaultThrowbackAge)
+	case "unrepost":
+		var n int
+		if n, err = UndoReposts(ctx, c, conn, 0); err == nil {
+			logger.Infof("undid %v reposts", n)
+		}
+	default:
+		err = fmt.Errorf("unknown posts command %v", args[0])
+	}
+
+	return err
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// function testClient returns an authenticated [AtClient] pointed at srv
+func testClient(srv *httptest.Server) *AtClient {
+	c := NewClient(AtCredentials{
+		Handle:      "synapse.test",
+		AccessToken: "access",
+		DID:         "did:plc:synapse",
+	})
+	c.Service = srv.URL
+
+	return c
+}
+
+func TestCreatePost(t *testing.T) {
+	var got RepoCreateRecordInput
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/xrpc/"+CreateRecordMethod {
+			t.Errorf("unexpected path %v", r.URL.Path)
+		}
+
+		json.NewDecoder(r.Body).Decode(&got)
+		w.Write([]byte(`{"uri":"at://did:plc:synapse/app.bsky.feed.post/3k","cid":"bafy"}`))
+	}))
+
+	defer srv.Close()
+
+	conn := testConnection(t)
+	c := testClient(srv)
+	p := NewPost("We can give . . . our attention to the opportunity before us.")
+
+	ref, err := c.CreatePost(context.Background(), "", p)
+	if err != nil {
+		t.Fatalf("wanted no error but got %v", err.Error())
+	}
+
+	t.Run("record is written to the user's repo", func(t *testing.T) {
+		if got.Repo != "did:plc:synapse" || got.Collection != PostCollection {
+			t.Errorf("unexpected request %+v", got)
+		}
+
+		record := map[string]interface{}{}
+		json.Unmarshal(got.Record, &record)
+		if record["$type"] != PostCollection || record["text"] != p.Text {
+			t.Errorf("unexpected record %v", record)
+		}
+	})
+
+	t.Run("post is recorded in the database", func(t *testing.T) {
+		id, err := conn.SavePost(*ref, p, 0)
+		if err != nil || id == 0 {
+			t.Errorf("wanted post to be saved but got %v %v", id, err)
+		}
+	})
+}
+
+func TestReconcile(t *testing.T) {
+	conn := testConnection(t)
+	b := &Bookcision{ASIN: "B00KWG9M2E", Title: "Getting Things Done", Authors: "David Allen", Highlights: []BookcisionHighlight{
+		{Text: "Your mind is for having ideas, not holding them."},
+		{Text: "We can give . . . our attention to the opportunity before us."},
+		{Text: "Capture everything that has your attention."},
+		{Text: "Your mind is for having ideas, not holding them. It is for thinking."},
+		{Text: "Use your mind to think about things, rather than think of them."},
+	}}
+
+	if _, err := ImportBookcision(conn, b); err != nil {
+		t.Fatalf("test setup failed %v", err.Error())
+	}
+
+	root := StrongRef{"at://did:plc:synapse/app.bsky.feed.post/3", "cid3"}
+	remote := []map[string]interface{}{
+		{"uri": "at://did:plc:synapse/app.bsky.feed.post/4", "cid": "cid4", "value": Post{Text: "part two (2/2)", CreatedAt: "2024-01-03T00:00:01Z", Reply: &ReplyRef{root, root}}},
+		{"uri": root.URI, "cid": root.CID, "value": Post{Text: "Your mind is for having ideas, not holding them.\n\n— David Allen, Getting Things Done", CreatedAt: "2024-01-03T00:00:00Z"}},
+		{"uri": "at://did:plc:synapse/app.bsky.feed.post/6", "cid": "cid6", "value": Post{Text: "Your mind is for having ideas, not holding them. It is for thinking.\n\n— David Allen, Getting Things Done", CreatedAt: "2024-01-04T00:00:00Z"}},
+		{"uri": "at://did:plc:synapse/app.bsky.feed.post/1", "cid": "cid1", "value": map[string]interface{}{
+			"text":      "— David Allen, Getting Things Done",
+			"createdAt": "2024-01-02T00:00:00Z",
+			"embed":     NewImagesEmbed(EmbedImage{Alt: "We can give . . . our attention to the opportunity before us."}),
+		}},
+		{"uri": "at://did:plc:synapse/app.bsky.feed.post/7", "cid": "cid7", "value": map[string]interface{}{
+			"text":      "— David Allen, Getting Things Done",
+			"createdAt": "2024-01-05T00:00:00Z",
+			"embed":     NewQuoteEmbed(root, NewImagesEmbed(EmbedImage{Alt: "Use your mind to think about things, rather than think of them."})),
+		}},
+	}
+
+	deleted := []RepoDeleteRecordInput{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/xrpc/" + ListRecordsMethod:
+			if r.URL.Query().Get("cursor") == "" {
+				json.NewEncoder(w).Encode(map[string]interface{}{"cursor": "next", "records": remote[:2]})
+			} else {
+				json.NewEncoder(w).Encode(map[string]interface{}{"records": remote[2:]})
+			}
+		case "/xrpc/" + DeleteRecordMethod:
+			req := RepoDeleteRecordInput{}
+			json.NewDecoder(r.Body).Decode(&req)
+			deleted = append(deleted, req)
+			w.Write([]byte(`{}`))
+		}
+	}))
+
+	defer srv.Close()
+
+	c := testClient(srv)
+	lost := StrongRef{"at://did:plc:synapse/app.bsky.feed.post/0", "cid0"}
+	conn.SavePost(lost, NewPost("deleted from another client"), 0)
+	pending := "at://did:plc:synapse/app.bsky.feed.post/5"
+	conn.ReservePost(pending, NewPost("reserved but not sent"), 0)
+
+	r, err := Reconcile(context.Background(), c, conn)
+	if err != nil {
+		t.Fatalf("wanted no error but got %v", err.Error())
+	}
+
+	t.Run("remote posts are restored", func(t *testing.T) {
+		if r.Remote != 5 || r.Restored != 5 || r.Deleted != 1 {
+			t.Errorf("unexpected result %+v", r)
+		}
+
+		thread, _ := conn.GetThread(root.URI)
+		if len(thread) != 2 || thread[1].ParentURI != root.URI {
+			t.Errorf("wanted the thread to be restored but got %+v", thread)
+		}
+	})
+
+	t.Run("restored posts are linked to their highlights", func(t *testing.T) {
+		h, err := conn.NextHighlight()
+		if err != nil || h.Text != "Capture everything that has your attention." {
+			t.Errorf("wanted only the unposted highlight to remain but got %+v %v", h, err)
+		}
+
+		for uri, want := range map[string]string{
+			root.URI: "Your mind is for having ideas, not holding them.",
+			"at://did:plc:synapse/app.bsky.feed.post/6": "Your mind is for having ideas, not holding them. It is for thinking.",
+			"at://did:plc:synapse/app.bsky.feed.post/7": "Use your mind to think about things, rather than think of them.",
+		} {
+			if posted, _ := conn.PostedHighlight(uri); posted == nil || posted.Text != want {
+				t.Errorf("wanted %v to be linked to %q but got %+v", uri, want, posted)
+			}
+		}
+	})
+
+	t.Run("reservations are not marked deleted", func(t *testing.T) {
+		posts, _ := conn.PendingPosts()
+		if len(posts) != 1 || posts[0].URI != pending {
+			t.Errorf("wanted the reservation to stay pending but got %+v", posts)
+		}
+	})
+
+	t.Run("reconciling again changes nothing", func(t *testing.T) {
+		again, err := Reconcile(context.Background(), c, conn)
+		if err != nil || again.Restored != 0 || again.Deleted != 0 {
+			t.Errorf("unexpected result %+v %v", again, err)
+		}
+	})
+
+	t.Run("deleted posts stay recorded", func(t *testing.T) {
+		if err := DeletePost(context.Background(), c, conn, root.URI); err != nil {
+			t.Fatalf("wanted no error but got %v", err.Error())
+		}
+
+		if len(deleted) != 1 || deleted[0].Rkey != "3" || deleted[0].Collection != PostCollection {
+			t.Errorf("unexpected delete request %+v", deleted)
+		}
+
+		thread, _ := conn.GetThread(root.URI)
+		if thread[0].DeletedAt.IsZero() {
+			t.Errorf("wanted post to be marked deleted")
+		}
+	})
+
+	t.Run("records in other repos are not deleted", func(t *testing.T) {
+		if err := c.DeleteRecord(context.Background(), "at://did:plc:other/app.bsky.feed.post/1"); err == nil {
+			t.Errorf("wanted an error")
+		}
+	})
+}
+
+func TestPostOnce(t *testing.T) {
+	records := map[string]string{}
+	drop := 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/xrpc/" + string(CreateRecordMethod):
+			req := RepoCreateRecordInput{}
+			json.NewDecoder(r.Body).Decode(&req)
+			uri := ATURI{req.Repo, req.Collection, req.Rkey}.String()
+			if _, ok := records[uri]; ok {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":"InvalidSwap","message":"Record already exists"}`))
+				return
+			}
+
+			p := Post{}
+			json.Unmarshal(req.Record, &p)
+			if p.Text == "rejected" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":"InvalidRequest","message":"Invalid record"}`))
+				return
+			}
+
+			records[uri] = "cid" + req.Rkey
+			if drop > 0 {
+				drop--
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+
+			json.NewEncoder(w).Encode(StrongRef{uri, records[uri]})
+		case "/xrpc/" + string(GetRecordMethod):
+			q := r.URL.Query()
+			uri := ATURI{q.Get("repo"), q.Get("collection"), q.Get("rkey")}.String()
+			cid, ok := records[uri]
+			if !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":"RecordNotFound","message":"Could not locate record"}`))
+				return
+			}
+
+			json.NewEncoder(w).Encode(map[string]interface{}{"uri": uri, "cid": cid, "value": map[string]string{}})
+		default:
+			t.Errorf("unexpected path %v", r.URL.Path)
+		}
+	}))
+
+	defer srv.Close()
+
+	ctx := context.Background()
+	conn := testConnection(t)
+	c := testClient(srv)
+
+	t.Run("lost response leaves a pending post", func(t *testing.T) {
+		if _, err := PostOnce(ctx, c, conn, NewPost("Capture everything."), 0); err == nil {
+			t.Fatal("wanted an error but got none")
+		}
+
+		pending, err := conn.PendingPosts()
+		if err != nil || len(pending) != 1 {
+			t.Fatalf("wanted 1 pending post but got %v %v", len(pending), err)
+		}
+	})
+
+	t.Run("resuming confirms the existing record", func(t *testing.T) {
+		if err := ResumePendingPosts(ctx, c, conn); err != nil {
+			t.Fatalf("wanted no error but got %v", err.Error())
+		}
+
+		if len(records) != 1 {
+			t.Errorf("wanted 1 remote record but got %v", len(records))
+		}
+
+		posts, _ := conn.GetPosts()
+		if len(posts) != 1 || posts[0].CID == "" {
+			t.Errorf("wanted a confirmed post but got %+v", posts)
+		}
+	})
+
+	t.Run("missing records are sent again under the same key", func(t *testing.T) {
+		uri := ATURI{"did:plc:synapse", PostCollection, NextTID()}.String()
+		if _, err := conn.ReservePost(uri, NewPost("Your mind is for having ideas."), 0); err != nil {
+			t.Fatalf("test setup failed %v", err.Error())
+		}
+
+		if err := ResumePendingPosts(ctx, c, conn); err != nil {
+			t.Fatalf("wanted no error but got %v", err.Error())
+		}
+
+		if _, ok := records[uri]; !ok {
+			t.Errorf("wanted %v to be created", uri)
+		}
+
+		if pending, _ := conn.PendingPosts(); len(pending) != 0 {
+			t.Errorf("wanted no pending posts but got %v", len(pending))
+		}
+	})
+
+	t.Run("duplicate keys are confirmed", func(t *testing.T) {
+		uri := ATURI{"did:plc:synapse", PostCollection, NextTID()}.String()
+		records[uri] = "cid-existing"
+		p := NewPost("We can give our attention.")
+		if _, err := conn.ReservePost(uri, p, 0); err != nil {
+			t.Fatalf("test setup failed %v", err.Error())
+		}
+
+		ref, err := sendReserved(ctx, c, conn, uri, p)
+		if err != nil || ref.CID != "cid-existing" {
+			t.Errorf("wanted existing record but got %v %v", ref, err)
+		}
+	})
+
+	t.Run("rejected posts do not hold up the queue", func(t *testing.T) {
+		rejected := ATURI{"did:plc:synapse", PostCollection, NextTID()}.String()
+		conn.ReservePost(rejected, NewPost("rejected"), 0)
+		lost := ATURI{"did:plc:synapse", PostCollection, NextTID()}.String()
+		conn.ReservePost(lost, NewPost("Capture everything that has your attention."), 0)
+
+		if err := ResumePendingPosts(ctx, c, conn); err != nil {
+			t.Fatalf("wanted no error but got %v", err.Error())
+		}
+
+		if _, ok := records[lost]; !ok {
+			t.Errorf("wanted %v to be sent after the rejected post", lost)
+		}
+
+		if pending, _ := conn.PendingPosts(); len(pending) != 0 {
+			t.Errorf("wanted no pending posts but got %+v", pending)
+		}
+
+		if _, err := PostOnce(ctx, c, conn, NewPost("rejected"), 0); err == nil {
+			t.Errorf("wanted an error but got none")
+		}
+
+		if pending, _ := conn.PendingPosts(); len(pending) != 0 {
+			t.Errorf("wanted the rejected post to be marked failed but got %+v", pending)
+		}
+	})
+
+	t.Run("invalid posts are neither reserved nor sent", func(t *testing.T) {
+		before, _ := conn.GetPosts()
+		sent := len(records)
+
+		_, err := PostOnce(ctx, c, conn, NewPost("@reader.test "+strings.Repeat("Capture everything. ", 20)), 0)
+		if !errors.Is(err, ErrInvalidRecord) {
+			t.Errorf("wanted an invalid record but got %v", err)
+		}
+
+		if after, _ := conn.GetPosts(); len(after) != len(before) || len(records) != sent {
+			t.Errorf("wanted nothing to be reserved or sent but got %v posts and %v records", len(after), len(records))
+		}
+	})
+
+	t.Run("transient errors leave the post pending", func(t *testing.T) {
+		drop = 1
+		if _, err := PostOnce(ctx, c, conn, NewPost("Your mind is for having ideas."), 0); err == nil {
+			t.Fatal("wanted an error but got none")
+		}
+
+		if pending, _ := conn.PendingPosts(); len(pending) != 1 {
+			t.Errorf("wanted 1 pending post but got %+v", pending)
+		}
+	})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	Postable    PostStatus = "postable"
+	NeedsThread PostStatus = "needs-thread"
+	NeedsImage  PostStatus = "needs-image"
+)
+
+const (
+	// MaxPostBytes is the byte limit on app.bsky.feed.post text
+	MaxPostBytes int = 3000
+	// MaxThreadParts is the longest thread synapse will post before
+	// rendering the highlight as an image instead
+	MaxThreadParts int = 4
+)
+
+// PostStatus describes how a highlight can be sent to BlueSky
+type PostStatus = string
+
+// struct PreflightResult is the outcome of checking a highlight before posting
+type PreflightResult struct {
+	Status    PostStatus
+	Graphemes int
+	Bytes     int
+	Parts     int
+}
+
+func (r PreflightResult) String() string {
+	return fmt.Sprintf("%v (%v graphemes, %v bytes, %v parts)", r.Status, r.Graphemes, r.Bytes, r.Parts)
+}
+
+// function Preflight classifies text as postable as-is, postable as a thread
+// or too long for a thread, in which case it needs an image
+func Preflight(text string) (PreflightResult, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return PreflightResult{}, fmt.Errorf("unable to post empty text")
+	}
+
+	r := PreflightResult{
+		Graphemes: PostLength(text),
+		Bytes:     len(text),
+		Parts:     1,
+	}
+
+	switch {
+	case fits(text, MaxPostLength, MaxPostBytes):
+		r.Status = Postable
+	default:
+		r.Parts = len(SplitThread(text, MaxPostLength))
+		if r.Parts > MaxThreadParts {
+			r.Status = NeedsImage
+		} else {
+			r.Status = NeedsThread
+		}
+	}
+
+	return r, nil
+}
+
+// function Check is the CLI entrypoint for running [Preflight] against text
+// passed as arguments
+func Check(args []string) error {
+	text := strings.Join(args, " ")
+	r, err := Preflight(text)
+	if err != nil {
+		return err
+	}
+
+	logger.Info(r.String())
+
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPreflight(t *testing.T) {
+	for _, tc := range []struct {
+		desc string
+		text string
+		want PostStatus
+	}{
+		{"short highlight", "We can give . . . our attention to the opportunity before us.", Postable},
+		{"emoji at the limit", strings.Repeat("👨‍👩‍👧", MaxPostLength), NeedsThread},
+		{"long highlight", strings.Repeat("Capture everything that has your attention. ", 15), NeedsThread},
+		{"very long highlight", strings.Repeat("Capture everything that has your attention. ", 40), NeedsImage},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			got, err := Preflight(tc.text)
+			if err != nil {
+				t.Fatalf("wanted no error but got %v", err.Error())
+			}
+
+			if got.Status != tc.want {
+				t.Errorf("wanted %v but got %v", tc.want, got)
+			}
+		})
+	}
+
+	t.Run("emoji threads fit the byte limit", func(t *testing.T) {
+		parts := SplitThread(strings.Repeat("👨‍👩‍👧", MaxPostLength), MaxPostLength)
+		if len(parts) < 2 {
+			t.Fatalf("wanted a thread but got %v parts", len(parts))
+		}
+
+		for i, p := range parts {
+			if len(p) > MaxPostBytes || PostLength(p) > MaxPostLength {
+				t.Errorf("part %v is too long (%v bytes, %v graphemes)", i+1, len(p), PostLength(p))
+			}
+		}
+	})
+
+	t.Run("empty text is rejected", func(t *testing.T) {
+		if _, err := Preflight("  "); err == nil {
+			t.Errorf("wanted an error")
+		}
+	})
+}
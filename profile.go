@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	ProfileCollection string = "app.bsky.actor.profile"
+	// ProfileRkey is the key of the only profile record in a repo
+	ProfileRkey string = "self"
+
+	MaxDisplayNameLength int = 64
+	MaxDescriptionLength int = 256
+
+	// MaxProfileAttempts is how often an update is retried after the profile
+	// changed between reading and writing it
+	MaxProfileAttempts int = 3
+)
+
+// Matches the line [StatsLine] writes, so the bio keeps any other text
+var statsPattern = regexp.MustCompile(`(?m)^Sharing [\d,]+ highlights? from [\d,]+ books?\.?$`)
+
+// struct Profile is the part of an app.bsky.actor.profile record the bot
+// edits. The record it was read from is kept, so writing it back leaves the
+// other fields, including ones the bot doesn't know of, as they were.
+type Profile struct {
+	Type        string `json:"$type"`
+	DisplayName string `json:"displayName,omitempty"`
+	Description string `json:"description,omitempty"`
+	Avatar      *Blob  `json:"avatar,omitempty"`
+	Banner      *Blob  `json:"banner,omitempty"`
+
+	record map[string]json.RawMessage
+	// read is the profile as it was in record
+	read *Profile
+}
+
+type profileJSON Profile
+
+func (p *Profile) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &p.record); err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(data, (*profileJSON)(p)); err != nil {
+		return err
+	}
+
+	read := *p
+	read.record, read.read = nil, nil
+	p.read = &read
+
+	return nil
+}
+
+// function MarshalJSON writes the record that was read with only the fields
+// that were edited replaced
+func (p Profile) MarshalJSON() ([]byte, error) {
+	was := Profile{}
+	if p.read != nil {
+		was = *p.read
+	}
+
+	record := maps.Clone(p.record)
+	if record == nil {
+		record = map[string]json.RawMessage{}
+	}
+
+	edits := []struct {
+		key            string
+		changed, empty bool
+		value          interface{}
+	}{
+		{"$type", p.Type != was.Type, p.Type == "", p.Type},
+		{"displayName", p.DisplayName != was.DisplayName, p.DisplayName == "", p.DisplayName},
+		{"description", p.Description != was.Description, p.Description == "", p.Description},
+		{"avatar", !sameBlob(p.Avatar, was.Avatar), p.Avatar == nil, p.Avatar},
+		{"banner", !sameBlob(p.Banner, was.Banner), p.Banner == nil, p.Banner},
+	}
+
+	for _, e := range edits {
+		if !e.changed {
+			continue
+		}
+
+		if e.empty {
+			delete(record, e.key)
+			continue
+		}
+
+		v, err := json.Marshal(e.value)
+		if err != nil {
+			return nil, err
+		}
+
+		record[e.key] = v
+	}
+
+	return json.Marshal(record)
+}
+
+func sameBlob(a, b *Blob) bool {
+	return a == b || (a != nil && b != nil && *a == *b)
+}
+
+// function Validate checks the lengths the lexicon allows, in graphemes
+func (p Profile) Validate() error {
+	if n := GraphemeCount(p.DisplayName); n > MaxDisplayNameLength {
+		return fmt.Errorf("display name is %v characters, at most %v are allowed", n, MaxDisplayNameLength)
+	}
+
+	if n := GraphemeCount(p.Description); n > MaxDescriptionLength {
+		return fmt.Errorf("description is %v characters, at most %v are allowed", n, MaxDescriptionLength)
+	}
+
+	return nil
+}
+
+// function GetProfile fetches the authenticated user's profile record and
+// its CID. An account without a profile gets an empty one and no CID.
+func (c *AtClient) GetProfile(ctx context.Context) (*Profile, string, error) {
+	uri := ATURI{c.CurrentCredentials().DID, ProfileCollection, ProfileRkey}.String()
+	p := Profile{Type: ProfileCollection}
+
+	rec, err := c.GetRecord(ctx, uri)
+	if errors.Is(err, ErrRecordNotFound) {
+		return &p, "", nil
+	} else if err != nil {
+		return nil, "", err
+	}
+
+	if err = json.Unmarshal(rec.Value, &p); err != nil {
+		return nil, "", fmt.Errorf("unable to read profile %v", err.Error())
+	}
+
+	return &p, rec.CID, nil
+}
+
+// function PutProfile replaces the profile record, failing with
+// [ErrInvalidSwap] when swap is not the CID of the current one
+func (c *AtClient) PutProfile(ctx context.Context, p Profile, swap string) (*StrongRef, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+
+	p.Type = ProfileCollection
+
+	return c.PutRecord(ctx, ProfileCollection, ProfileRkey, p, swap)
+}
+
+// function UpdateProfile applies edit to the current profile and writes it
+// back if edit reports a change. The write is swapped against the profile
+// that was read, so edits made elsewhere in between are not overwritten;
+// the update starts over instead.
+func UpdateProfile(ctx context.Context, c *AtClient, edit func(p *Profile) (bool, error)) (*StrongRef, error) {
+	for attempt := 1; ; attempt++ {
+		p, cid, err := c.GetProfile(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		changed, err := edit(p)
+		if err != nil || !changed {
+			return nil, err
+		}
+
+		ref, err := c.PutProfile(ctx, *p, cid)
+		if !errors.Is(err, ErrInvalidSwap) || attempt >= MaxProfileAttempts {
+			return ref, err
+		}
+
+		logger.Warnf("profile changed while updating it, retrying")
+	}
+}
+
+// function UploadImage uploads a PNG or JPEG file for use as an avatar or
+// banner
+func (c *AtClient) UploadImage(ctx context.Context, path string) (*Blob, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read image %v", err.Error())
+	}
+
+	mimeType := http.DetectContentType(data)
+	if mimeType != "image/png" && mimeType != "image/jpeg" {
+		return nil, fmt.Errorf("unable to use %v: %v is not a PNG or JPEG image", path, mimeType)
+	}
+
+	if len(data) > MaxBlobSize {
+		return nil, fmt.Errorf("unable to use %v: %v bytes is over the %v byte limit", path, len(data), MaxBlobSize)
+	}
+
+	return c.UploadBlob(ctx, data, mimeType)
+}
+
+// function FormatCount writes n with thousands separators, e.g. 1,204
+func FormatCount(n int) string {
+	if n < 0 {
+		return "-" + FormatCount(-n)
+	}
+
+	s := strconv.Itoa(n)
+
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+
+	return s
+}
+
+func plural(n int, word string) string {
+	if n == 1 {
+		return FormatCount(n) + " " + word
+	}
+
+	return FormatCount(n) + " " + word + "s"
+}
+
+// function StatsLine describes the library, e.g. "Sharing 1,204 highlights
+// from 37 books"
+func StatsLine(s LibraryStats) string {
+	return fmt.Sprintf("Sharing %v from %v", plural(s.Highlights, "highlight"), plural(s.Books, "book"))
+}
+
+// function WithStats replaces the stats line in a bio, or appends one
+func WithStats(description string, s LibraryStats) string {
+	line := StatsLine(s)
+	if statsPattern.MatchString(description) {
+		return statsPattern.ReplaceAllLiteralString(description, line)
+	}
+
+	if strings.TrimSpace(description) == "" {
+		return line
+	}
+
+	return strings.TrimRight(description, "\n") + "\n\n" + line
+}
+
+// function RefreshBio keeps the stats line in the profile description up to
+// date with the database. The profile is left alone when nothing changed.
+func RefreshBio(ctx context.Context, c *AtClient, conn *Connection) error {
+	s, err := conn.LibraryStats()
+	if err != nil {
+		return err
+	}
+
+	ref, err := UpdateProfile(ctx, c, func(p *Profile) (bool, error) {
+		description := WithStats(p.Description, s)
+		if description == p.Description {
+			return false, nil
+		}
+
+		p.Description = description
+
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if ref != nil {
+		logger.Infof("updated bio: %v", StatsLine(s))
+	}
+
+	return nil
+}
+
+// function ManageProfile is the CLI entrypoint for the bot's profile:
+//
+//	profile show
+//	profile set [--name n] [--description d] [--avatar file] [--banner file]
+//	profile bio
+func ManageProfile(args []string) error {
+	usage := fmt.Errorf("usage: synapse profile show|set [--name n] [--description d] [--avatar file] [--banner file]|bio")
+	if len(args) == 0 {
+		return usage
+	}
+
+	ctx := context.Background()
+	conn, err := SelectAccount(CreateConnection(), selectedAccount)
+	if err != nil {
+		return err
+	}
+
+	c, err := Login(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "show":
+		p, cid, err := c.GetProfile(ctx)
+		if err != nil {
+			return err
+		}
+
+		logger.Infof("%v (%v)\n%v", p.DisplayName, cid, p.Description)
+	case "set":
+		edit, err := profileEdit(ctx, c, args[1:])
+		if errors.Is(err, errMissingValue) {
+			return usage
+		} else if err != nil {
+			return err
+		}
+
+		ref, err := UpdateProfile(ctx, c, edit)
+		if err != nil {
+			return err
+		} else if ref == nil {
+			logger.Info("profile unchanged")
+			return nil
+		}
+
+		logger.Info("updated profile")
+	case "bio":
+		return RefreshBio(ctx, c, conn)
+	default:
+		return usage
+	}
+
+	return nil
+}
+
+// errMissingValue is returned for an option of profile set given without
+// its value, e.g. a trailing --avatar
+var errMissingValue = errors.New("missing option value")
+
+// function profileEdit reads the options of profile set. Images are uploaded
+// once up front, not on every attempt of [UpdateProfile].
+func profileEdit(ctx context.Context, c *AtClient, args []string) (func(p *Profile) (bool, error), error) {
+	var name, description *string
+	var avatar, banner *Blob
+	for i := 0; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			return nil, fmt.Errorf("%w for %v", errMissingValue, args[i])
+		}
+
+		val := args[i+1]
+		switch args[i] {
+		case "--name", "-name":
+			name = &val
+		case "--description", "-description", "--bio", "-bio":
+			description = &val
+		case "--avatar", "-avatar", "--banner", "-banner":
+			blob, err := c.UploadImage(ctx, val)
+			if err != nil {
+				return nil, err
+			}
+
+			if strings.HasSuffix(args[i], "avatar") {
+				avatar = blob
+			} else {
+				banner = blob
+			}
+		default:
+			return nil, fmt.Errorf("unknown option %v", args[i])
+		}
+	}
+
+	// Only the fields that differ count as a change, so nothing is written
+	// when no option is given or the profile already matches
+	return func(p *Profile) (bool, error) {
+		changed := false
+		if name != nil && p.DisplayName != *name {
+			p.DisplayName, changed = *name, true
+		}
+
+		if description != nil && p.Description != *description {
+			p.Description, changed = *description, true
+		}
+
+		if avatar != nil && (p.Avatar == nil || p.Avatar.Ref != avatar.Ref) {
+			p.Avatar, changed = avatar, true
+		}
+
+		if banner != nil && (p.Banner == nil || p.Banner.Ref != banner.Ref) {
+			p.Banner, changed = banner, true
+		}
+
+		return changed, nil
+	}, nil
+}
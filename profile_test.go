@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWithStats(t *testing.T) {
+	s := LibraryStats{Books: 37, Highlights: 1204}
+	tests := []struct {
+		name, description, want string
+	}{
+		{"an empty bio", "", "Sharing 1,204 highlights from 37 books"},
+		{"a bio without stats", "Notes from my Kindle\n", "Notes from my Kindle\n\nSharing 1,204 highlights from 37 books"},
+		{"a bio with old stats", "Notes\nSharing 12 highlights from 1 book\nBy @me", "Notes\nSharing 1,204 highlights from 37 books\nBy @me"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := WithStats(tt.description, s); got != tt.want {
+				t.Errorf("wanted %q but got %q", tt.want, got)
+			}
+		})
+	}
+
+	t.Run("counts are formatted", func(t *testing.T) {
+		for n, want := range map[int]string{0: "0", 999: "999", 1000: "1,000", 1234567: "1,234,567", -1204: "-1,204"} {
+			if got := FormatCount(n); got != want {
+				t.Errorf("wanted %v but got %v", want, got)
+			}
+		}
+	})
+}
+
+// fakeProfile is a PDS holding a single profile record that enforces swaps
+type fakeProfile struct {
+	record json.RawMessage
+	cid    int
+	puts   []RepoPutRecordInput
+	// conflicts is how many puts are rejected as if the profile was edited
+	conflicts int
+}
+
+func (f *fakeProfile) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/xrpc/" + GetRecordMethod:
+		if f.record == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"RecordNotFound"}`))
+			return
+		}
+
+		json.NewEncoder(w).Encode(Record{"at://did:plc:synapse/app.bsky.actor.profile/self", fmt.Sprint(f.cid), f.record})
+	case "/xrpc/" + PutRecordMethod:
+		req := RepoPutRecordInput{}
+		json.NewDecoder(r.Body).Decode(&req)
+		f.puts = append(f.puts, req)
+
+		current := ""
+		if f.record != nil {
+			current = fmt.Sprint(f.cid)
+		}
+
+		if f.conflicts > 0 || req.SwapRecord != current {
+			f.conflicts--
+			f.cid++
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"InvalidSwap"}`))
+			return
+		}
+
+		f.record = req.Record
+		f.cid++
+		json.NewEncoder(w).Encode(StrongRef{"at://did:plc:synapse/app.bsky.actor.profile/self", fmt.Sprint(f.cid)})
+	case "/xrpc/" + UploadBlobMethod:
+		json.NewEncoder(w).Encode(RepoUploadBlobOutput{Blob{"blob", BlobRef{"bafkavatar"}, r.Header.Get("Content-Type"), 8}})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestRefreshBio(t *testing.T) {
+	conn := testConnection(t)
+	b := &Bookcision{ASIN: "B00KWG9M2E", Title: "Getting Things Done", Authors: "David Allen", Highlights: []BookcisionHighlight{
+		{Text: "Your mind is for having ideas, not holding them."},
+		{Text: "Capture everything that has your attention."},
+	}}
+
+	if _, err := ImportBookcision(conn, b); err != nil {
+		t.Fatalf("test setup failed %v", err.Error())
+	}
+
+	f := &fakeProfile{}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	ctx := context.Background()
+	c := testClient(srv)
+
+	t.Run("a missing profile is created", func(t *testing.T) {
+		if err := RefreshBio(ctx, c, conn); err != nil {
+			t.Fatalf("wanted no error but got %v", err.Error())
+		}
+
+		p, _, _ := c.GetProfile(ctx)
+		if p.Description != "Sharing 2 highlights from 1 book" || f.puts[0].SwapRecord != "" {
+			t.Errorf("unexpected profile %+v", p)
+		}
+	})
+
+	t.Run("an unchanged bio is not written", func(t *testing.T) {
+		if err := RefreshBio(ctx, c, conn); err != nil || len(f.puts) != 1 {
+			t.Errorf("wanted 1 put but got %v %v", len(f.puts), err)
+		}
+	})
+
+	t.Run("other fields are kept", func(t *testing.T) {
+		f.record = json.RawMessage(`{"$type":"app.bsky.actor.profile","displayName":"Synapse","description":"Sharing 2 highlights from 1 book","pinnedPost":{"uri":"at://did:plc:synapse/app.bsky.feed.post/1","cid":"bafkpost"},"avatar":{"$type":"blob","ref":{"$link":"bafkreiavatar"},"mimeType":"image/png","size":8},"pronouns":"it/its"}`)
+		b.Highlights = append(b.Highlights, BookcisionHighlight{Text: "Use your mind to think about things, rather than think of them."})
+		ImportBookcision(conn, b)
+
+		if err := RefreshBio(ctx, c, conn); err != nil {
+			t.Fatalf("wanted no error but got %v", err.Error())
+		}
+
+		got := map[string]json.RawMessage{}
+		json.Unmarshal(f.record, &got)
+
+		want := map[string]string{
+			"displayName": `"Synapse"`,
+			"description": `"Sharing 3 highlights from 1 book"`,
+			"pinnedPost":  `{"uri":"at://did:plc:synapse/app.bsky.feed.post/1","cid":"bafkpost"}`,
+			"avatar":      `{"$type":"blob","ref":{"$link":"bafkreiavatar"},"mimeType":"image/png","size":8}`,
+			"pronouns":    `"it/its"`,
+		}
+
+		for k, v := range want {
+			if string(got[k]) != v {
+				t.Errorf("wanted %v to be %v but got %s", k, v, got[k])
+			}
+		}
+	})
+
+	t.Run("writes are swapped against the profile that was read", func(t *testing.T) {
+		f.puts, f.conflicts = nil, 1
+		_, err := UpdateProfile(ctx, c, func(p *Profile) (bool, error) {
+			p.DisplayName = "Synapse Bot"
+			return true, nil
+		})
+
+		if err != nil || len(f.puts) != 2 || f.puts[1].SwapRecord != fmt.Sprint(f.cid-1) {
+			t.Errorf("wanted a retry against the new CID but got %+v %v", f.puts, err)
+		}
+	})
+
+	t.Run("too many conflicts fail", func(t *testing.T) {
+		f.puts, f.conflicts = nil, MaxProfileAttempts
+		_, err := UpdateProfile(ctx, c, func(p *Profile) (bool, error) { return true, nil })
+		if len(f.puts) != MaxProfileAttempts || err == nil {
+			t.Errorf("wanted %v attempts but got %v %v", MaxProfileAttempts, len(f.puts), err)
+		}
+	})
+
+	t.Run("avatars are uploaded as blobs", func(t *testing.T) {
+		png := filepath.Join(t.TempDir(), "avatar.png")
+		os.WriteFile(png, []byte("\x89PNG\r\n\x1a\n"), 0o644)
+		f.conflicts = 0
+
+		edit, err := profileEdit(ctx, c, []string{"--avatar", png, "--name", "Synapse"})
+		if err != nil {
+			t.Fatalf("wanted no error but got %v", err.Error())
+		}
+
+		if _, err = UpdateProfile(ctx, c, edit); err != nil {
+			t.Fatalf("wanted no error but got %v", err.Error())
+		}
+
+		p, _, _ := c.GetProfile(ctx)
+		if p.Avatar == nil || p.Avatar.Ref.Link != "bafkavatar" || p.Avatar.MimeType != "image/png" {
+			t.Errorf("unexpected avatar %+v", p.Avatar)
+		}
+	})
+
+	t.Run("edits that change nothing are not written", func(t *testing.T) {
+		f.puts = nil
+		for _, args := range [][]string{{}, {"--name", "Synapse"}} {
+			edit, err := profileEdit(ctx, c, args)
+			if err != nil {
+				t.Fatalf("wanted no error but got %v", err.Error())
+			}
+
+			if ref, err := UpdateProfile(ctx, c, edit); ref != nil || err != nil {
+				t.Errorf("wanted no write for %v but got %v %v", args, ref, err)
+			}
+		}
+
+		if len(f.puts) != 0 {
+			t.Errorf("wanted no writes but got %v", len(f.puts))
+		}
+	})
+
+	t.Run("options without a value are rejected", func(t *testing.T) {
+		if _, err := profileEdit(ctx, c, []string{"--name", "Synapse", "--avatar"}); !errors.Is(err, errMissingValue) {
+			t.Errorf("wanted a missing value error but got %v", err)
+		}
+	})
+
+	t.Run("other files are rejected", func(t *testing.T) {
+		txt := filepath.Join(t.TempDir(), "avatar.txt")
+		os.WriteFile(txt, []byte("hello"), 0o644)
+
+		if _, err := c.UploadImage(ctx, txt); err == nil {
+			t.Errorf("wanted an error but got none")
+		}
+	})
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	_ "embed"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+)
+
+const DefaultPort int = 8080
+
+//go:embed templates/login.html
+var loginHTML string
+
+var loginPage = template.Must(template.New("login").Parse(loginHTML))
+
+// struct loginView is rendered by templates/login.html
+type loginView struct {
+	Handle string
+	Error  string
+}
+
+// function oauthRoutes handles signing in on the loopback address: the
+// login page starts the flow and the callback finishes it
+func oauthRoutes(o *OAuthClient, conn *Connection) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /oauth/login", func(w http.ResponseWriter, r *http.Request) {
+		handle := r.URL.Query().Get("handle")
+		if handle == "" {
+			loginPage.Execute(w, loginView{})
+			return
+		}
+
+		target, err := o.Authorize(r.Context(), conn, handle)
+		if err != nil {
+			logger.Errorf("unable to sign in %v %v", handle, err.Error())
+			w.WriteHeader(http.StatusBadGateway)
+			loginPage.Execute(w, loginView{Error: err.Error()})
+			return
+		}
+
+		http.Redirect(w, r, target, http.StatusFound)
+	})
+
+	mux.HandleFunc("GET "+OAuthCallback, func(w http.ResponseWriter, r *http.Request) {
+		s, err := o.Callback(r.Context(), conn, r.URL.Query())
+		if err != nil {
+			logger.Errorf("unable to finish signing in %v", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			loginPage.Execute(w, loginView{Error: err.Error()})
+			return
+		}
+
+		logger.Infof("signed in as %v (%v)", s.Handle, s.DID)
+		loginPage.Execute(w, loginView{Handle: cmp.Or(s.Handle, s.DID)})
+	})
+
+	return mux
+}
+
+// function Serve runs the loopback server that OAuth redirects back to
+func Serve(args []string) error {
+	port := DefaultPort
+	for i, arg := range args {
+		if (arg == "--port" || arg == "-p") && i+1 < len(args) {
+			p, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				return fmt.Errorf("unable to parse %v value %v", arg, err.Error())
+			}
+
+			port = p
+		}
+	}
+
+	// Loopback clients must be redirected to an IP address, not localhost
+	addr := fmt.Sprintf("127.0.0.1:%v", port)
+	o := NewOAuthClient("http://" + addr + OAuthCallback)
+	if service := os.Getenv("BLUESKY_SERVICE"); service != "" {
+		o.Service = service
+	}
+
+	srv := &http.Server{Addr: addr, Handler: oauthRoutes(o, CreateConnection())}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		<-ctx.Done()
+		srv.Shutdown(context.Background())
+	}()
+
+	logger.Infof("open http://%v/oauth/login to sign in", addr)
+
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+
+	return nil
+}
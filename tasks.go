@@ -1,11 +1,16 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"math/rand/v2"
 	"os"
 	"os/signal"
 	"strconv"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -26,11 +31,23 @@ type Settings struct {
 	MaxProcesses int
 }
 
+// struct Task is a unit of work the [Worker] runs every Interval, starting
+// at Next. Tasks of the same Account, a [Connection.AccountID], run one after
+// another.
+type Task struct {
+	Name     string
+	Account  int64
+	Interval time.Duration
+	Next     time.Time
+	Run      func(ctx context.Context) error
+}
+
 type Worker struct {
 	Ticker   *Ticker
 	Context  *Context
 	Logger   *Logger
 	Settings Settings
+	Tasks    []*Task
 }
 
 func NewTicker(i int) *Ticker {
@@ -54,23 +71,112 @@ func NewWorker(retries int, processes int, hr int) Worker {
 	}
 }
 
-// function DoWork dispatches/spawns goroutines to execute tasks
+func (w *Worker) AddTask(t Task) {
+	w.Tasks = append(w.Tasks, &t)
+}
+
+// function Execute runs a task, retrying the failures [RetryAfter] considers
+// transient up to MaxRetries times. Rate limited tasks wait for the limit to
+// reset, and fail to be rescheduled when it is more than [MaxRateLimitWait]
+// away; other retries back off exponentially from one second.
+func (w *Worker) Execute(t *Task) error {
+	for attempt := 0; ; attempt++ {
+		err := t.Run(w.Context.ctx)
+		if err == nil {
+			return nil
+		}
+
+		wait, ok := RetryAfter(err)
+		if !ok {
+			return err
+		}
+
+		if attempt >= w.Settings.MaxRetries {
+			return fmt.Errorf("after %v attempts %w", attempt+1, err)
+		}
+
+		if wait == 0 {
+			wait = time.Second << attempt
+		}
+
+		w.Logger.Warnf("task %v failed, retrying in %v %v", t.Name, wait, err.Error())
+
+		select {
+		case <-w.Context.ctx.Done():
+			return w.Context.ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// function DoWork executes the tasks that are due and schedules their next
+// run. Each account's tasks run in the order they were added, in a goroutine
+// of their own; at most MaxProcesses accounts are worked on at once.
 func (w *Worker) DoWork() error {
-	return nil
+	accounts := []int64{}
+	due := map[int64][]*Task{}
+	now := time.Now()
+	for _, t := range w.Tasks {
+		if now.Before(t.Next) {
+			continue
+		}
+
+		if _, ok := due[t.Account]; !ok {
+			accounts = append(accounts, t.Account)
+		}
+
+		due[t.Account] = append(due[t.Account], t)
+	}
+
+	slots := make(chan struct{}, max(w.Settings.MaxProcesses, 1))
+	mu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	errs := []error{}
+	for _, account := range accounts {
+		wg.Add(1)
+		go func(tasks []*Task) {
+			defer wg.Done()
+
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			for _, t := range tasks {
+				started := time.Now()
+				if err := w.Execute(t); err != nil {
+					mu.Lock()
+					errs = append(errs, fmt.Errorf("task %v failed %w", t.Name, err))
+					mu.Unlock()
+				}
+
+				t.Next = started.Add(t.Interval)
+			}
+		}(due[account])
+	}
+
+	wg.Wait()
+
+	return errors.Join(errs...)
 }
 
+// function StartListener runs the due tasks on every tick until the process
+// is signalled to stop, then waits for the work in progress to wind down
 func (w *Worker) StartListener() {
 	sigChannel := make(chan os.Signal, 1)
 	signal.Notify(sigChannel, syscall.SIGINT, syscall.SIGTERM)
 	messenger := make(chan string)
+	stopped := make(chan struct{})
 
 	go func() {
+		defer close(stopped)
 		for {
 			select {
 			case <-w.Ticker.done:
 				return
 			case t := <-w.Ticker.t.C:
 				messenger <- fmt.Sprintf("heartbeat at %v", t.Format(time.DateTime))
+				if err := w.DoWork(); err != nil {
+					w.Logger.Errorf("heartbeat at %v failed\n%v", t.Format(time.DateTime), err.Error())
+				}
 			}
 		}
 	}()
@@ -84,11 +190,14 @@ func (w *Worker) StartListener() {
 	go func() {
 		sig := <-sigChannel
 		w.Logger.Info("received signal: " + sig.String())
-		w.Ticker.done <- true
+		w.Context.cancel()
+		// Closing rather than sending wakes every receiver
+		close(w.Ticker.done)
 	}()
 
 	<-w.Ticker.done
 	w.Ticker.t.Stop()
+	<-stopped
 }
 
 // ParseArgs is a part of the [Commander] interface implementation
@@ -97,45 +206,299 @@ func ParseWorkerArgs(args []string) map[string]int {
 	parsed["heartRate"] = 2
 	parsed["retries"] = 3
 	parsed["processes"] = 1
+	parsed["interval"] = 24 * 60
+	parsed["mentions"] = 5
+	parsed["metrics"] = 60
+	parsed["metricsWindow"] = int(DefaultMetricsWindow.Hours() / 24)
+	parsed["bio"] = 0
+	parsed["related"] = 0
+	parsed["throwback"] = 0
+	parsed["throwbackAge"] = int(DefaultThrowbackAge.Hours() / 24)
+	parsed["undo"] = 0
 
-	for i, arg := range args {
-		var val string
+	for i := 0; i+1 < len(args); i++ {
+		key := ""
+		switch args[i] {
+		case "--heartrate", "--hr", "-heartrate", "-hr":
+			key = "heartRate"
+		case "--retries", "--r", "-retries", "-r":
+			key = "retries"
+		case "--processes", "--p", "-processes", "-p":
+			key = "processes"
+		case "--interval", "--i", "-interval", "-i":
+			key = "interval"
+		case "--mentions", "--m", "-mentions", "-m":
+			key = "mentions"
+		case "--metrics", "-metrics":
+			key = "metrics"
+		case "--metrics-window", "-metrics-window":
+			key = "metricsWindow"
+		case "--bio", "-bio":
+			key = "bio"
+		case "--related", "-related":
+			key = "related"
+		case "--throwback", "-throwback":
+			key = "throwback"
+		case "--throwback-age", "-throwback-age":
+			key = "throwbackAge"
+		case "--undo", "-undo":
+			key = "undo"
+		default:
+			// Flags with other values, e.g. --replies, are read elsewhere
+			continue
+		}
 
-		if i != len(args)-1 {
-			val = args[i+1]
-		} else {
-			break
+		i++
+		value, err := strconv.Atoi(args[i])
+		if err != nil {
+			logger.Errorf("unable to parse %v value %v", args[i-1], err.Error())
+			continue
 		}
 
-		value, err := strconv.Atoi(val)
+		parsed[key] = value
+	}
+
+	return parsed
+}
+
+// function PostNextHighlight posts the next highlight that has not been
+// shared, as a quote card when it is too long for a thread. Otherwise the
+// thread opens with a link card for the book's source, when it can be built.
+// A highlight that can never be posted is skipped, see [skipHighlight].
+//
+// related is the percent chance the post quotes the account's latest post
+// of a highlight from the same book or with a shared tag, when there is one.
+func PostNextHighlight(ctx context.Context, c *AtClient, conn *Connection, related int) error {
+	if err := ResumePendingPosts(ctx, c, conn); err != nil {
+		return err
+	}
+
+	h, err := conn.NextHighlight()
+	if errors.Is(err, sql.ErrNoRows) {
+		logger.Info("every highlight has been posted")
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("unable to select highlight %v", err.Error())
+	}
+
+	var quote *PostRow
+	if related > 0 && rand.IntN(100) < related {
+		quote, err = conn.RelatedPost(*h)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			logger.Warnf("unable to find a related post for %v %v", h.ID, err.Error())
+		}
+	}
+
+	// The title or authors may have changed since the highlight was imported,
+	// so the status is checked again against the text that will be posted
+	q := Quote{h.Text, h.Title, h.Authors}
+	r, err := Preflight(q.PostText())
+	if err != nil {
+		return skipHighlight(c, conn, h, h.Text, err)
+	}
+
+	if r.Status == NeedsImage {
+		p, err := NewQuoteCardPost(ctx, c, q, DefaultTheme)
 		if err != nil {
-			logger.Error(fmt.Printf("unable to parse %v value %v", arg, err.Error()))
+			return skipHighlight(c, conn, h, q.PostText(), err)
 		}
 
-		switch arg {
-		case "--heartrate", "--hr", "-heartrate", "-hr":
-			parsed["heartRate"] = value
-		case "--retries", "--r", "-retries", "-r":
-			parsed["retries"] = value
-		case "--processes", "--p", "-processes", "-p":
-			parsed["processes"] = value
+		if quote != nil {
+			p.Embed = NewQuoteEmbed(StrongRef{quote.URI, quote.CID}, p.Embed)
 		}
+
+		if _, err = PostOnce(ctx, c, conn, p, h.ID); errors.Is(err, ErrInvalidRecord) {
+			return skipHighlight(c, conn, h, q.PostText(), err)
+		}
+
+		return err
 	}
 
-	return parsed
+	var embed interface{}
+	if source := h.SourceURL(); source == "" {
+		logger.Debugf("no source page for %v, posting without a link card", h.Title)
+	} else if card, cardErr := BuildExternalEmbed(ctx, c, source); cardErr != nil {
+		logger.Warnf("unable to build a link card for %v %v", h.Title, cardErr.Error())
+	} else {
+		embed = card
+	}
+
+	if quote != nil {
+		embed = NewQuoteEmbed(StrongRef{quote.URI, quote.CID}, embed)
+	}
+
+	if _, err = PublishEmbed(ctx, c, conn, q.PostText(), embed, h.ID); errors.Is(err, ErrInvalidRecord) {
+		return skipHighlight(c, conn, h, q.PostText(), err)
+	}
+
+	return err
+}
+
+// function skipHighlight records a failed reservation of h when err will not
+// change on retry, e.g. a quote card over [MaxBlobSize], so
+// [Connection.NextHighlight] moves on to the next highlight. Transient and
+// authentication errors are returned for the highlight to be tried again.
+func skipHighlight(c *AtClient, conn *Connection, h *Highlight, text string, err error) error {
+	if _, retry := RetryAfter(err); retry || errors.Is(err, ErrAuthRequired) ||
+		errors.Is(err, ErrExpiredToken) || errors.Is(err, ErrInvalidToken) {
+		return err
+	}
+
+	uri := ATURI{c.CurrentCredentials().DID, PostCollection, NextTID()}.String()
+	if _, reserveErr := conn.ReservePost(uri, NewPost(text), h.ID); reserveErr != nil {
+		return reserveErr
+	} else if failErr := conn.FailPost(uri); failErr != nil {
+		return failErr
+	}
+
+	logger.Errorf("skipping highlight %v, it cannot be posted %v", h.ID, err.Error())
+
+	return nil
 }
 
 // func Run "turns on the bot," i.e. starts the worker and parses the command-line
-// argument slice from [ParseArgs]
+// argument slice from [ParseArgs]. --replies and --quotes override the reply
+// and quote rules of every account.
 func Run(args []string) error {
 	parsed := ParseWorkerArgs(args)
+	base := CreateConnection()
+	for i := 0; i+1 < len(args); i++ {
+		switch args[i] {
+		case "--replies", "-replies":
+			base.ReplyRules = args[i+1]
+		case "--quotes", "-quotes":
+			base.QuoteRules = args[i+1]
+		}
+	}
+
+	if _, err := PostGates(base, base.ReplyRules, base.QuoteRules); err != nil {
+		return err
+	}
+
 	w := NewWorker(parsed["retries"], parsed["processes"], parsed["heartRate"])
 
+	conns, err := SelectAccounts(base, selectedAccount)
+	if err != nil {
+		return err
+	}
+
+	for _, conn := range conns {
+		c, err := Login(w.Context.ctx, conn)
+		if err != nil {
+			logger.Errorf("skipping account %v %v", conn.AccountID, err.Error())
+			continue
+		}
+
+		if err = AddAccountTasks(&w, c, conn, parsed); err != nil {
+			return err
+		}
+	}
+
+	if len(w.Tasks) == 0 {
+		return fmt.Errorf("unable to sign in to any account")
+	}
+
 	w.StartListener()
 
-	if err := w.DoWork(); err != nil {
+	return nil
+}
+
+// function AddAccountTasks schedules posting, answering mentions and syncing
+// metrics of posts from the last --metrics-window days, 0 for all, for the
+// account c is signed in to, and refreshing its bio when --bio is given. --throwback reposts popular posts at least
+// --throwback-age days old, and --undo deletes those reposts after as many
+// hours. Accounts post on their own interval; the --interval flag
+// applies when no account is selected.
+func AddAccountTasks(w *Worker, c *AtClient, conn *Connection, parsed map[string]int) error {
+	interval := time.Duration(parsed["interval"]) * time.Minute
+	if conn.AccountID != 0 {
+		a, err := conn.GetAccount(strconv.FormatInt(conn.AccountID, 10))
+		if err != nil {
+			return fmt.Errorf("unable to load account %v %v", conn.AccountID, err.Error())
+		}
+
+		interval = time.Duration(a.PostInterval) * time.Minute
+	}
+
+	last, err := conn.LastPostedAt()
+	if err != nil {
 		return err
-	} else {
-		return nil
 	}
+
+	// Sessions resumed by DID have no handle, so tasks are grouped by the
+	// account's ID and the handle only names them
+	cred := c.CurrentCredentials()
+	handle := cmp.Or(cred.Handle, cred.DID)
+	if conn.AccountID != 0 {
+		handle = fmt.Sprintf("%v (account %v)", handle, conn.AccountID)
+	}
+
+	w.AddTask(Task{
+		Name:     "post " + handle,
+		Account:  conn.AccountID,
+		Interval: interval,
+		Next:     last.Add(interval),
+		Run: func(ctx context.Context) error {
+			return PostNextHighlight(ctx, c, conn, parsed["related"])
+		},
+	})
+
+	w.AddTask(Task{
+		Name:     "mentions " + handle,
+		Account:  conn.AccountID,
+		Interval: time.Duration(parsed["mentions"]) * time.Minute,
+		Run: func(ctx context.Context) error {
+			return HandleMentions(ctx, c, conn)
+		},
+	})
+
+	window := time.Duration(parsed["metricsWindow"]) * 24 * time.Hour
+	w.AddTask(Task{
+		Name:     "metrics " + handle,
+		Account:  conn.AccountID,
+		Interval: time.Duration(parsed["metrics"]) * time.Minute,
+		Run: func(ctx context.Context) error {
+			_, err := SyncMetrics(ctx, c, conn, window)
+			return err
+		},
+	})
+
+	if parsed["throwback"] > 0 {
+		age := time.Duration(parsed["throwbackAge"]) * 24 * time.Hour
+		w.AddTask(Task{
+			Name:     "throwback " + handle,
+			Account:  conn.AccountID,
+			Interval: time.Duration(parsed["throwback"]) * time.Minute,
+			Run: func(ctx context.Context) error {
+				_, err := Throwback(ctx, c, conn, age)
+				return err
+			},
+		})
+	}
+
+	if parsed["undo"] > 0 {
+		window := time.Duration(parsed["undo"]) * time.Hour
+		w.AddTask(Task{
+			Name:     "undo reposts " + handle,
+			Account:  conn.AccountID,
+			Interval: UndoRepostInterval,
+			Run: func(ctx context.Context) error {
+				_, err := UndoReposts(ctx, c, conn, window)
+				return err
+			},
+		})
+	}
+
+	if parsed["bio"] > 0 {
+		w.AddTask(Task{
+			Name:     "bio " + handle,
+			Account:  conn.AccountID,
+			Interval: time.Duration(parsed["bio"]) * time.Minute,
+			Run: func(ctx context.Context) error {
+				return RefreshBio(ctx, c, conn)
+			},
+		})
+	}
+
+	return nil
 }
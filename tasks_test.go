@@ -1 +1,400 @@
 package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestExecute(t *testing.T) {
+	w := NewWorker(2, 1, 1)
+
+	t.Run("transient errors are retried", func(t *testing.T) {
+		attempts := 0
+		err := w.Execute(&Task{Name: "flaky", Run: func(ctx context.Context) error {
+			attempts++
+			if attempts < 2 {
+				return &XRPCError{Status: http.StatusBadGateway}
+			}
+
+			return nil
+		}})
+
+		if err != nil || attempts != 2 {
+			t.Errorf("wanted success on the 2nd attempt but got %v after %v", err, attempts)
+		}
+	})
+
+	t.Run("invalid requests are not retried", func(t *testing.T) {
+		attempts := 0
+		err := w.Execute(&Task{Name: "invalid", Run: func(ctx context.Context) error {
+			attempts++
+			return &XRPCError{Status: http.StatusBadRequest, Name: "InvalidRequest"}
+		}})
+
+		if !errors.Is(err, ErrInvalidRequest) || attempts != 1 {
+			t.Errorf("wanted a single attempt but got %v after %v", err, attempts)
+		}
+	})
+
+	t.Run("limits resetting after MaxRateLimitWait are not waited for", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("ratelimit-remaining", "0")
+			w.Header().Set("ratelimit-reset", fmt.Sprint(time.Now().Add(time.Hour).Unix()))
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"error":"RateLimitExceeded","message":"Rate Limit Exceeded"}`))
+		}))
+
+		defer srv.Close()
+
+		attempts, started := 0, time.Now()
+		err := w.Execute(&Task{Name: "limited", Run: func(ctx context.Context) error {
+			attempts++
+			return testClient(srv).Procedure(ctx, CreateRecordMethod, nil, nil)
+		}})
+
+		if !errors.Is(err, ErrRateLimitExceeded) || attempts != 1 || time.Since(started) > time.Second {
+			t.Errorf("wanted a single attempt but got %v after %v in %v", err, attempts, time.Since(started))
+		}
+	})
+
+	t.Run("retries stop when the worker is cancelled", func(t *testing.T) {
+		w.Context.cancel()
+		err := w.Execute(&Task{Name: "flaky", Run: func(ctx context.Context) error {
+			return &XRPCError{Status: http.StatusBadGateway}
+		}})
+
+		if !errors.Is(err, w.Context.ctx.Err()) {
+			t.Errorf("wanted cancellation but got %v", err)
+		}
+	})
+}
+
+func TestParseWorkerArgs(t *testing.T) {
+	parsed := ParseWorkerArgs([]string{"pulse", "--replies", "following", "--retries", "5", "--quotes", "nobody", "--undo", "soon", "--throwback-age", "60", "--metrics-window", "0"})
+	want := map[string]int{"retries": 5, "throwbackAge": 60, "undo": 0, "heartRate": 2, "metricsWindow": 0}
+	for k, v := range want {
+		if parsed[k] != v {
+			t.Errorf("wanted %v to be %v but got %v", k, v, parsed[k])
+		}
+	}
+}
+
+func TestDoWork(t *testing.T) {
+	t.Run("tasks wait until they are due", func(t *testing.T) {
+		w := NewWorker(0, 1, 1)
+		runs := 0
+		w.AddTask(Task{Name: "due", Interval: time.Hour, Run: func(ctx context.Context) error { runs++; return nil }})
+		w.AddTask(Task{Name: "later", Interval: time.Hour, Next: time.Now().Add(time.Minute), Run: func(ctx context.Context) error {
+			t.Errorf("wanted task to wait until it is due")
+			return nil
+		}})
+
+		w.DoWork()
+		w.DoWork()
+
+		if runs != 1 || w.Tasks[0].Next.Before(time.Now().Add(59*time.Minute)) {
+			t.Errorf("wanted a single run scheduled an hour later but got %v runs, next at %v", runs, w.Tasks[0].Next)
+		}
+	})
+
+	t.Run("accounts are worked on concurrently", func(t *testing.T) {
+		w := NewWorker(0, 2, 1)
+		started := make(chan int64, 2)
+		both := make(chan struct{})
+		for _, account := range []int64{1, 2} {
+			w.AddTask(Task{Name: "post", Account: account, Run: func(ctx context.Context) error {
+				started <- account
+				select {
+				case <-both:
+					return nil
+				case <-time.After(time.Second):
+					return errors.New("the other account did not start")
+				}
+			}})
+		}
+
+		go func() {
+			<-started
+			<-started
+			close(both)
+		}()
+
+		if err := w.DoWork(); err != nil {
+			t.Errorf("wanted no error but got %v", err.Error())
+		}
+	})
+
+	t.Run("processes bound the accounts worked on at once", func(t *testing.T) {
+		w := NewWorker(0, 2, 1)
+		mu := sync.Mutex{}
+		running, most := 0, 0
+		order := map[int64][]string{}
+		for _, account := range []int64{1, 2, 3} {
+			for _, name := range []string{"post", "mentions"} {
+				w.AddTask(Task{Name: name, Account: account, Run: func(ctx context.Context) error {
+					mu.Lock()
+					running++
+					most = max(most, running)
+					order[account] = append(order[account], name)
+					mu.Unlock()
+
+					time.Sleep(10 * time.Millisecond)
+
+					mu.Lock()
+					running--
+					mu.Unlock()
+
+					return nil
+				}})
+			}
+		}
+
+		w.DoWork()
+
+		if most != 2 {
+			t.Errorf("wanted 2 tasks at once but got %v", most)
+		}
+
+		for account, names := range order {
+			if len(names) != 2 || names[0] != "post" {
+				t.Errorf("wanted the tasks of %v in order but got %v", account, names)
+			}
+		}
+	})
+
+	t.Run("failures are reported with their task", func(t *testing.T) {
+		w := NewWorker(0, 1, 1)
+		ran := false
+		w.AddTask(Task{Name: "post one.test", Account: 1, Run: func(ctx context.Context) error {
+			return &XRPCError{Status: http.StatusBadRequest, Name: "InvalidRequest"}
+		}})
+		w.AddTask(Task{Name: "post two.test", Account: 2, Run: func(ctx context.Context) error {
+			ran = true
+			return nil
+		}})
+
+		err := w.DoWork()
+		if !errors.Is(err, ErrInvalidRequest) || !strings.Contains(err.Error(), "post one.test") || !ran {
+			t.Errorf("wanted the failure of post one.test but got %v", err)
+		}
+	})
+}
+
+func TestPostNextHighlight(t *testing.T) {
+	var embeds []map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/isbn/0449213943", "/isbn/0143108263":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<meta property="og:title" content="Open Library">`))
+		case "/xrpc/" + CreateRecordMethod:
+			var req struct {
+				Rkey   string `json:"rkey"`
+				Record struct {
+					Embed map[string]interface{} `json:"embed"`
+				} `json:"record"`
+			}
+
+			json.NewDecoder(r.Body).Decode(&req)
+			embeds = append(embeds, req.Record.Embed)
+			json.NewEncoder(w).Encode(StrongRef{"at://did:plc:synapse/app.bsky.feed.post/" + req.Rkey, "bafyrei" + req.Rkey})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	defer srv.Close()
+
+	base := OpenLibraryURL
+	OpenLibraryURL = srv.URL
+	t.Cleanup(func() { OpenLibraryURL = base })
+
+	ctx := context.Background()
+	conn := testConnection(t)
+	c := testClient(srv)
+	war := ".war"
+	books := []*Bookcision{
+		{ASIN: "0449213943", Title: "All Quiet on the Western Front", Authors: "Erich Maria Remarque", Highlights: []BookcisionHighlight{
+			{Text: "We are forlorn like children, and experienced like old men.", Note: &war},
+			{Text: "I am young, I am twenty years old."},
+		}},
+		{ASIN: "0143108263", Title: "Storm of Steel", Authors: "Ernst Jünger", Highlights: []BookcisionHighlight{
+			{Text: "The war had taken on a new and sinister aspect.", Note: &war},
+			{Text: "Chance plays a bigger part than merit."},
+		}},
+	}
+
+	for _, b := range books {
+		if _, err := ImportBookcision(conn, b); err != nil {
+			t.Fatalf("test setup failed %v", err.Error())
+		}
+	}
+
+	quoted := func(e map[string]interface{}) string {
+		if e["$type"] != RecordWithMediaEmbedType {
+			return ""
+		}
+
+		record := e["record"].(map[string]interface{})["record"].(map[string]interface{})
+
+		return record["uri"].(string)
+	}
+
+	posts := []StrongRef{}
+	for i, related := range []int{100, 100, 100, 0} {
+		if err := PostNextHighlight(ctx, c, conn, related); err != nil {
+			t.Fatalf("wanted no error posting highlight %v but got %v", i+1, err.Error())
+		}
+
+		rows, _ := conn.GetPosts()
+		posts = append(posts, StrongRef{rows[i].URI, rows[i].CID})
+	}
+
+	t.Run("highlights without earlier related posts only have a card", func(t *testing.T) {
+		if embeds[0]["$type"] != ExternalEmbedType || embeds[3]["$type"] != ExternalEmbedType {
+			t.Errorf("wanted link cards but got %v and %v", embeds[0], embeds[3])
+		}
+	})
+
+	t.Run("highlights from the same book quote the earlier post", func(t *testing.T) {
+		if got := quoted(embeds[1]); got != posts[0].URI {
+			t.Errorf("wanted a quote of %v but got %v", posts[0].URI, embeds[1])
+		}
+
+		media := embeds[1]["media"].(map[string]interface{})
+		if media["$type"] != ExternalEmbedType {
+			t.Errorf("wanted the link card as media but got %v", media)
+		}
+	})
+
+	t.Run("highlights sharing a tag quote the earlier post", func(t *testing.T) {
+		if got := quoted(embeds[2]); got != posts[0].URI {
+			t.Errorf("wanted a quote of %v but got %v", posts[0].URI, embeds[2])
+		}
+	})
+
+	t.Run("the latest related post is quoted", func(t *testing.T) {
+		got, err := conn.RelatedPost(Highlight{ID: 99, BookID: 2})
+		if err != nil || got.URI != posts[3].URI {
+			t.Errorf("wanted the latest post of the book but got %+v %v", got, err)
+		}
+	})
+}
+
+func TestPostNextHighlightSkips(t *testing.T) {
+	sent := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/xrpc/" + UploadBlobMethod:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"BlobTooLarge","message":"This file is too large"}`))
+		case "/xrpc/" + CreateRecordMethod:
+			var req struct {
+				Rkey   string `json:"rkey"`
+				Record Post   `json:"record"`
+			}
+
+			json.NewDecoder(r.Body).Decode(&req)
+			sent = append(sent, req.Record.Text)
+			json.NewEncoder(w).Encode(StrongRef{"at://did:plc:synapse/app.bsky.feed.post/" + req.Rkey, "bafyrei" + req.Rkey})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	defer srv.Close()
+
+	ctx := context.Background()
+	conn := testConnection(t)
+	c := testClient(srv)
+	if _, err := ImportBookcision(conn, &Bookcision{ASIN: "B00KWG9M2E", Title: "Getting Things Done", Authors: "David Allen", Highlights: []BookcisionHighlight{
+		{Text: strings.Repeat("Your mind is for having ideas, not holding them. ", 40)},
+		{Text: "Capture everything that has your attention."},
+	}}); err != nil {
+		t.Fatalf("test setup failed %v", err.Error())
+	}
+
+	t.Run("highlights whose card cannot be built are skipped", func(t *testing.T) {
+		if err := PostNextHighlight(ctx, c, conn, 0); err != nil {
+			t.Fatalf("wanted no error but got %v", err.Error())
+		}
+
+		if len(sent) != 0 {
+			t.Errorf("wanted nothing to be sent but got %v", sent)
+		}
+
+		if pending, err := conn.PendingPosts(); err != nil || len(pending) != 0 {
+			t.Errorf("wanted no pending posts but got %v %v", pending, err)
+		}
+	})
+
+	t.Run("highlights that fail preflight are skipped", func(t *testing.T) {
+		if _, err := conn.Db.Exec(`UPDATE highlights SET text = ' ' WHERE id = 2`); err != nil {
+			t.Fatalf("test setup failed %v", err.Error())
+		}
+
+		if err := PostNextHighlight(ctx, c, conn, 0); err != nil || len(sent) != 0 {
+			t.Fatalf("wanted the highlight to be skipped but got %v %v", sent, err)
+		}
+
+		if _, err := ImportBookcision(conn, &Bookcision{ASIN: "B00KWG9M2E", Title: "Getting Things Done", Authors: "David Allen", Highlights: []BookcisionHighlight{
+			{Text: "Use your mind to think about things, rather than think of them."},
+		}}); err != nil {
+			t.Fatalf("test setup failed %v", err.Error())
+		}
+	})
+
+	t.Run("the next highlight is posted", func(t *testing.T) {
+		if err := PostNextHighlight(ctx, c, conn, 0); err != nil {
+			t.Fatalf("wanted no error but got %v", err.Error())
+		}
+
+		if len(sent) != 1 || !strings.HasPrefix(sent[0], "Use your mind") {
+			t.Errorf("wanted the next highlight but got %v", sent)
+		}
+	})
+}
+
+func TestStartListener(t *testing.T) {
+	w := NewWorker(0, 2, 1)
+	started := make(chan bool, 2)
+	finished := make(chan bool, 2)
+	for _, account := range []int64{1, 2} {
+		w.AddTask(Task{Name: "slow", Account: account, Interval: time.Hour, Run: func(ctx context.Context) error {
+			started <- true
+			<-ctx.Done()
+			finished <- true
+			return ctx.Err()
+		}})
+	}
+
+	returned := make(chan bool)
+	go func() {
+		w.StartListener()
+		returned <- true
+	}()
+
+	<-started
+	<-started
+	syscall.Kill(os.Getpid(), syscall.SIGINT)
+
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("wanted the listener to stop on a signal")
+	}
+
+	if len(finished) != 2 {
+		t.Errorf("wanted the work in progress to finish but %v of 2 did", len(finished))
+	}
+}
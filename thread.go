@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const MaxPostLength int = 300
+
+// Sentences end in terminal punctuation, optionally followed by closing
+// quotes or brackets, and then whitespace
+var sentenceEnd = regexp.MustCompile(`[.!?…]+["'”’)\]]*\s+`)
+
+// function PostLength counts text the way Bluesky limits posts, in
+// grapheme clusters
+func PostLength(text string) int {
+	return GraphemeCount(text)
+}
+
+// function SplitSentences breaks text after each sentence's terminal
+// punctuation. Whitespace between sentences is dropped.
+func SplitSentences(text string) []string {
+	sentences := []string{}
+	start := 0
+	for _, m := range sentenceEnd.FindAllStringIndex(text, -1) {
+		sentences = append(sentences, strings.TrimSpace(text[start:m[1]]))
+		start = m[1]
+	}
+
+	if rest := strings.TrimSpace(text[start:]); rest != "" {
+		sentences = append(sentences, rest)
+	}
+
+	return sentences
+}
+
+// function fits reports whether text is at most limit graphemes and size
+// bytes long
+func fits(text string, limit, size int) bool {
+	return len(text) <= size && PostLength(text) <= limit
+}
+
+// function splitWords breaks a sentence that is too long on its own into
+// pieces of at most limit graphemes and size bytes, hard-splitting words
+// that exceed them
+func splitWords(sentence string, limit, size int) []string {
+	pieces := []string{}
+	current := ""
+	for _, w := range strings.Fields(sentence) {
+		for !fits(w, limit, size) {
+			if current != "" {
+				pieces = append(pieces, current)
+				current = ""
+			}
+
+			clusters := Graphemes(w)
+			n, bytes := 0, 0
+			for n < limit && n < len(clusters) && bytes+len(clusters[n]) <= size {
+				bytes += len(clusters[n])
+				n++
+			}
+
+			// A single cluster larger than size cannot be split any further
+			n = max(n, 1)
+			pieces = append(pieces, strings.Join(clusters[:n], ""))
+			w = strings.Join(clusters[n:], "")
+		}
+
+		if current == "" {
+			current = w
+		} else if fits(current+" "+w, limit, size) {
+			current += " " + w
+		} else {
+			pieces = append(pieces, current)
+			current = w
+		}
+	}
+
+	if current != "" {
+		pieces = append(pieces, current)
+	}
+
+	return pieces
+}
+
+// function SplitThread splits text into parts of at most limit graphemes and
+// [MaxPostBytes] bytes on sentence boundaries, falling back to word
+// boundaries. When more than one part is needed each is numbered, e.g.
+// "(1/3)".
+func SplitThread(text string, limit int) []string {
+	text = strings.TrimSpace(text)
+	if fits(text, limit, MaxPostBytes) {
+		return []string{text}
+	}
+
+	// Reserve room for the largest suffix we expect, " (99/99)"
+	budget, size := limit-len(" (99/99)"), MaxPostBytes-len(" (99/99)")
+	parts := []string{}
+	current := ""
+	for _, s := range SplitSentences(text) {
+		pieces := []string{s}
+		if !fits(s, budget, size) {
+			pieces = splitWords(s, budget, size)
+		}
+
+		for _, p := range pieces {
+			if current == "" {
+				current = p
+			} else if fits(current+" "+p, budget, size) {
+				current += " " + p
+			} else {
+				parts = append(parts, current)
+				current = p
+			}
+		}
+	}
+
+	if current != "" {
+		parts = append(parts, current)
+	}
+
+	for i := range parts {
+		parts[i] = fmt.Sprintf("%v (%v/%v)", parts[i], i+1, len(parts))
+	}
+
+	return parts
+}
+
+// function Publish posts text, as a reply thread when it is too long for a
+// single post, and records every part in the database. The refs of the
+// parts that were posted are returned even when a later part fails.
+func Publish(ctx context.Context, c *AtClient, conn *Connection, text string, highlightID int64) ([]StrongRef, error) {
+	return PublishEmbed(ctx, c, conn, text, nil, highlightID)
+}
+
+// function PublishEmbed is [Publish] with embed attached to the first post
+// of the thread, e.g. a link card. A nil embed is left out. Every part is
+// reserved before the first is sent, so a thread that is cut short is
+// finished by [ResumePendingPosts].
+func PublishEmbed(ctx context.Context, c *AtClient, conn *Connection, text string, embed interface{}, highlightID int64) ([]StrongRef, error) {
+	parts := SplitThread(text, MaxPostLength)
+	refs := []StrongRef{}
+
+	did := c.CurrentCredentials().DID
+	uris := make([]string, len(parts))
+	posts := make([]Post, len(parts))
+	for i, part := range parts {
+		u := ATURI{did, PostCollection, NextTID()}
+		p := NewPost(part)
+		if i == 0 {
+			p.Embed = embed
+		}
+
+		p, err := preparePost(ctx, c, conn, u, p, highlightID)
+		if err != nil {
+			return refs, fmt.Errorf("unable to post part %v of %v %w", i+1, len(parts), err)
+		}
+
+		uris[i], posts[i] = u.String(), p
+	}
+
+	// The CIDs of the root and parent are filled in once they are sent
+	for i, p := range posts {
+		if i > 0 {
+			p.Reply = &ReplyRef{Root: StrongRef{URI: uris[0]}, Parent: StrongRef{URI: uris[i-1]}}
+		}
+
+		if _, err := conn.ReservePost(uris[i], p, highlightID); err != nil {
+			return refs, err
+		}
+	}
+
+	for i, p := range posts {
+		if i > 0 {
+			p.Reply = &ReplyRef{Root: refs[0], Parent: refs[i-1]}
+		}
+
+		ref, err := sendReserved(ctx, c, conn, uris[i], p)
+		if err != nil {
+			return refs, fmt.Errorf("unable to post part %v of %v %w", i+1, len(parts), err)
+		}
+
+		refs = append(refs, *ref)
+	}
+
+	if len(refs) > 1 {
+		logger.Infof("posted thread of %v parts at %v", len(refs), refs[0].URI)
+	}
+
+	return refs, nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSplitThread(t *testing.T) {
+	t.Run("short text is a single part", func(t *testing.T) {
+		got := SplitThread("  Your mind is for having ideas, not holding them.  ", MaxPostLength)
+		if len(got) != 1 || got[0] != "Your mind is for having ideas, not holding them." {
+			t.Errorf("unexpected parts %v", got)
+		}
+	})
+
+	t.Run("sentences are kept together and numbered", func(t *testing.T) {
+		sentence := strings.Repeat("word ", 25) + "end.”"
+		text := strings.Repeat(sentence+" ", 4)
+
+		got := SplitThread(text, MaxPostLength)
+		if len(got) != 2 {
+			t.Fatalf("wanted 2 parts but got %v", len(got))
+		}
+
+		for i, p := range got {
+			if PostLength(p) > MaxPostLength {
+				t.Errorf("part %v is too long (%v)", i, PostLength(p))
+			}
+
+			if !strings.HasSuffix(p, fmt.Sprintf("end.” (%v/2)", i+1)) {
+				t.Errorf("wanted part to end on a sentence but got %v", p)
+			}
+		}
+	})
+
+	t.Run("long sentences fall back to words", func(t *testing.T) {
+		text := strings.Repeat("capturing ", 80)
+		for _, p := range SplitThread(text, MaxPostLength) {
+			if PostLength(p) > MaxPostLength || strings.Contains(p, "capturing capt ") {
+				t.Errorf("unexpected part %v", p)
+			}
+		}
+	})
+}
+
+func TestPublish(t *testing.T) {
+	n := 0
+	replies := []*ReplyRef{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := struct {
+			Rkey   string `json:"rkey"`
+			Record Post   `json:"record"`
+		}{}
+
+		json.NewDecoder(r.Body).Decode(&req)
+		replies = append(replies, req.Record.Reply)
+		n++
+
+		fmt.Fprintf(w, `{"uri":"at://did:plc:synapse/app.bsky.feed.post/%v","cid":"bafyrei%v"}`, req.Rkey, n)
+	}))
+
+	defer srv.Close()
+
+	conn := testConnection(t)
+	refs, err := Publish(context.Background(), testClient(srv), conn, strings.Repeat("A sentence that goes on for a while. ", 20), 0)
+	if err != nil {
+		t.Fatalf("wanted no error but got %v", err.Error())
+	}
+
+	t.Run("parts reply to the root and previous part", func(t *testing.T) {
+		if len(refs) != 3 || replies[0] != nil {
+			t.Fatalf("unexpected thread %v %v", refs, replies)
+		}
+
+		for i, r := range replies[1:] {
+			if r.Root != refs[0] || r.Parent != refs[i] {
+				t.Errorf("part %v has wrong reply refs %+v", i+2, r)
+			}
+		}
+	})
+
+	t.Run("every part is stored", func(t *testing.T) {
+		got, err := conn.GetThread(refs[0].URI)
+		if err != nil || len(got) != 3 {
+			t.Fatalf("wanted 3 stored parts but got %v %v", got, err)
+		}
+
+		if got[2].ParentURI != refs[1].URI || got[2].RootURI != refs[0].URI {
+			t.Errorf("unexpected row %+v", got[2])
+		}
+	})
+}
+
+func TestPublishResume(t *testing.T) {
+	sent := map[string]Post{}
+	fail := map[int]int{}
+	n := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/xrpc/"+string(GetRecordMethod) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"RecordNotFound","message":"Could not locate record"}`))
+			return
+		}
+
+		req := struct {
+			Rkey   string `json:"rkey"`
+			Record Post   `json:"record"`
+		}{}
+
+		json.NewDecoder(r.Body).Decode(&req)
+		n++
+		if status, ok := fail[n]; ok {
+			w.WriteHeader(status)
+			w.Write([]byte(`{"error":"InvalidRequest","message":"Invalid record"}`))
+			return
+		}
+
+		sent[req.Rkey] = req.Record
+		fmt.Fprintf(w, `{"uri":"at://did:plc:synapse/app.bsky.feed.post/%v","cid":"bafyrei%v"}`, req.Rkey, n)
+	}))
+
+	defer srv.Close()
+
+	ctx := context.Background()
+	c := testClient(srv)
+	text := strings.Repeat("A sentence that goes on for a while. ", 20)
+
+	t.Run("a thread cut short is finished on resume", func(t *testing.T) {
+		conn := testConnection(t)
+		fail[2] = http.StatusBadGateway
+
+		refs, err := Publish(ctx, c, conn, text, 0)
+		if err == nil || len(refs) != 1 {
+			t.Fatalf("wanted the second part to fail but got %v %v", refs, err)
+		}
+
+		if pending, _ := conn.PendingPosts(); len(pending) != 2 {
+			t.Fatalf("wanted the rest of the thread to be reserved but got %+v", pending)
+		}
+
+		if err = ResumePendingPosts(ctx, c, conn); err != nil {
+			t.Fatalf("wanted no error but got %v", err.Error())
+		}
+
+		thread, _ := conn.GetThread(refs[0].URI)
+		if len(thread) != 3 {
+			t.Fatalf("wanted 3 parts but got %+v", thread)
+		}
+
+		for i, row := range thread[1:] {
+			u, _ := ParseATURI(row.URI)
+			reply := sent[u.Rkey].Reply
+			if row.CID == "" || reply == nil || reply.Root != refs[0] || reply.Parent != (StrongRef{thread[i].URI, thread[i].CID}) {
+				t.Errorf("part %v has wrong reply refs %+v", i+2, reply)
+			}
+		}
+	})
+
+	t.Run("parts of a rejected root are not sent", func(t *testing.T) {
+		conn := testConnection(t)
+		fail[n+1] = http.StatusBadRequest
+		before := len(sent)
+
+		if refs, err := Publish(ctx, c, conn, text, 0); err == nil || len(refs) != 0 {
+			t.Fatalf("wanted the root to be rejected but got %v %v", refs, err)
+		}
+
+		if err := ResumePendingPosts(ctx, c, conn); err != nil {
+			t.Fatalf("wanted no error but got %v", err.Error())
+		}
+
+		if pending, _ := conn.PendingPosts(); len(pending) != 0 || len(sent) != before {
+			t.Errorf("wanted the thread to be dropped but got %+v and %v sent", pending, len(sent)-before)
+		}
+	})
+}
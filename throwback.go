@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+const RepostCollection string = "app.bsky.feed.repost"
+
+// DefaultThrowbackAge is how old a post must be before it is reposted, and
+// how long before it is reposted again
+const DefaultThrowbackAge time.Duration = 30 * 24 * time.Hour
+
+// UndoRepostInterval is how often reposts are checked against the undo
+// window
+const UndoRepostInterval time.Duration = 15 * time.Minute
+
+// struct Repost is an app.bsky.feed.repost record
+type Repost struct {
+	Type      string    `json:"$type"`
+	Subject   StrongRef `json:"subject"`
+	CreatedAt string    `json:"createdAt"`
+}
+
+func NewRepost(subject StrongRef) Repost {
+	return Repost{Type: RepostCollection, Subject: subject, CreatedAt: time.Now().UTC().Format(time.RFC3339Nano)}
+}
+
+// function Throwback reposts the account's post with the most engagement
+// that is at least age old and has not been reposted within age. It
+// returns nil when no post is due. A repost that cannot be recorded is
+// deleted again.
+func Throwback(ctx context.Context, c *AtClient, conn *Connection, age time.Duration) (*StrongRef, error) {
+	now := time.Now().UTC()
+	p, err := conn.ThrowbackCandidate(now.Add(-age))
+	if errors.Is(err, sql.ErrNoRows) {
+		logger.Info("no posts are due a throwback")
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	ref, err := c.CreateRecord(ctx, RepostCollection, NextTID(), NewRepost(StrongRef{p.URI, p.CID}))
+	if err != nil {
+		return nil, err
+	}
+
+	if err = conn.SaveRepost(p.URI, *ref, now); err != nil {
+		// an unrecorded repost would never be undone, so it is taken back
+		if undo := c.DeleteRecord(ctx, ref.URI); undo != nil {
+			return nil, errors.Join(err, undo)
+		}
+
+		return nil, err
+	}
+
+	logger.Infof("reposted %v from %v", p.URI, p.PostedAt.Format(time.DateOnly))
+
+	return ref, nil
+}
+
+// function UndoReposts deletes the account's repost records made more than
+// window ago, or every one when window is 0. The posts stay in the history
+// of reposts, so they wait out the throwback age before they are reposted
+// again. A repost that cannot be undone is logged and tried again on the
+// next run, without holding up the others. It returns the number of reposts
+// undone.
+func UndoReposts(ctx context.Context, c *AtClient, conn *Connection, window time.Duration) (int, error) {
+	uris, err := conn.ActiveReposts(time.Now().UTC().Add(-window))
+	if err != nil {
+		return 0, err
+	}
+
+	undone := 0
+	failed := []error{}
+	for _, uri := range uris {
+		if err = c.DeleteRecord(ctx, uri); err == nil {
+			err = conn.MarkRepostUndone(uri)
+		}
+
+		if err != nil {
+			logger.Errorf("unable to undo %v %v", uri, err.Error())
+			failed = append(failed, err)
+			continue
+		}
+
+		undone++
+	}
+
+	return undone, errors.Join(failed...)
+}
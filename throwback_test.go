@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestThrowback(t *testing.T) {
+	conn := testConnection(t)
+	b := &Bookcision{ASIN: "B00KWG9M2E", Title: "Getting Things Done", Authors: "David Allen", Highlights: []BookcisionHighlight{
+		{Text: "Your mind is for having ideas, not holding them."},
+		{Text: "Capture everything that has your attention."},
+		{Text: "You can do anything, but not everything."},
+		{Text: "Use your mind to think about things, rather than think of them."},
+	}}
+
+	if _, err := ImportBookcision(conn, b); err != nil {
+		t.Fatalf("test setup failed %v", err.Error())
+	}
+
+	now := time.Now().UTC()
+	posts := []struct {
+		age   time.Duration
+		likes int
+	}{
+		{60 * 24 * time.Hour, 5},
+		{40 * 24 * time.Hour, 20},
+		{24 * time.Hour, 100},
+		{90 * 24 * time.Hour, 0},
+	}
+
+	uris := []string{}
+	for i, p := range posts {
+		ref := StrongRef{fmt.Sprintf("at://did:plc:synapse/app.bsky.feed.post/%v", i), fmt.Sprintf("bafyrei%v", i)}
+		post := NewPost(b.Highlights[i].Text)
+		post.CreatedAt = now.Add(-p.age).Format(time.RFC3339Nano)
+		if _, err := conn.SavePost(ref, post, int64(i+1)); err != nil {
+			t.Fatalf("test setup failed %v", err.Error())
+		}
+
+		if err := conn.SaveMetrics(PostMetrics{URI: ref.URI, Likes: p.likes, FetchedAt: now}); err != nil {
+			t.Fatalf("test setup failed %v", err.Error())
+		}
+
+		uris = append(uris, ref.URI)
+	}
+
+	reposted := []Repost{}
+	deleted := []RepoDeleteRecordInput{}
+	failDelete := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/xrpc/" + CreateRecordMethod:
+			var req struct {
+				Collection string `json:"collection"`
+				Rkey       string `json:"rkey"`
+				Record     Repost `json:"record"`
+			}
+
+			json.NewDecoder(r.Body).Decode(&req)
+			if req.Collection != RepostCollection {
+				t.Errorf("wanted a repost but got %v", req.Collection)
+			}
+
+			reposted = append(reposted, req.Record)
+			json.NewEncoder(w).Encode(StrongRef{"at://did:plc:synapse/app.bsky.feed.repost/" + req.Rkey, "bafyreirepost" + req.Rkey})
+		case "/xrpc/" + DeleteRecordMethod:
+			if failDelete > 0 {
+				failDelete--
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":"InvalidRequest","message":"Could not delete record"}`))
+				return
+			}
+
+			req := RepoDeleteRecordInput{}
+			json.NewDecoder(r.Body).Decode(&req)
+			deleted = append(deleted, req)
+			w.Write([]byte(`{}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	defer srv.Close()
+
+	ctx := context.Background()
+	c := testClient(srv)
+	age := 30 * 24 * time.Hour
+
+	t.Run("the most engaging old post is reposted first", func(t *testing.T) {
+		ref, err := Throwback(ctx, c, conn, age)
+		if err != nil || ref == nil {
+			t.Fatalf("wanted a repost but got %v %v", ref, err)
+		}
+
+		if len(reposted) != 1 || reposted[0].Subject != (StrongRef{uris[1], "bafyrei1"}) {
+			t.Errorf("wanted a repost of %v but got %+v", uris[1], reposted)
+		}
+
+		if active, err := conn.ActiveReposts(time.Now().UTC()); err != nil || len(active) != 1 || active[0] != ref.URI {
+			t.Errorf("wanted the repost to be remembered but got %v %v", active, err)
+		}
+	})
+
+	t.Run("posts are not reposted twice", func(t *testing.T) {
+		if _, err := Throwback(ctx, c, conn, age); err != nil {
+			t.Fatalf("wanted no error but got %v", err.Error())
+		}
+
+		if len(reposted) != 2 || reposted[1].Subject.URI != uris[0] {
+			t.Errorf("wanted a repost of %v but got %+v", uris[0], reposted)
+		}
+
+		ref, err := Throwback(ctx, c, conn, age)
+		if err != nil || ref != nil || len(reposted) != 2 {
+			t.Errorf("wanted recent and unengaging posts to be skipped but got %v %v", ref, err)
+		}
+	})
+
+	t.Run("reposts are undone after the window", func(t *testing.T) {
+		if n, err := UndoReposts(ctx, c, conn, time.Hour); err != nil || n != 0 {
+			t.Errorf("wanted recent reposts to be kept but got %v %v", n, err)
+		}
+
+		if n, err := UndoReposts(ctx, c, conn, 0); err != nil || n != 2 {
+			t.Fatalf("wanted 2 reposts to be undone but got %v %v", n, err)
+		}
+
+		if len(deleted) != 2 || deleted[0].Collection != RepostCollection {
+			t.Errorf("unexpected deletes %+v", deleted)
+		}
+
+		if n, _ := UndoReposts(ctx, c, conn, 0); n != 0 {
+			t.Errorf("wanted reposts to be undone once but got %v", n)
+		}
+	})
+
+	t.Run("undone posts wait out the age", func(t *testing.T) {
+		ref, err := Throwback(ctx, c, conn, age)
+		if err != nil || ref != nil {
+			t.Errorf("wanted no repost but got %v %v", ref, err)
+		}
+
+		ref, err = Throwback(ctx, c, conn, 0)
+		if err != nil || ref == nil || reposted[2].Subject.URI != uris[2] {
+			t.Errorf("wanted a repost of %v but got %v %v", uris[2], ref, err)
+		}
+	})
+
+	t.Run("reposts that cannot be recorded are deleted", func(t *testing.T) {
+		conn.Db.Exec(`CREATE TRIGGER no_reposts BEFORE INSERT ON reposts BEGIN SELECT RAISE(ABORT, 'read only'); END`)
+		defer conn.Db.Exec(`DROP TRIGGER no_reposts`)
+
+		deleted = nil
+		ref, err := Throwback(ctx, c, conn, 0)
+		if err == nil || ref != nil {
+			t.Fatalf("wanted an error but got %v %v", ref, err)
+		}
+
+		if len(deleted) != 1 || deleted[0].Collection != RepostCollection {
+			t.Errorf("wanted the repost to be deleted but got %+v", deleted)
+		}
+	})
+
+	t.Run("a repost that cannot be undone does not hold up the others", func(t *testing.T) {
+		if ref, err := Throwback(ctx, c, conn, 0); err != nil || ref == nil {
+			t.Fatalf("test setup failed %v %v", ref, err)
+		}
+
+		failDelete = 1
+		if n, err := UndoReposts(ctx, c, conn, 0); err == nil || n != 1 {
+			t.Errorf("wanted 1 repost to be undone and an error but got %v %v", n, err)
+		}
+
+		if n, err := UndoReposts(ctx, c, conn, 0); err != nil || n != 1 {
+			t.Errorf("wanted the failed repost to be undone on the next run but got %v %v", n, err)
+		}
+	})
+}
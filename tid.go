@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// TIDs sort as strings in the order they were created.
+//
+// https://atproto.com/specs/record-key#record-key-type-tid
+const tidAlphabet string = "234567abcdefghijklmnopqrstuvwxyz"
+
+// struct TIDClock generates strictly increasing timestamp identifiers
+type TIDClock struct {
+	mu      sync.Mutex
+	clockID uint64
+	last    uint64
+}
+
+// tids is shared so every record key made by this process is unique
+var tids = NewTIDClock()
+
+// function NewTIDClock picks a random 10 bit clock identifier, so that two
+// processes posting in the same microsecond do not collide
+func NewTIDClock() *TIDClock {
+	return &TIDClock{clockID: rand.Uint64N(1024)}
+}
+
+// function Next returns a TID for the current time. Two calls in the same
+// microsecond get consecutive timestamps.
+func (c *TIDClock) Next() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	us := uint64(time.Now().UnixMicro())
+	if us <= c.last {
+		us = c.last + 1
+	}
+
+	c.last = us
+
+	return EncodeTID(us, c.clockID)
+}
+
+// function EncodeTID packs microseconds since the epoch and a clock
+// identifier into a 13 character base32-sortable string
+func EncodeTID(us, clockID uint64) string {
+	v := (us&(1<<53-1))<<10 | clockID&(1<<10-1)
+	b := make([]byte, 13)
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i] = tidAlphabet[v&31]
+		v >>= 5
+	}
+
+	return string(b)
+}
+
+// function DecodeTID returns the timestamp and clock identifier of a TID
+func DecodeTID(tid string) (time.Time, uint64, error) {
+	if len(tid) != 13 {
+		return time.Time{}, 0, fmt.Errorf("invalid tid %v: expected 13 characters", tid)
+	}
+
+	v := uint64(0)
+	for i := 0; i < len(tid); i++ {
+		n := -1
+		for j := 0; j < len(tidAlphabet); j++ {
+			if tidAlphabet[j] == tid[i] {
+				n = j
+				break
+			}
+		}
+
+		if n < 0 || i == 0 && n >= 16 {
+			return time.Time{}, 0, fmt.Errorf("invalid tid %v", tid)
+		}
+
+		v = v<<5 | uint64(n)
+	}
+
+	return time.UnixMicro(int64(v >> 10)), v & (1<<10 - 1), nil
+}
+
+// function NextTID returns a TID from the process-wide clock, for use as the
+// record key of a new record
+func NextTID() string {
+	return tids.Next()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestTID(t *testing.T) {
+	t.Run("example from the spec", func(t *testing.T) {
+		want := time.Date(2023, 6, 30, 15, 3, 1, 887007000, time.UTC)
+		ts, clockID, err := DecodeTID("3jzfcijpj2z2a")
+		if err != nil || !ts.Equal(want) || clockID != 6 {
+			t.Errorf("wanted %v/6 but got %v/%v %v", want, ts, clockID, err)
+		}
+
+		if got := EncodeTID(uint64(want.UnixMicro()), 6); got != "3jzfcijpj2z2a" {
+			t.Errorf("wanted 3jzfcijpj2z2a but got %v", got)
+		}
+	})
+
+	t.Run("round trip", func(t *testing.T) {
+		now := time.Now().Truncate(time.Microsecond)
+		ts, clockID, err := DecodeTID(EncodeTID(uint64(now.UnixMicro()), 513))
+		if err != nil || !ts.Equal(now) || clockID != 513 {
+			t.Errorf("wanted %v/513 but got %v/%v %v", now, ts, clockID, err)
+		}
+	})
+
+	t.Run("tids increase", func(t *testing.T) {
+		c := NewTIDClock()
+		got := make([]string, 1000)
+		for i := range got {
+			got[i] = c.Next()
+		}
+
+		if !sort.StringsAreSorted(got) {
+			t.Errorf("wanted sorted tids")
+		}
+
+		for i := 1; i < len(got); i++ {
+			if got[i] == got[i-1] {
+				t.Fatalf("duplicate tid %v", got[i])
+			}
+		}
+	})
+
+	t.Run("invalid tids are rejected", func(t *testing.T) {
+		for _, tid := range []string{"", "3jzfcijpj2z2", "zzzzzzzzzzzzz", "3jzfcijpj2z21"} {
+			if _, _, err := DecodeTID(tid); err == nil {
+				t.Errorf("wanted an error for %q", tid)
+			}
+		}
+	})
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// MaxRateLimitWait is the longest a request will pause for an exhausted
+// rate limit to reset before failing with [ErrRateLimitExceeded]
+const MaxRateLimitWait time.Duration = time.Minute
+
+// Errors returned by XRPC endpoints. An [XRPCError] matches these with
+// [errors.Is] by name.
+var (
+	ErrAuthRequired      = errors.New("AuthRequired")
+	ErrExpiredToken      = errors.New("ExpiredToken")
+	ErrInvalidToken      = errors.New("InvalidToken")
+	ErrRateLimitExceeded = errors.New("RateLimitExceeded")
+	ErrInvalidRequest    = errors.New("InvalidRequest")
+	ErrInvalidSwap       = errors.New("InvalidSwap")
+	ErrRecordNotFound    = errors.New("RecordNotFound")
+
+	ErrAuthFactorTokenRequired = errors.New("AuthFactorTokenRequired")
+)
+
+// struct RateLimit is read from the ratelimit-* headers of a response
+type RateLimit struct {
+	Limit     int
+	Remaining int
+	Reset     time.Time
+	Policy    string
+}
+
+// struct XRPCError is the body returned by an XRPC endpoint for any
+// non-200 response
+type XRPCError struct {
+	Status    int        `json:"-"`
+	Name      string     `json:"error"`
+	Message   string     `json:"message"`
+	RateLimit *RateLimit `json:"-"`
+}
+
+// struct RawBody is sent as-is instead of being encoded as JSON, e.g. the
+// bytes of an uploaded blob
+type RawBody struct {
+	Data     []byte
+	MimeType string
+}
+
+func (e *XRPCError) Error() string {
+	if e.Name == "" {
+		return fmt.Sprintf("request failed with status %v", e.Status)
+	}
+
+	return fmt.Sprintf("request failed with status %v: %v %v", e.Status, e.Name, e.Message)
+}
+
+// Implements errors.Is for the sentinel errors, falling back to the
+// status code when the body did not name the error
+func (e *XRPCError) Is(target error) bool {
+	if e.Name != "" {
+		return e.Name == target.Error()
+	}
+
+	switch e.Status {
+	case http.StatusUnauthorized:
+		return target == ErrAuthRequired
+	case http.StatusTooManyRequests:
+		return target == ErrRateLimitExceeded
+	case http.StatusBadRequest:
+		return target == ErrInvalidRequest
+	default:
+		return false
+	}
+}
+
+// function ParseRateLimit reads the ratelimit-* headers, returning nil when
+// the response has none
+func ParseRateLimit(h http.Header) *RateLimit {
+	if h.Get("ratelimit-remaining") == "" {
+		return nil
+	}
+
+	rl := RateLimit{Policy: h.Get("ratelimit-policy")}
+	rl.Limit, _ = strconv.Atoi(h.Get("ratelimit-limit"))
+	rl.Remaining, _ = strconv.Atoi(h.Get("ratelimit-remaining"))
+	if reset, err := strconv.ParseInt(h.Get("ratelimit-reset"), 10, 64); err == nil {
+		rl.Reset = time.Unix(reset, 0)
+	}
+
+	return &rl
+}
+
+// function Wait is how long until the limit resets when it is exhausted
+func (rl *RateLimit) Wait(now time.Time) time.Duration {
+	if rl == nil || rl.Remaining > 0 || !rl.Reset.After(now) {
+		return 0
+	}
+
+	return rl.Reset.Sub(now)
+}
+
+// function ReadError builds an [XRPCError] from a non-200 response
+func ReadError(rsp *http.Response) error {
+	e := XRPCError{Status: rsp.StatusCode, RateLimit: ParseRateLimit(rsp.Header)}
+	buf := bytes.NewBuffer(nil)
+
+	if _, err := buf.ReadFrom(rsp.Body); err == nil {
+		json.Unmarshal(buf.Bytes(), &e)
+	}
+
+	return &e
+}
+
+// function IsExpiredToken reports whether err is an XRPC error caused by an
+// expired access token
+func IsExpiredToken(err error) bool {
+	return errors.Is(err, ErrExpiredToken)
+}
+
+// function RetryAfter reports whether a failed request is worth retrying
+// and how long to wait first. Server and network errors are retried, rate
+// limited requests wait for the limit to reset unless that is longer than
+// [MaxRateLimitWait]. Anything else, e.g. an authentication, validation or
+// database error, would fail the same way again.
+func RetryAfter(err error) (time.Duration, bool) {
+	var e *XRPCError
+	var urlErr *url.Error
+	var netErr net.Error
+	switch {
+	case err == nil, errors.Is(err, context.Canceled), errors.Is(err, ErrInvalidRecord):
+		return 0, false
+	case errors.Is(err, ErrRateLimitExceeded):
+		if errors.As(err, &e) && e.RateLimit != nil {
+			wait := e.RateLimit.Wait(time.Now())
+
+			return wait, wait <= MaxRateLimitWait
+		}
+
+		return MaxRateLimitWait, true
+	case errors.As(err, &e):
+		return 0, e.Status >= http.StatusInternalServerError
+	case errors.As(err, &urlErr), errors.As(err, &netErr) && netErr.Timeout(), errors.Is(err, io.ErrUnexpectedEOF):
+		return 0, true
+	default:
+		return 0, false
+	}
+}
+
+// function Query sends an authenticated XRPC query (GET) with params in the
+// query string and decodes the response into out.
+func (c *AtClient) Query(ctx context.Context, m AtProtoMethod, params url.Values, out interface{}) error {
+	return c.withRefresh(ctx, m, func(token string) error {
+		return c.send(ctx, http.MethodGet, m, token, params, nil, out)
+	})
+}
+
+// function Procedure sends an authenticated XRPC procedure (POST) with in as
+// the JSON body and decodes the response into out, which may be nil.
+func (c *AtClient) Procedure(ctx context.Context, m AtProtoMethod, in, out interface{}) error {
+	return c.withRefresh(ctx, m, func(token string) error {
+		return c.send(ctx, http.MethodPost, m, token, nil, in, out)
+	})
+}
+
+// A request rejected with ExpiredToken is retried once after the session
+// has been refreshed.
+func (c *AtClient) withRefresh(ctx context.Context, m AtProtoMethod, fn func(token string) error) error {
+	cred := c.CurrentCredentials()
+	if c.oauthExpired() {
+		if err := c.refreshExpired(ctx, cred.AccessToken); err != nil {
+			return err
+		}
+
+		cred = c.CurrentCredentials()
+	}
+
+	err := fn(cred.AccessToken)
+	if !c.isExpired(err) || cred.RefreshToken == "" {
+		return err
+	}
+
+	logger.Debugf("access token expired while calling %v, refreshing session", m)
+
+	if err = c.refreshExpired(ctx, cred.AccessToken); err != nil {
+		return err
+	}
+
+	return fn(c.CurrentCredentials().AccessToken)
+}
+
+// function refreshExpired refreshes the session unless another request has
+// already replaced the expired token, since refresh tokens are single use
+func (c *AtClient) refreshExpired(ctx context.Context, expired string) error {
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+
+	if c.CurrentCredentials().AccessToken != expired {
+		return nil
+	}
+
+	c.mu.RLock()
+	oauth := c.OAuth != nil
+	c.mu.RUnlock()
+
+	if oauth {
+		return c.refreshOAuth(ctx)
+	}
+
+	_, err := c.RefreshSession(ctx)
+
+	return err
+}
+
+// function isExpired reports whether err was caused by an expired access
+// token. Resource servers reject expired OAuth tokens as invalid.
+func (c *AtClient) isExpired(err error) bool {
+	if IsExpiredToken(err) {
+		return true
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.OAuth != nil && errors.Is(err, ErrInvalidToken)
+}
+
+// function waitForRateLimit pauses until an exhausted limit for m resets,
+// or fails right away when that would take longer than [MaxRateLimitWait]
+func (c *AtClient) waitForRateLimit(ctx context.Context, m AtProtoMethod) error {
+	c.mu.RLock()
+	rl := c.RateLimits[m]
+	c.mu.RUnlock()
+
+	wait := rl.Wait(time.Now())
+	if wait == 0 {
+		return nil
+	}
+
+	if wait > MaxRateLimitWait {
+		return &XRPCError{
+			Status:    http.StatusTooManyRequests,
+			Name:      ErrRateLimitExceeded.Error(),
+			Message:   fmt.Sprintf("%v is rate limited until %v", m, rl.Reset.Format(time.DateTime)),
+			RateLimit: rl,
+		}
+	}
+
+	logger.Warnf("rate limit for %v exhausted, pausing for %v", m, wait)
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(wait):
+		return nil
+	}
+}
+
+// function send is the request pipeline shared by every XRPC call. token
+// is sent as a bearer token, or a DPoP-bound one for OAuth sessions.
+func (c *AtClient) send(ctx context.Context, verb string, m AtProtoMethod, token string, params url.Values, in, out interface{}) error {
+	if err := c.waitForRateLimit(ctx, m); err != nil {
+		return err
+	}
+
+	u := c.BuildURL(m)
+	buf := bytes.NewBuffer(nil)
+
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+
+	contentType := "application/json"
+	switch body := in.(type) {
+	case nil:
+	case RawBody:
+		buf.Write(body.Data)
+		contentType = body.MimeType
+	default:
+		if err := json.NewEncoder(buf).Encode(in); err != nil {
+			return fmt.Errorf("unable to build body: %s", err.Error())
+		}
+	}
+
+	var rsp *http.Response
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, verb, u, bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			return fmt.Errorf("unable to build request: %s", err.Error())
+		}
+
+		if in != nil {
+			req.Header.Set("Content-Type", contentType)
+		}
+
+		if err = c.authorize(req, token); err != nil {
+			return err
+		}
+
+		rsp, err = c.HTTP.Do(req)
+		if err != nil {
+			return fmt.Errorf("unable to call %v: %w", m, err)
+		} else {
+			logger.Debugf("request to %v completed with status %v", u, rsp.Status)
+		}
+
+		// DPoP proofs must carry the nonce the server sent last
+		if attempt > 0 || !c.retryWithNonce(rsp) {
+			break
+		}
+
+		rsp.Body.Close()
+	}
+
+	defer rsp.Body.Close()
+
+	if rl := ParseRateLimit(rsp.Header); rl != nil {
+		c.mu.Lock()
+		if c.RateLimits == nil {
+			c.RateLimits = map[AtProtoMethod]*RateLimit{}
+		}
+
+		c.RateLimits[m] = rl
+		c.mu.Unlock()
+	}
+
+	if rsp.StatusCode != 200 {
+		return ReadError(rsp)
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	// A body cut short is a network error, see [RetryAfter]
+	if err := json.NewDecoder(rsp.Body).Decode(out); err != nil {
+		return fmt.Errorf("unable to marshal JSON: %w", err)
+	}
+
+	return nil
+}
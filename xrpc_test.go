@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestXRPCErrors(t *testing.T) {
+	for _, tc := range []struct {
+		status int
+		body   string
+		want   error
+		retry  bool
+	}{
+		{http.StatusUnauthorized, `{"error":"AuthRequired","message":"Invalid identifier or password"}`, ErrAuthRequired, false},
+		{http.StatusBadRequest, `{"error":"ExpiredToken","message":"Token has expired"}`, ErrExpiredToken, false},
+		{http.StatusBadRequest, `{"error":"InvalidRequest","message":"Input/text must not be longer than 300 graphemes"}`, ErrInvalidRequest, false},
+		{http.StatusTooManyRequests, `{"error":"RateLimitExceeded","message":"Rate Limit Exceeded"}`, ErrRateLimitExceeded, true},
+		{http.StatusUnauthorized, ``, ErrAuthRequired, false},
+		{http.StatusBadGateway, ``, nil, true},
+	} {
+		t.Run(fmt.Sprintf("%v %v", tc.status, tc.want), func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("ratelimit-remaining", "0")
+				w.Header().Set("ratelimit-reset", "0")
+				w.WriteHeader(tc.status)
+				w.Write([]byte(tc.body))
+			}))
+
+			defer srv.Close()
+
+			err := testClient(srv).Procedure(context.Background(), CreateRecordMethod, nil, nil)
+			if tc.want != nil && !errors.Is(err, tc.want) {
+				t.Errorf("wanted %v but got %v", tc.want, err)
+			}
+
+			if _, retry := RetryAfter(fmt.Errorf("wrapped %w", err)); retry != tc.retry {
+				t.Errorf("wanted retry to be %v for %v", tc.retry, err)
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.Close()
+
+	unreachable := testClient(srv).Procedure(context.Background(), CreateRecordMethod, nil, nil)
+
+	for _, tc := range []struct {
+		name  string
+		err   error
+		retry bool
+	}{
+		{"unreachable servers", unreachable, true},
+		{"bodies cut short", fmt.Errorf("unable to marshal JSON: %w", io.ErrUnexpectedEOF), true},
+		{"database errors", errors.New("unable to save post database is locked"), false},
+		{"empty posts", errors.New("unable to post empty text"), false},
+		{"signed out clients", fmt.Errorf("unable to create record, not signed in: %w", ErrAuthRequired), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, retry := RetryAfter(tc.err); retry != tc.retry {
+				t.Errorf("wanted retry to be %v for %v", tc.retry, tc.err)
+			}
+		})
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	calls := 0
+	reset := time.Now().Add(time.Hour).Unix()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("ratelimit-limit", "5000")
+		w.Header().Set("ratelimit-remaining", "0")
+		w.Header().Set("ratelimit-reset", fmt.Sprint(reset))
+		w.Header().Set("ratelimit-policy", "5000;w=3600")
+		w.Write([]byte(`{}`))
+	}))
+
+	defer srv.Close()
+
+	c := testClient(srv)
+	if err := c.Procedure(context.Background(), CreateRecordMethod, nil, nil); err != nil {
+		t.Fatalf("wanted no error but got %v", err.Error())
+	}
+
+	t.Run("headers are recorded per method", func(t *testing.T) {
+		rl := c.RateLimits[CreateRecordMethod]
+		if rl == nil || rl.Limit != 5000 || rl.Remaining != 0 || rl.Reset.Unix() != reset {
+			t.Errorf("unexpected rate limit %+v", rl)
+		}
+	})
+
+	t.Run("exhausted limits fail without a request", func(t *testing.T) {
+		err := c.Procedure(context.Background(), CreateRecordMethod, nil, nil)
+		if !errors.Is(err, ErrRateLimitExceeded) || calls != 1 {
+			t.Errorf("wanted rate limit error without a request but got %v after %v calls", err, calls)
+		}
+
+		if wait, retry := RetryAfter(err); retry {
+			t.Errorf("wanted no retry past MaxRateLimitWait but got %v", wait)
+		}
+	})
+
+	t.Run("other methods are unaffected", func(t *testing.T) {
+		if err := c.Procedure(context.Background(), UploadBlobMethod, nil, nil); err != nil || calls != 2 {
+			t.Errorf("wanted request to be sent but got %v", err)
+		}
+	})
+}